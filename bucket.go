@@ -0,0 +1,217 @@
+package gokvstore
+
+import (
+	"errors"
+	"strings"
+	"unicode/utf8"
+)
+
+// buckets live in the same table as the rest of the store:
+//
+//	"\x01B\x01" + name            the bucket registry entry
+//	"\x01b\x01" + name + "\x01" + k  the key k of the bucket
+//
+// bucket names can't contain control characters, so the data of a bucket
+// is exactly the key range ["\x01b\x01" + name + "\x01", "\x01b\x01" + name + "\x02")
+const (
+	bucketRegistryPrefix = "\x01B\x01"
+	bucketRegistryEnd    = "\x01B\x02"
+	bucketDataPrefix     = "\x01b\x01"
+)
+
+// ErrInvalidBucketName is returned for empty bucket names
+// and for bucket names with control characters
+var ErrInvalidBucketName = errors.New("gokvstore: invalid bucket name")
+
+// Bucket is a named namespace of keys inside a store.
+// Bucket handles are cheap, all the buckets of a store share its prepared statements
+type Bucket struct {
+	Name   string
+	prefix string
+	end    string
+	err    error
+	kv
+}
+
+func newBucket(c kv, name string) *Bucket {
+	b := &Bucket{
+		Name:   name,
+		prefix: bucketDataPrefix + name + "\x01",
+		end:    bucketDataPrefix + name + "\x02",
+		kv:     c,
+	}
+	if !validBucketName(name) {
+		b.err = ErrInvalidBucketName
+	}
+	return b
+}
+
+func validBucketName(name string) bool {
+	if name == "" || !utf8.ValidString(name) {
+		return false
+	}
+	for _, r := range name {
+		if r < 0x20 || r == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+func createBucket(c kv, name string) (*Bucket, error) {
+	b := newBucket(c, name)
+	if b.err != nil {
+		return nil, b.err
+	}
+	err := c.addValueKVT(bucketRegistryPrefix+name, "{}", "")
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func dropBucket(c kv, name string) error {
+	b := newBucket(c, name)
+	if b.err != nil {
+		return b.err
+	}
+	_, err := c.deleteInternalRange(b.prefix, b.end)
+	if err != nil {
+		return err
+	}
+	_, err = c.deleteValue(bucketRegistryPrefix + name)
+	return err
+}
+
+func listBuckets(c kv) ([]string, error) {
+	names := []string{}
+	err := c.iterateByKeyRange(
+		false,
+		bucketRegistryPrefix,
+		bucketRegistryEnd,
+		noLimit,
+		func(k *string, t *string, v *string, stop *bool) {
+			names = append(names, strings.TrimPrefix(*k, bucketRegistryPrefix))
+		})
+	return names, err
+}
+
+// Bucket get a handle to the bucket name, the handle shares the transaction
+func (tx *Tx) Bucket(name string) *Bucket {
+	return newBucket(tx.kv, name)
+}
+
+// CreateBucket register the bucket name, creating an existing bucket is a no-op
+func (tx *Tx) CreateBucket(name string) (*Bucket, error) {
+	return createBucket(tx.kv, name)
+}
+
+// DropBucket delete all the data of the bucket name and unregister it
+func (tx *Tx) DropBucket(name string) error {
+	return dropBucket(tx.kv, name)
+}
+
+// ListBuckets list the names of all the registered buckets in ASC order
+func (tx *Tx) ListBuckets() ([]string, error) {
+	return listBuckets(tx.kv)
+}
+
+// AddValueKVT add (k,v,t) to the bucket
+func (b *Bucket) AddValueKVT(k string, v string, t string) error {
+	if b.err != nil {
+		return b.err
+	}
+	return b.addValueKVT(b.prefix+k, v, t)
+}
+
+// AddValueKV add (k,v) to the bucket
+func (b *Bucket) AddValueKV(k string, v string) error {
+	return b.AddValueKVT(k, v, "")
+}
+
+// AddValueAsJSON add (k, t, json(o)) to the bucket
+func (b *Bucket) AddValueAsJSON(k string, t string, o interface{}) error {
+	if b.err != nil {
+		return b.err
+	}
+	return b.addValueAsJSON(b.prefix+k, t, o)
+}
+
+// GetValue get the value for the given k, nil if k is not in the bucket
+func (b *Bucket) GetValue(k string) (*string, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	return b.getValue(b.prefix + k)
+}
+
+// GetValueAsJSON get the value for the given k into o
+func (b *Bucket) GetValueAsJSON(k string, o interface{}) error {
+	if b.err != nil {
+		return b.err
+	}
+	return b.getValueAsJSON(b.prefix+k, o)
+}
+
+// DeleteValue delete k from the bucket, get the number of deleted keys
+func (b *Bucket) DeleteValue(k string) (int64, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	return b.deleteValue(b.prefix + k)
+}
+
+// DeleteAll delete all the data in the bucket, the bucket stays registered.
+// Get the number of deleted keys
+func (b *Bucket) DeleteAll() (int64, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	return b.deleteInternalRange(b.prefix, b.end)
+}
+
+// IterateByKeyRangeASC traverse the items of the bucket with begin <= key < end in ASC order,
+// an empty end means the end of the bucket. The keys passed to block are relative to the bucket
+func (b *Bucket) IterateByKeyRangeASC(
+	begin string,
+	end string,
+	limit int,
+	block func(k *string, t *string, v *string, stop *bool)) error {
+	return b.iterateByKeyRange(false, begin, end, limit, block)
+}
+
+// IterateByKeyRangeDESC traverse the items of the bucket with begin <= key < end in DESC order,
+// an empty end means the end of the bucket. The keys passed to block are relative to the bucket
+func (b *Bucket) IterateByKeyRangeDESC(
+	begin string,
+	end string,
+	limit int,
+	block func(k *string, t *string, v *string, stop *bool)) error {
+	return b.iterateByKeyRange(true, begin, end, limit, block)
+}
+
+func (b *Bucket) iterateByKeyRange(
+	desc bool,
+	begin string,
+	end string,
+	limit int,
+	block func(k *string, t *string, v *string, stop *bool)) error {
+	if b.err != nil {
+		return b.err
+	}
+
+	end = b.prefix + end
+	if end == b.prefix {
+		end = b.end
+	}
+
+	return b.kv.iterateByKeyRange(
+		desc,
+		b.prefix+begin,
+		end,
+		limit,
+		func(k *string, t *string, v *string, stop *bool) {
+			key := strings.TrimPrefix(*k, b.prefix)
+			block(&key, t, v, stop)
+		})
+}
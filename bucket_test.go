@@ -0,0 +1,138 @@
+package gokvstore_test
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/korovkin/gokvstore"
+
+	. "github.com/onsi/gomega"
+)
+
+// bucketStore the bucket API shared by StoreSqlite and StorePostgres
+type bucketStore interface {
+	Bucket(name string) *gokvstore.Bucket
+	CreateBucket(name string) (*gokvstore.Bucket, error)
+	DropBucket(name string) error
+	ListBuckets() ([]string, error)
+	Update(block func(tx *gokvstore.Tx) error) error
+}
+
+func bucketKeys(g *GomegaWithT, b *gokvstore.Bucket) []string {
+	list := []string{}
+	err := b.IterateByKeyRangeASC(
+		"",
+		"",
+		1000,
+		func(k *string, t *string, v *string, stop *bool) {
+			list = append(list, *k)
+		})
+	g.Expect(err).To(BeNil())
+	return list
+}
+
+func checkBuckets(g *GomegaWithT, s bucketStore) {
+	users, err := s.CreateBucket("users")
+	g.Expect(err).To(BeNil())
+	orders, err := s.CreateBucket("orders")
+	g.Expect(err).To(BeNil())
+	_, err = s.CreateBucket("users")
+	g.Expect(err).To(BeNil())
+
+	names, err := s.ListBuckets()
+	g.Expect(err).To(BeNil())
+	g.Expect(names).To(Equal([]string{"orders", "users"}))
+
+	g.Expect(users.AddValueKV("1", `"superman"`)).To(BeNil())
+	g.Expect(users.AddValueKV("2", `"batman"`)).To(BeNil())
+	g.Expect(orders.AddValueKV("1", `"cape"`)).To(BeNil())
+
+	v, err := users.GetValue("1")
+	g.Expect(err).To(BeNil())
+	g.Expect(*v).To(Equal(`"superman"`))
+
+	v, err = orders.GetValue("1")
+	g.Expect(err).To(BeNil())
+	g.Expect(*v).To(Equal(`"cape"`))
+
+	v, err = orders.GetValue("2")
+	g.Expect(err).To(BeNil())
+	g.Expect(v).To(BeNil())
+
+	g.Expect(bucketKeys(g, users)).To(Equal([]string{"1", "2"}))
+	g.Expect(bucketKeys(g, orders)).To(Equal([]string{"1"}))
+
+	// a failed transaction doesn't change any bucket
+	errAbort := errors.New("abort")
+	err = s.Update(func(tx *gokvstore.Tx) error {
+		g.Expect(tx.Bucket("users").AddValueKV("3", `"robin"`)).To(BeNil())
+		g.Expect(tx.Bucket("orders").DeleteValue("1")).To(BeEquivalentTo(1))
+		return errAbort
+	})
+	g.Expect(err).To(Equal(errAbort))
+	g.Expect(bucketKeys(g, users)).To(Equal([]string{"1", "2"}))
+	g.Expect(bucketKeys(g, orders)).To(Equal([]string{"1"}))
+
+	// a committed transaction changes all the buckets
+	err = s.Update(func(tx *gokvstore.Tx) error {
+		err := tx.Bucket("users").AddValueKV("3", `"robin"`)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Bucket("orders").DeleteValue("1")
+		return err
+	})
+	g.Expect(err).To(BeNil())
+	g.Expect(bucketKeys(g, users)).To(Equal([]string{"1", "2", "3"}))
+	g.Expect(bucketKeys(g, orders)).To(Equal([]string{}))
+
+	g.Expect(orders.DeleteValue("1")).To(BeEquivalentTo(0))
+	g.Expect(users.DeleteAll()).To(BeEquivalentTo(3))
+	g.Expect(users.DeleteAll()).To(BeEquivalentTo(0))
+	_, err = s.Bucket("a\x01b").DeleteAll()
+	g.Expect(err).To(Equal(gokvstore.ErrInvalidBucketName))
+
+	err = s.DropBucket("users")
+	g.Expect(err).To(BeNil())
+	g.Expect(bucketKeys(g, s.Bucket("users"))).To(Equal([]string{}))
+
+	names, err = s.ListBuckets()
+	g.Expect(err).To(BeNil())
+	g.Expect(names).To(Equal([]string{"orders"}))
+
+	_, err = s.CreateBucket("")
+	g.Expect(err).To(Equal(gokvstore.ErrInvalidBucketName))
+	err = s.Bucket("a\x01b").AddValueKV("k", `"v"`)
+	g.Expect(err).To(Equal(gokvstore.ErrInvalidBucketName))
+}
+
+func TestSqliteBuckets(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	os.RemoveAll("kv_test_buckets.db")
+	defer os.RemoveAll("kv_test_buckets.db")
+
+	s, err := gokvstore.NewStoreSqlite("kv_test_buckets", ".")
+	g.Expect(err).To(BeNil())
+	defer s.Close()
+
+	checkBuckets(g, s)
+}
+
+func TestPQBuckets(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	s, err := gokvstore.NewStorePostgresWithValueType(
+		"test_buckets",
+		"jsonb",
+		"host=localhost user=test password=test dbname=test sslmode=disable",
+		nil)
+	g.Expect(err).To(BeNil())
+	defer s.Close()
+
+	s.DeleteAll()
+	defer s.DeleteAll()
+
+	checkBuckets(g, s)
+}
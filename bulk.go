@@ -0,0 +1,81 @@
+package gokvstore
+
+import (
+	"context"
+)
+
+// bulkProgressEvery how many entries a bulk load writes between progress reports
+const bulkProgressEvery = 10000
+
+// Entry is a (key, value, tag) item of a store
+type Entry struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	Tag   string `json:"tag"`
+}
+
+// EntryIterator yields the entries of a bulk load
+type EntryIterator interface {
+	// Next get the next entry, ok is false after the last entry
+	Next() (entry Entry, ok bool, err error)
+}
+
+// EntryIteratorFunc adapt a function to EntryIterator
+type EntryIteratorFunc func() (Entry, bool, error)
+
+// Next call f
+func (f EntryIteratorFunc) Next() (Entry, bool, error) {
+	return f()
+}
+
+// SliceIterator iterate over entries
+func SliceIterator(entries []Entry) EntryIterator {
+	i := 0
+	return EntryIteratorFunc(func() (Entry, bool, error) {
+		if i >= len(entries) {
+			return Entry{}, false, nil
+		}
+		i++
+		return entries[i-1], true, nil
+	})
+}
+
+// loadEntries write all the entries of it with write,
+// progress (when not nil) is called with the number of entries written so far
+func loadEntries(
+	ctx context.Context,
+	it EntryIterator,
+	progress func(loaded int64),
+	write func(e Entry) error) (int64, error) {
+	var loaded int64
+	for {
+		entry, ok, err := it.Next()
+		if err != nil {
+			return loaded, err
+		}
+		if !ok {
+			break
+		}
+
+		err = write(entry)
+		if err != nil {
+			return loaded, err
+		}
+
+		loaded++
+		if loaded%bulkProgressEvery == 0 {
+			err = ctx.Err()
+			if err != nil {
+				return loaded, err
+			}
+			if progress != nil {
+				progress(loaded)
+			}
+		}
+	}
+
+	if progress != nil && loaded%bulkProgressEvery != 0 {
+		progress(loaded)
+	}
+	return loaded, nil
+}
@@ -0,0 +1,117 @@
+package gokvstore_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/korovkin/gokvstore"
+
+	. "github.com/onsi/gomega"
+)
+
+// bulkStore the bulk load API shared by StoreSqlite and StorePostgres
+type bulkStore interface {
+	BulkLoad(ctx context.Context, it gokvstore.EntryIterator, progress func(loaded int64)) (int64, error)
+	GetValue(k string) *string
+	CountAll() (int64, string, string)
+}
+
+// numberedEntries iterate over n entries, failing with err (when not nil) at entry failAt
+func numberedEntries(n int, failAt int, err error) gokvstore.EntryIterator {
+	i := 0
+	return gokvstore.EntryIteratorFunc(func() (gokvstore.Entry, bool, error) {
+		if i == failAt && err != nil {
+			return gokvstore.Entry{}, false, err
+		}
+		if i >= n {
+			return gokvstore.Entry{}, false, nil
+		}
+		i++
+		return gokvstore.Entry{Key: fmt.Sprintf("k%06d", i), Value: strconv.Itoa(i), Tag: "bulk"}, true, nil
+	})
+}
+
+func checkBulkLoad(g *GomegaWithT, s bulkStore) {
+	ctx := context.Background()
+
+	progress := []int64{}
+	loaded, err := s.BulkLoad(ctx, numberedEntries(25000, 0, nil), func(loaded int64) {
+		progress = append(progress, loaded)
+	})
+	g.Expect(err).To(BeNil())
+	g.Expect(loaded).To(Equal(int64(25000)))
+	g.Expect(progress).To(Equal([]int64{10000, 20000, 25000}))
+
+	count, min, max := s.CountAll()
+	g.Expect(count).To(Equal(int64(25000)))
+	g.Expect(min).To(Equal("k000001"))
+	g.Expect(max).To(Equal("k025000"))
+	g.Expect(*s.GetValue("k012345")).To(Equal("12345"))
+
+	// existing keys are replaced, the last duplicate wins
+	loaded, err = s.BulkLoad(ctx, gokvstore.SliceIterator([]gokvstore.Entry{
+		{Key: "k000001", Value: `"first"`, Tag: "t"},
+		{Key: "new", Value: `"a"`, Tag: "t"},
+		{Key: "new", Value: `"b"`, Tag: "t"},
+	}), nil)
+	g.Expect(err).To(BeNil())
+	g.Expect(loaded).To(Equal(int64(3)))
+	g.Expect(*s.GetValue("k000001")).To(Equal(`"first"`))
+	g.Expect(*s.GetValue("new")).To(Equal(`"b"`))
+
+	count, _, _ = s.CountAll()
+	g.Expect(count).To(Equal(int64(25001)))
+
+	// nothing is written when the iterator fails
+	failure := errors.New("failure")
+	loaded, err = s.BulkLoad(ctx, numberedEntries(50000, 15000, failure), nil)
+	g.Expect(err).To(Equal(failure))
+	g.Expect(loaded).To(Equal(int64(0)))
+	g.Expect(s.GetValue("k025001")).To(BeNil())
+
+	// or when ctx is done
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	loaded, err = s.BulkLoad(ctx, numberedEntries(50000, 0, nil), func(loaded int64) {
+		cancel()
+	})
+	g.Expect(err).To(Equal(context.Canceled))
+	g.Expect(loaded).To(Equal(int64(0)))
+	g.Expect(s.GetValue("k025001")).To(BeNil())
+
+	count, _, _ = s.CountAll()
+	g.Expect(count).To(Equal(int64(25001)))
+}
+
+func TestSqliteBulkLoad(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	os.RemoveAll("kv_test_bulk.db")
+	defer os.RemoveAll("kv_test_bulk.db")
+
+	s, err := gokvstore.NewStoreSqlite("kv_test_bulk", ".")
+	g.Expect(err).To(BeNil())
+	defer s.Close()
+
+	checkBulkLoad(g, s)
+}
+
+func TestPQBulkLoad(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	s, err := gokvstore.NewStorePostgres(
+		"test_bulk",
+		"host=localhost user=test password=test dbname=test sslmode=disable",
+		nil)
+	g.Expect(err).To(BeNil())
+	defer s.Close()
+
+	s.DeleteAll()
+	defer s.DeleteAll()
+
+	checkBulkLoad(g, s)
+}
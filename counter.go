@@ -0,0 +1,125 @@
+package gokvstore
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/rand"
+
+	"github.com/korovkin/gotils"
+)
+
+// ErrNotCounter is returned by Incr for a key whose value is not an integer
+var ErrNotCounter = errors.New("gokvstore: the value is not a counter")
+
+// counters are stored as decimal integers, a valid JSON number for every value type
+
+func (c kv) incr(k string, delta int64) (int64, error) {
+	if c.readOnly {
+		return 0, ErrReadOnly
+	}
+
+	var v int64
+	op := func() error {
+		return c.stmt(c.stmts.incr).QueryRow(k, delta).Scan(&v)
+	}
+
+	var err error
+	if c.tx == nil {
+		err = c.retry.do(op)
+	} else {
+		err = op()
+	}
+	if err == sql.ErrNoRows {
+		// the update is skipped for values that are not integers
+		err = fmt.Errorf("%w: %q", ErrNotCounter, k)
+	}
+	gotils.CheckNotFatal(err)
+	return v, err
+}
+
+func (c kv) sumRange(begin string, end string) (int64, error) {
+	err := c.check()
+	if err != nil {
+		return 0, err
+	}
+
+	var sum int64
+	err = c.stmt(c.stmts.sumRange).QueryRow(begin, end).Scan(&sum)
+	gotils.CheckNotFatal(err)
+	return sum, err
+}
+
+// Incr atomically add delta to the counter k (a missing k counts from 0), get the new value
+func (tx *Tx) Incr(k string, delta int64) (int64, error) {
+	return tx.incr(k, delta)
+}
+
+// Decr atomically subtract delta from the counter k (a missing k counts from 0), get the new value
+func (tx *Tx) Decr(k string, delta int64) (int64, error) {
+	return tx.incr(k, -delta)
+}
+
+// ShardedCounter get the sharded counter k under the transaction
+func (tx *Tx) ShardedCounter(k string, shards int) *ShardedCounter {
+	return newShardedCounter(tx.kv, k, shards)
+}
+
+// Incr atomically add delta to the counter k of the bucket, get the new value
+func (b *Bucket) Incr(k string, delta int64) (int64, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	return b.incr(b.prefix+k, delta)
+}
+
+// Decr atomically subtract delta from the counter k of the bucket, get the new value
+func (b *Bucket) Decr(k string, delta int64) (int64, error) {
+	return b.Incr(k, -delta)
+}
+
+// ShardedCounter is a counter spread over several rows, the increments of a hot
+// counter go to a random shard and don't wait for each other, reads sum the shards.
+// Shard i is stored under Key + "\x01#" + i
+type ShardedCounter struct {
+	Key    string
+	Shards int
+	kv
+}
+
+func newShardedCounter(c kv, k string, shards int) *ShardedCounter {
+	if shards < 1 {
+		shards = 1
+	}
+	return &ShardedCounter{Key: k, Shards: shards, kv: c}
+}
+
+func (sc *ShardedCounter) begin() string {
+	return sc.Key + "\x01#"
+}
+
+func (sc *ShardedCounter) end() string {
+	return sc.Key + "\x01$"
+}
+
+// Incr atomically add delta to a random shard
+func (sc *ShardedCounter) Incr(delta int64) error {
+	_, err := sc.incr(fmt.Sprintf("%s%04d", sc.begin(), rand.Intn(sc.Shards)), delta)
+	return err
+}
+
+// Decr atomically subtract delta from a random shard
+func (sc *ShardedCounter) Decr(delta int64) error {
+	return sc.Incr(-delta)
+}
+
+// Value get the sum of the shards
+func (sc *ShardedCounter) Value() (int64, error) {
+	return sc.sumRange(sc.begin(), sc.end())
+}
+
+// Delete delete all the shards
+func (sc *ShardedCounter) Delete() error {
+	_, err := sc.deleteRange(sc.begin(), sc.end())
+	return err
+}
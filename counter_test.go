@@ -0,0 +1,152 @@
+package gokvstore_test
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/korovkin/gokvstore"
+
+	. "github.com/onsi/gomega"
+)
+
+// counterStore the counter API shared by StoreSqlite and StorePostgres
+type counterStore interface {
+	Incr(k string, delta int64) (int64, error)
+	Decr(k string, delta int64) (int64, error)
+	ShardedCounter(k string, shards int) *gokvstore.ShardedCounter
+	AddValueKVT(k string, v string, t string) error
+	GetValue(k string) *string
+	Update(block func(tx *gokvstore.Tx) error) error
+	Bucket(name string) *gokvstore.Bucket
+}
+
+// concurrently run n times block in each of workers goroutines
+func concurrently(workers int, n int, block func()) {
+	wg := sync.WaitGroup{}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				block()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func checkCounters(g *GomegaWithT, s counterStore) {
+	v, err := s.Incr("hits", 5)
+	g.Expect(err).To(BeNil())
+	g.Expect(v).To(Equal(int64(5)))
+
+	v, err = s.Decr("hits", 7)
+	g.Expect(err).To(BeNil())
+	g.Expect(v).To(Equal(int64(-2)))
+	g.Expect(*s.GetValue("hits")).To(Equal("-2"))
+
+	v, err = s.Decr("misses", 1)
+	g.Expect(err).To(BeNil())
+	g.Expect(v).To(Equal(int64(-1)))
+
+	// no lost increments
+	concurrently(8, 50, func() {
+		_, err := s.Incr("hits", 1)
+		g.Expect(err).To(BeNil())
+	})
+	v, err = s.Incr("hits", 0)
+	g.Expect(err).To(BeNil())
+	g.Expect(v).To(Equal(int64(398)))
+
+	// values that are not integers are left alone
+	g.Expect(s.AddValueKVT("name", `"abc"`, "t")).To(BeNil())
+	_, err = s.Incr("name", 1)
+	g.Expect(errors.Is(err, gokvstore.ErrNotCounter)).To(BeTrue())
+	g.Expect(*s.GetValue("name")).To(Equal(`"abc"`))
+	g.Expect(s.AddValueKVT("quoted", `"5"`, "t")).To(BeNil())
+	_, err = s.Incr("quoted", 1)
+	g.Expect(errors.Is(err, gokvstore.ErrNotCounter)).To(BeTrue())
+	g.Expect(*s.GetValue("quoted")).To(Equal(`"5"`))
+
+	// transactions
+	failure := errors.New("failure")
+	err = s.Update(func(tx *gokvstore.Tx) error {
+		v, err := tx.Incr("hits", 2)
+		g.Expect(err).To(BeNil())
+		g.Expect(v).To(Equal(int64(400)))
+		return failure
+	})
+	g.Expect(err).To(Equal(failure))
+	g.Expect(*s.GetValue("hits")).To(Equal("398"))
+
+	// buckets
+	b := s.Bucket("stats")
+	v, err = b.Incr("hits", 3)
+	g.Expect(err).To(BeNil())
+	g.Expect(v).To(Equal(int64(3)))
+	v, err = b.Decr("hits", 1)
+	g.Expect(err).To(BeNil())
+	g.Expect(v).To(Equal(int64(2)))
+	g.Expect(*s.GetValue("hits")).To(Equal("398"))
+
+	// sharded counters
+	sc := s.ShardedCounter("views", 4)
+	concurrently(8, 50, func() {
+		g.Expect(sc.Incr(2)).To(BeNil())
+	})
+	g.Expect(sc.Decr(10)).To(BeNil())
+	total, err := sc.Value()
+	g.Expect(err).To(BeNil())
+	g.Expect(total).To(Equal(int64(790)))
+	g.Expect(s.GetValue("views")).To(BeNil())
+
+	other, err := s.ShardedCounter("views2", 4).Value()
+	g.Expect(err).To(BeNil())
+	g.Expect(other).To(Equal(int64(0)))
+
+	err = s.Update(func(tx *gokvstore.Tx) error {
+		return tx.ShardedCounter("views", 4).Incr(10)
+	})
+	g.Expect(err).To(BeNil())
+	total, err = sc.Value()
+	g.Expect(err).To(BeNil())
+	g.Expect(total).To(Equal(int64(800)))
+
+	g.Expect(sc.Delete()).To(BeNil())
+	total, err = sc.Value()
+	g.Expect(err).To(BeNil())
+	g.Expect(total).To(Equal(int64(0)))
+}
+
+func TestSqliteCounters(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	os.RemoveAll("kv_test_counters.db")
+	defer os.RemoveAll("kv_test_counters.db")
+
+	s, err := gokvstore.NewStoreSqlite("kv_test_counters", ".")
+	g.Expect(err).To(BeNil())
+	defer s.CloseAndDelete()
+
+	checkCounters(g, s)
+}
+
+func TestPQCounters(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	for _, valueType := range []string{"jsonb", "json", "text"} {
+		s, err := gokvstore.NewStorePostgresWithValueType(
+			"test_counters_"+valueType,
+			valueType,
+			"host=localhost user=test password=test dbname=test sslmode=disable",
+			nil)
+		g.Expect(err).To(BeNil())
+
+		s.DeleteAll()
+		checkCounters(g, s)
+		s.DeleteAll()
+		s.Close()
+	}
+}
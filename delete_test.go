@@ -0,0 +1,143 @@
+package gokvstore_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/korovkin/gokvstore"
+
+	. "github.com/onsi/gomega"
+)
+
+type deleteStore interface {
+	AddValueKVT(k string, v string, t string) error
+	DeleteValue(k string) (int64, error)
+	DeleteAllWithTag(t string) (int64, error)
+	DeleteAll() (int64, error)
+	DeletePrefix(prefix string) (int64, error)
+	DeleteRange(begin string, end string) (int64, error)
+	CountPrefix(prefix string) (int64, error)
+	CountRange(begin string, end string) (int64, error)
+	CreateBucket(name string) (*gokvstore.Bucket, error)
+	DropBucket(name string) error
+	ListBuckets() ([]string, error)
+	TryLock(name string, ttl time.Duration) (*gokvstore.Lock, error)
+	Queue(name string, options gokvstore.QueueOptions) *gokvstore.Queue
+	DryRun(block func(tx *gokvstore.Tx) error) ([]string, error)
+}
+
+func checkDeleteCounts(g *GomegaWithT, s deleteStore) {
+	for _, k := range []string{"a/1", "a/2", "a/3", "b/1", "b/2"} {
+		g.Expect(s.AddValueKVT(k, `{}`, k[:1])).To(BeNil())
+	}
+
+	g.Expect(s.DeleteValue("a/1")).To(BeEquivalentTo(1))
+	g.Expect(s.DeleteValue("a/1")).To(BeEquivalentTo(0))
+	g.Expect(s.DeleteAllWithTag("c")).To(BeEquivalentTo(0))
+
+	// a dry run gets the counts of the deletes and deletes nothing
+	var value, prefix, tag, all int64
+	deleted, err := s.DryRun(func(tx *gokvstore.Tx) error {
+		var err error
+		value, err = tx.DeleteValue("b/1")
+		if err != nil {
+			return err
+		}
+		prefix, err = tx.DeletePrefix("a/")
+		if err != nil {
+			return err
+		}
+		tag, err = tx.DeleteAllWithTag("b")
+		if err != nil {
+			return err
+		}
+		all, err = tx.DeleteAll()
+		return err
+	})
+	g.Expect(err).To(BeNil())
+	g.Expect([]int64{value, prefix, tag, all}).To(Equal([]int64{1, 2, 1, 0}))
+	g.Expect(deleted).To(Equal([]string{"b/1", "a/2", "a/3", "b/2"}))
+	g.Expect(s.CountPrefix("")).To(BeEquivalentTo(4))
+
+	failed := errors.New("failed")
+	deleted, err = s.DryRun(func(tx *gokvstore.Tx) error {
+		_, err := tx.DeleteAll()
+		g.Expect(err).To(BeNil())
+		return failed
+	})
+	g.Expect(err).To(Equal(failed))
+	g.Expect(deleted).To(BeNil())
+	g.Expect(s.CountPrefix("")).To(BeEquivalentTo(4))
+
+	g.Expect(s.DeleteAllWithTag("b")).To(BeEquivalentTo(2))
+	g.Expect(s.DeleteAll()).To(BeEquivalentTo(2))
+	g.Expect(s.DeleteAll()).To(BeEquivalentTo(0))
+
+	// the prefix and range deletes and counts skip the keys of buckets, locks and queues
+	b, err := s.CreateBucket("users")
+	g.Expect(err).To(BeNil())
+	g.Expect(b.AddValueKV("1", `{}`)).To(BeNil())
+	l, err := s.TryLock("job", time.Minute)
+	g.Expect(err).To(BeNil())
+	q := s.Queue("jobs", gokvstore.QueueOptions{})
+	_, err = q.Enqueue(`{}`, 0)
+	g.Expect(err).To(BeNil())
+	g.Expect(s.AddValueKVT("a/1", `{}`, "a")).To(BeNil())
+
+	g.Expect(s.CountPrefix("")).To(BeEquivalentTo(1))
+	g.Expect(s.CountRange("", "")).To(BeEquivalentTo(1))
+	deleted, err = s.DryRun(func(tx *gokvstore.Tx) error {
+		_, err := tx.DeletePrefix("")
+		return err
+	})
+	g.Expect(err).To(BeNil())
+	g.Expect(deleted).To(Equal([]string{"a/1"}))
+	g.Expect(s.DeletePrefix("")).To(BeEquivalentTo(1))
+	g.Expect(s.DeleteRange("", "")).To(BeEquivalentTo(0))
+
+	g.Expect(s.ListBuckets()).To(Equal([]string{"users"}))
+	g.Expect(b.GetValue("1")).ToNot(BeNil())
+	_, err = s.TryLock("job", time.Minute)
+	g.Expect(err).To(Equal(gokvstore.ErrLockHeld))
+	g.Expect(l.Unlock()).To(BeNil())
+	m, err := q.Dequeue()
+	g.Expect(err).To(BeNil())
+	g.Expect(m).ToNot(BeNil())
+	g.Expect(m.Ack()).To(BeNil())
+
+	// a bucket still deletes its own keys
+	g.Expect(b.DeleteAll()).To(BeEquivalentTo(1))
+	g.Expect(s.DropBucket("users")).To(BeNil())
+	g.Expect(s.ListBuckets()).To(BeEmpty())
+	s.DeleteAll()
+}
+
+func TestSqliteDeleteCounts(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	s, err := gokvstore.NewStoreSqlite("kv_test_delete", ".")
+	g.Expect(err).To(BeNil())
+	defer s.CloseAndDelete()
+
+	checkDeleteCounts(g, s)
+}
+
+func TestPQDeleteCounts(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	s, err := gokvstore.NewStorePostgres(
+		"test_delete",
+		"host=localhost user=test password=test dbname=test sslmode=disable",
+		nil)
+	g.Expect(err).To(BeNil())
+	defer s.Close()
+
+	s.DeleteAll()
+	defer s.DeleteAll()
+	checkDeleteCounts(g, s)
+
+	g.Expect(s.AddValueKVT("old", `{}`, "0001")).To(BeNil())
+	g.Expect(s.AddValueKVT("new", `{}`, "0002")).To(BeNil())
+	g.Expect(s.DeleteWhereTagLT("0002")).To(BeEquivalentTo(1))
+}
@@ -0,0 +1,316 @@
+package gokvstore
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// ImportMode what Import does with the keys that are already in the store
+type ImportMode int
+
+const (
+	// ImportOverwrite replace the existing values
+	ImportOverwrite ImportMode = iota
+	// ImportSkip keep the existing values
+	ImportSkip
+	// ImportFail fail the import (nothing is imported)
+	ImportFail
+)
+
+// ErrImportConflict is returned by Import in ImportFail mode for a key that is already in the store
+var ErrImportConflict = errors.New("gokvstore: import: the key is already in the store")
+
+// importedPrefix the keys of the imported entries that postgres can't store byte for byte,
+// the key is the base64 of the key of the entry and the value an importedEntry
+const importedPrefix = "\x01I\x01"
+
+// importedEntry an imported entry and what postgres stored for it. Export writes the
+// imported entry as long as the key has the stored value and tag.
+// The strings are base64, a jsonb string can't hold every string
+type importedEntry struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+	Tag   []byte `json:"tag"`
+	// Stored the key was stored, with StoredValue and StoredTag
+	Stored      bool   `json:"stored"`
+	StoredValue []byte `json:"stored_value,omitempty"`
+	StoredTag   []byte `json:"stored_tag,omitempty"`
+}
+
+// the encodings of the exported strings
+const (
+	// encodingJSON the value is embedded as is, it's compact JSON
+	encodingJSON = "json"
+	// encodingText the string is a JSON string
+	encodingText = "text"
+	// encodingBase64 the string is not valid UTF-8, a JSON string of its base64
+	encodingBase64 = "base64"
+)
+
+// exportLine a line of an export, the entry with how its strings are encoded
+type exportLine struct {
+	Key   json.RawMessage `json:"key"`
+	Value json.RawMessage `json:"value"`
+	Tag   json.RawMessage `json:"tag"`
+	Meta  exportMeta      `json:"meta"`
+}
+
+// exportMeta the encodings of a line, a missing encoding means text
+type exportMeta struct {
+	Encoding    string `json:"encoding,omitempty"`
+	KeyEncoding string `json:"key_encoding,omitempty"`
+	TagEncoding string `json:"tag_encoding,omitempty"`
+}
+
+// encodeString encode s as a JSON string, base64 if s is not valid UTF-8
+func encodeString(s string) (json.RawMessage, string, error) {
+	if !utf8.ValidString(s) {
+		b, err := json.Marshal(base64.StdEncoding.EncodeToString([]byte(s)))
+		return b, encodingBase64, err
+	}
+	b, err := marshalNoEscape(s)
+	return b, "", err
+}
+
+// encodeValue embed v as is when it's compact JSON, encode it as a string otherwise
+func encodeValue(v string) (json.RawMessage, string, error) {
+	if json.Valid([]byte(v)) {
+		b, err := marshalNoEscape(json.RawMessage(v))
+		if err == nil && string(b) == v {
+			return b, encodingJSON, nil
+		}
+	}
+
+	b, encoding, err := encodeString(v)
+	if encoding == "" {
+		encoding = encodingText
+	}
+	return b, encoding, err
+}
+
+// marshalNoEscape marshal o without escaping HTML characters
+func marshalNoEscape(o interface{}) ([]byte, error) {
+	buffer := bytes.Buffer{}
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+	err := encoder.Encode(o)
+	// Encode appends a new line
+	return bytes.TrimSuffix(buffer.Bytes(), []byte("\n")), err
+}
+
+// decodeString decode a string encoded with encodeString or encodeValue
+func decodeString(raw json.RawMessage, encoding string) (string, error) {
+	switch encoding {
+	case encodingJSON:
+		return string(raw), nil
+	case "", encodingText, encodingBase64:
+		var s string
+		err := json.Unmarshal(raw, &s)
+		if err != nil || encoding != encodingBase64 {
+			return s, err
+		}
+		b, err := base64.StdEncoding.DecodeString(s)
+		return string(b), err
+	default:
+		return "", fmt.Errorf("unknown encoding %q", encoding)
+	}
+}
+
+// importedKey the key of the importedEntry of k
+func importedKey(k string) string {
+	return importedPrefix + base64.StdEncoding.EncodeToString([]byte(k))
+}
+
+// importedEntries get the importedEntry values of c by their keys
+func importedEntries(c kv) (map[string]importedEntry, error) {
+	entries := map[string]importedEntry{}
+	err := c.iterateByKeyRange(false, importedPrefix, prefixEnd(importedPrefix), noLimit,
+		func(k *string, t *string, v *string, stop *bool) {
+			e := importedEntry{}
+			if json.Unmarshal([]byte(*v), &e) == nil {
+				entries[*k] = e
+			}
+		})
+	return entries, err
+}
+
+// exportEntries write all the entries of c to w, one JSON object per line
+func exportEntries(c kv, w io.Writer) (int64, error) {
+	imported, err := importedEntries(c)
+	if err != nil {
+		return 0, err
+	}
+
+	var exported int64
+	var encodeErr error
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+
+	write := func(k string, v string, t string) error {
+		line := exportLine{}
+		var err error
+		line.Key, line.Meta.KeyEncoding, err = encodeString(k)
+		if err == nil {
+			line.Tag, line.Meta.TagEncoding, err = encodeString(t)
+		}
+		if err == nil {
+			line.Value, line.Meta.Encoding, err = encodeValue(v)
+		}
+		if err == nil {
+			err = encoder.Encode(&line)
+		}
+		return err
+	}
+
+	err = c.iterateByKeyRange(false, "", "", noLimit, func(k *string, t *string, v *string, stop *bool) {
+		key, value, tag := *k, *v, *t
+		if e, ok := imported[key]; ok {
+			// the entries with a stored key are written with it
+			if e.Stored {
+				return
+			}
+			key, value, tag = string(e.Key), string(e.Value), string(e.Tag)
+		} else if e, ok := imported[importedKey(key)]; ok && e.Stored &&
+			string(e.StoredValue) == value && string(e.StoredTag) == tag {
+			value, tag = string(e.Value), string(e.Tag)
+		}
+
+		encodeErr = write(key, value, tag)
+		if encodeErr != nil {
+			*stop = true
+			return
+		}
+		exported++
+	})
+	if err == nil {
+		err = encodeErr
+	}
+	return exported, err
+}
+
+// postgresText can s be stored in a postgres text, it's valid UTF-8 without NUL
+func postgresText(s string) bool {
+	return utf8.ValidString(s) && !strings.Contains(s, "\x00")
+}
+
+// toPostgresText the closest string to s that postgres text can store
+func toPostgresText(s string) string {
+	return strings.ToValidUTF8(strings.Replace(s, "\x00", "", -1), "\uFFFD")
+}
+
+// toPostgresValue the closest value to v that a postgres store of valueType can store:
+// the values that are not JSON are JSON strings in json and jsonb stores
+func toPostgresValue(v string, valueType string) string {
+	if valueType == "text" {
+		return toPostgresText(v)
+	}
+	// jsonb can't store the NUL character of a JSON string
+	if json.Valid([]byte(v)) && postgresText(v) && !strings.Contains(v, `\u0000`) {
+		return v
+	}
+	b, _ := marshalNoEscape(toPostgresText(v))
+	return string(b)
+}
+
+// importEntry write e to c, get the number of written keys (0 when the key is already
+// in c and mode isn't ImportOverwrite). A postgres store of valueType stores the closest
+// entry it can and keeps e in an importedEntry when it can't store it byte for byte
+func importEntry(c kv, e Entry, mode ImportMode, valueType string) (int64, error) {
+	write := func(k string, v string, t string) (int64, error) {
+		if mode == ImportOverwrite {
+			return 1, c.addValueKVT(k, v, t)
+		}
+		res, err := c.stmt(c.stmts.insertNew).Exec(k, v, t)
+		if err != nil {
+			return 0, err
+		}
+		return res.RowsAffected()
+	}
+	keep := func(e importedEntry) (string, error) {
+		b, err := json.Marshal(e)
+		return string(b), err
+	}
+
+	if valueType == "" {
+		return write(e.Key, e.Value, e.Tag)
+	}
+
+	original := importedEntry{Key: []byte(e.Key), Value: []byte(e.Value), Tag: []byte(e.Tag)}
+	if !postgresText(e.Key) {
+		// the key can't be stored, only the imported entry is kept
+		v, err := keep(original)
+		if err != nil {
+			return 0, err
+		}
+		return write(importedKey(e.Key), v, "")
+	}
+
+	t := toPostgresText(e.Tag)
+	written, err := write(e.Key, toPostgresValue(e.Value, valueType), t)
+	if err != nil || written == 0 {
+		return written, err
+	}
+
+	// the text of the value postgres stored, jsonb normalizes the JSON
+	v, err := c.getValue(e.Key)
+	if err != nil {
+		return 0, err
+	}
+	if *v == e.Value && t == e.Tag {
+		_, err = c.deleteValue(importedKey(e.Key))
+		return written, err
+	}
+
+	original.Stored = true
+	original.StoredValue = []byte(*v)
+	original.StoredTag = []byte(t)
+	kept, err := keep(original)
+	if err != nil {
+		return 0, err
+	}
+	return written, c.addValueKVT(importedKey(e.Key), kept, "")
+}
+
+// importEntries write all the entries read from r to c (under a transaction),
+// valueType is the value type of a postgres store, empty for sqlite (see importEntry)
+func importEntries(c kv, r io.Reader, mode ImportMode, valueType string) (int64, error) {
+	var imported int64
+	decoder := json.NewDecoder(r)
+	for line := 1; ; line++ {
+		l := exportLine{}
+		err := decoder.Decode(&l)
+		if err == io.EOF {
+			return imported, nil
+		}
+		if err != nil {
+			return imported, fmt.Errorf("gokvstore: import: line %d: %w", line, err)
+		}
+
+		e := Entry{}
+		e.Key, err = decodeString(l.Key, l.Meta.KeyEncoding)
+		if err == nil {
+			e.Tag, err = decodeString(l.Tag, l.Meta.TagEncoding)
+		}
+		if err == nil {
+			e.Value, err = decodeString(l.Value, l.Meta.Encoding)
+		}
+		if err != nil {
+			return imported, fmt.Errorf("gokvstore: import: line %d: %w", line, err)
+		}
+
+		added, err := importEntry(c, e, mode, valueType)
+		if err != nil {
+			return imported, err
+		}
+		if added == 0 && mode == ImportFail {
+			return imported, fmt.Errorf("%w: line %d: %q", ErrImportConflict, line, e.Key)
+		}
+		imported += added
+	}
+}
@@ -0,0 +1,245 @@
+package gokvstore_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/korovkin/gokvstore"
+	"github.com/korovkin/gokvstore/tuple"
+
+	. "github.com/onsi/gomega"
+)
+
+// exportEntries entries that exercise every encoding of the export
+func exportEntries(g *GomegaWithT) []gokvstore.Entry {
+	tupleKey, err := tuple.Pack("users", int64(42))
+	g.Expect(err).To(BeNil())
+
+	entries := []gokvstore.Entry{
+		{Key: "compact", Value: `{"a":[1,2.50,"<b>&"]}`, Tag: "t"},
+		{Key: "spaced", Value: `{ "a": 1 }`, Tag: "t"},
+		{Key: "number", Value: `1e3`, Tag: ""},
+		{Key: "string", Value: `"s"`, Tag: "t"},
+		{Key: "text", Value: "not json\n\ttabs <&>", Tag: "t"},
+		{Key: "empty", Value: "", Tag: "t"},
+		{Key: "unicode ключ 🔑", Value: "значение", Tag: "метка"},
+		{Key: tupleKey, Value: `{}`, Tag: "\x01tag"},
+		{Key: "invalid \xff", Value: "\xfe\xff", Tag: "\xc3"},
+	}
+	return entries
+}
+
+func exportLines(g *GomegaWithT, export string) []map[string]interface{} {
+	lines := []map[string]interface{}{}
+	for _, l := range strings.Split(strings.TrimSuffix(export, "\n"), "\n") {
+		line := map[string]interface{}{}
+		g.Expect(json.Unmarshal([]byte(l), &line)).To(BeNil())
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// exportStore the export API shared by StoreSqlite and StorePostgres
+type exportStore interface {
+	Export(w io.Writer) (int64, error)
+	Import(r io.Reader, mode gokvstore.ImportMode) (int64, error)
+	AddValueKVT(k string, v string, t string) error
+}
+
+// checkExport export a sqlite store, import the export into the empty store dst and
+// the export of dst into another sqlite store: the entries are the same byte for byte
+func checkExport(g *GomegaWithT, dst exportStore) {
+	for _, f := range []string{"kv_test_export_src.db", "kv_test_export_back.db"} {
+		os.RemoveAll(f)
+		defer os.RemoveAll(f)
+	}
+
+	src, err := gokvstore.NewStoreSqlite("kv_test_export_src", ".")
+	g.Expect(err).To(BeNil())
+	defer src.Close()
+
+	entries := append(exportEntries(g),
+		gokvstore.Entry{Key: "nul \x00 key", Value: `{"a":1}`, Tag: "t"},
+		gokvstore.Entry{Key: "nul value", Value: "a\x00b", Tag: "t\x00"},
+		gokvstore.Entry{Key: "nul string", Value: `"a\u0000b"`, Tag: "t"},
+		gokvstore.Entry{Key: "jsonb order", Value: `{"b":1,"a":2,"a":3}`, Tag: "t"})
+	for _, e := range entries {
+		g.Expect(src.AddValueKVT(e.Key, e.Value, e.Tag)).To(BeNil())
+	}
+
+	export := bytes.Buffer{}
+	_, err = src.Export(&export)
+	g.Expect(err).To(BeNil())
+
+	imported, err := dst.Import(bytes.NewReader(export.Bytes()), gokvstore.ImportFail)
+	g.Expect(err).To(BeNil())
+	g.Expect(imported).To(Equal(int64(len(entries))))
+
+	_, err = dst.Import(bytes.NewReader(export.Bytes()), gokvstore.ImportFail)
+	g.Expect(errors.Is(err, gokvstore.ErrImportConflict)).To(BeTrue())
+
+	reexport := bytes.Buffer{}
+	exported, err := dst.Export(&reexport)
+	g.Expect(err).To(BeNil())
+	g.Expect(exported).To(Equal(int64(len(entries))))
+
+	back, err := gokvstore.NewStoreSqlite("kv_test_export_back", ".")
+	g.Expect(err).To(BeNil())
+	defer back.Close()
+
+	_, err = back.Import(bytes.NewReader(reexport.Bytes()), gokvstore.ImportFail)
+	g.Expect(err).To(BeNil())
+	for _, e := range entries {
+		v := back.GetValue(e.Key)
+		g.Expect(v).NotTo(BeNil())
+		g.Expect([]byte(*v)).To(Equal([]byte(e.Value)))
+	}
+	backExport := bytes.Buffer{}
+	_, err = back.Export(&backExport)
+	g.Expect(err).To(BeNil())
+	g.Expect(backExport.Bytes()).To(Equal(export.Bytes()))
+
+	// a changed entry is exported as it is now
+	g.Expect(dst.AddValueKVT("spaced", `{"b":2}`, "t")).To(BeNil())
+	reexport.Reset()
+	_, err = dst.Export(&reexport)
+	g.Expect(err).To(BeNil())
+	g.Expect(reexport.String()).NotTo(ContainSubstring(`{ \"a\": 1 }`))
+	g.Expect(reexport.String()).To(ContainSubstring(`"key":"spaced"`))
+}
+
+func TestSqliteExportImport(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	for _, f := range []string{"kv_test_export.db", "kv_test_import.db"} {
+		os.RemoveAll(f)
+		defer os.RemoveAll(f)
+	}
+
+	src, err := gokvstore.NewStoreSqlite("kv_test_export", ".")
+	g.Expect(err).To(BeNil())
+	defer src.Close()
+
+	entries := exportEntries(g)
+	for _, e := range entries {
+		g.Expect(src.AddValueKVT(e.Key, e.Value, e.Tag)).To(BeNil())
+	}
+
+	export := bytes.Buffer{}
+	exported, err := src.Export(&export)
+	g.Expect(err).To(BeNil())
+	g.Expect(exported).To(Equal(int64(len(entries))))
+
+	// one object per line, in key order
+	lines := exportLines(g, export.String())
+	g.Expect(lines).To(HaveLen(len(entries)))
+	keys := []string{}
+	for _, line := range lines {
+		if line["meta"].(map[string]interface{})["key_encoding"] == nil {
+			keys = append(keys, line["key"].(string))
+		}
+	}
+	g.Expect(keys).To(HaveLen(len(entries) - 1))
+	for i := 1; i < len(keys); i++ {
+		g.Expect(keys[i-1] < keys[i]).To(BeTrue())
+	}
+	for _, line := range lines {
+		switch line["key"] {
+		case "compact":
+			g.Expect(line["value"]).To(Equal(map[string]interface{}{"a": []interface{}{1.0, 2.5, "<b>&"}}))
+			g.Expect(line["meta"]).To(Equal(map[string]interface{}{"encoding": "json"}))
+		case "spaced":
+			g.Expect(line["value"]).To(Equal(`{ "a": 1 }`))
+			g.Expect(line["meta"]).To(Equal(map[string]interface{}{"encoding": "text"}))
+		case "text":
+			g.Expect(line["value"]).To(Equal("not json\n\ttabs <&>"))
+			g.Expect(line["tag"]).To(Equal("t"))
+		}
+	}
+	g.Expect(export.String()).To(ContainSubstring(`"value":{"a":[1,2.50,"<b>&"]}`))
+	g.Expect(export.String()).To(ContainSubstring(
+		`"key":"aW52YWxpZCD/","value":"/v8=","tag":"ww==",` +
+			`"meta":{"encoding":"base64","key_encoding":"base64","tag_encoding":"base64"}`))
+
+	dst, err := gokvstore.NewStoreSqlite("kv_test_import", ".")
+	g.Expect(err).To(BeNil())
+	defer dst.Close()
+
+	// lossless: the import exports the same
+	imported, err := dst.Import(bytes.NewReader(export.Bytes()), gokvstore.ImportOverwrite)
+	g.Expect(err).To(BeNil())
+	g.Expect(imported).To(Equal(int64(len(entries))))
+
+	reexport := bytes.Buffer{}
+	_, err = dst.Export(&reexport)
+	g.Expect(err).To(BeNil())
+	g.Expect(reexport.String()).To(Equal(export.String()))
+	for _, e := range entries {
+		g.Expect(*dst.GetValue(e.Key)).To(Equal(e.Value))
+	}
+
+	// conflicts
+	g.Expect(dst.AddValueKVT("compact", "changed", "t")).To(BeNil())
+	g.Expect(dst.DeleteValue("text")).To(BeEquivalentTo(1))
+
+	imported, err = dst.Import(bytes.NewReader(export.Bytes()), gokvstore.ImportSkip)
+	g.Expect(err).To(BeNil())
+	g.Expect(imported).To(Equal(int64(1)))
+	g.Expect(*dst.GetValue("compact")).To(Equal("changed"))
+	g.Expect(*dst.GetValue("text")).To(Equal("not json\n\ttabs <&>"))
+
+	g.Expect(dst.DeleteValue("text")).To(BeEquivalentTo(1))
+	imported, err = dst.Import(bytes.NewReader(export.Bytes()), gokvstore.ImportFail)
+	g.Expect(errors.Is(err, gokvstore.ErrImportConflict)).To(BeTrue())
+	g.Expect(imported).To(Equal(int64(0)))
+	g.Expect(dst.GetValue("text")).To(BeNil())
+
+	imported, err = dst.Import(bytes.NewReader(export.Bytes()), gokvstore.ImportOverwrite)
+	g.Expect(err).To(BeNil())
+	g.Expect(imported).To(Equal(int64(len(entries))))
+	g.Expect(*dst.GetValue("compact")).To(Equal(`{"a":[1,2.50,"<b>&"]}`))
+
+	os.RemoveAll("kv_test_import_round_trip.db")
+	defer os.RemoveAll("kv_test_import_round_trip.db")
+	roundTrip, err := gokvstore.NewStoreSqlite("kv_test_import_round_trip", ".")
+	g.Expect(err).To(BeNil())
+	defer roundTrip.Close()
+	checkExport(g, roundTrip)
+
+	// broken input
+	_, err = dst.Import(strings.NewReader(`{"key": "k", "value": 1, "tag": "", "meta": {"encoding": "json"}}`+"\n{"), gokvstore.ImportOverwrite)
+	g.Expect(err).ToNot(BeNil())
+	g.Expect(dst.GetValue("k")).To(BeNil())
+
+	_, err = dst.Import(strings.NewReader(`{"key": "k", "value": 1, "tag": "", "meta": {"encoding": "xml"}}`), gokvstore.ImportOverwrite)
+	g.Expect(err).ToNot(BeNil())
+}
+
+func TestPQExportImport(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	for _, valueType := range []string{"jsonb", "json", "text"} {
+		dst, err := gokvstore.NewStorePostgresWithValueType(
+			"test_import_"+valueType,
+			valueType,
+			"host=localhost user=test password=test dbname=test sslmode=disable",
+			nil)
+		g.Expect(err).To(BeNil())
+
+		dst.DeleteAll()
+		checkExport(g, dst)
+
+		// jsonb and json stores serve the JSON values
+		if valueType != "text" {
+			g.Expect(*dst.GetValue("spaced")).To(MatchJSON(`{"a":1}`))
+			g.Expect(*dst.GetValue("text")).To(MatchJSON(`"not json\n\ttabs <&>"`))
+		}
+		dst.DeleteAll()
+		dst.Close()
+	}
+}
@@ -0,0 +1,154 @@
+package gokvstore
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/korovkin/gotils"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+)
+
+// ErrInvalidIndex is returned for an index with an invalid name or path
+var ErrInvalidIndex = errors.New("gokvstore: invalid index")
+
+// ErrUnknownIndex is returned by FindBy for an index that wasn't created
+var ErrUnknownIndex = errors.New("gokvstore: unknown index")
+
+// Index is a secondary index on a field of the JSON values of a store.
+// The field is indexed by its text: strings without the quotes, numbers,
+// true and false as written. Values that are not JSON objects with the field
+// are not indexed
+type Index struct {
+	// Name names the index, letters, digits and underscores
+	Name string
+	// Path the field, nested fields are separated by dots: "address.city"
+	Path string
+	// Unique reject the writes of a second key with the same field (see IsUniqueViolation)
+	Unique bool
+}
+
+// indexName the name and the segments of an index path
+var indexName = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+func (i Index) validate() error {
+	if !indexName.MatchString(i.Name) {
+		return fmt.Errorf("%w: name %q", ErrInvalidIndex, i.Name)
+	}
+	for _, segment := range strings.Split(i.Path, ".") {
+		if !indexName.MatchString(segment) {
+			return fmt.Errorf("%w: path %q", ErrInvalidIndex, i.Path)
+		}
+	}
+	return nil
+}
+
+// IsUniqueViolation is err a write rejected by a unique index
+func IsUniqueViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code == "23505"
+	}
+	return false
+}
+
+// indexes the FindBy statements of the indexes of a store, by index name,
+// and the Search statement of its full text index
+type indexes struct {
+	mutex  sync.RWMutex
+	stmts  map[string]*sql.Stmt
+	search *sql.Stmt
+}
+
+func newIndexes() *indexes {
+	return &indexes{stmts: map[string]*sql.Stmt{}}
+}
+
+func (x *indexes) add(name string, stmt *sql.Stmt) {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	if old, ok := x.stmts[name]; ok {
+		old.Close()
+	}
+	x.stmts[name] = stmt
+}
+
+func (x *indexes) remove(name string) {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	if stmt, ok := x.stmts[name]; ok {
+		stmt.Close()
+		delete(x.stmts, name)
+	}
+}
+
+func (x *indexes) setSearch(stmt *sql.Stmt) {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	if x.search != nil {
+		x.search.Close()
+	}
+	x.search = stmt
+}
+
+func (x *indexes) searchStmt() *sql.Stmt {
+	x.mutex.RLock()
+	defer x.mutex.RUnlock()
+	return x.search
+}
+
+func (x *indexes) close() {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	for name, stmt := range x.stmts {
+		stmt.Close()
+		delete(x.stmts, name)
+	}
+	if x.search != nil {
+		x.search.Close()
+		x.search = nil
+	}
+}
+
+// findBy get the entries whose field of the index name is value, in key order
+func (x *indexes) findBy(name string, value string) ([]Entry, error) {
+	x.mutex.RLock()
+	stmt, ok := x.stmts[name]
+	x.mutex.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownIndex, name)
+	}
+
+	res, err := stmt.Query(value)
+	gotils.CheckNotFatal(err)
+	if err != nil {
+		return nil, err
+	}
+	return scanEntries(res)
+}
+
+// scanEntries read the (K, V, T) rows of res
+func scanEntries(res *sql.Rows) ([]Entry, error) {
+	defer res.Close()
+
+	entries := []Entry{}
+	for res.Next() {
+		e := Entry{}
+		err := res.Scan(&e.Key, &e.Value, &e.Tag)
+		gotils.CheckNotFatal(err)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, res.Err()
+}
@@ -0,0 +1,185 @@
+package gokvstore_test
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/korovkin/gokvstore"
+
+	. "github.com/onsi/gomega"
+)
+
+type indexStore interface {
+	CreateIndex(index gokvstore.Index) error
+	DropIndex(name string) error
+	FindBy(name string, value string) ([]gokvstore.Entry, error)
+	AddValueKVT(k string, v string, t string) error
+	GetValue(k string) *string
+	Update(block func(tx *gokvstore.Tx) error) error
+	TryLock(name string, ttl time.Duration) (*gokvstore.Lock, error)
+	Queue(name string, options gokvstore.QueueOptions) *gokvstore.Queue
+}
+
+func findKeys(g *GomegaWithT, s indexStore, name string, value string) []string {
+	entries, err := s.FindBy(name, value)
+	g.Expect(err).To(BeNil())
+	keys := []string{}
+	for _, e := range entries {
+		keys = append(keys, e.Key)
+	}
+	return keys
+}
+
+func checkIndexes(g *GomegaWithT, s indexStore) {
+	g.Expect(errors.Is(s.CreateIndex(gokvstore.Index{Name: "bad name", Path: "a"}), gokvstore.ErrInvalidIndex)).To(BeTrue())
+	g.Expect(errors.Is(s.CreateIndex(gokvstore.Index{Name: "a", Path: "a..b"}), gokvstore.ErrInvalidIndex)).To(BeTrue())
+	g.Expect(errors.Is(s.CreateIndex(gokvstore.Index{Name: "a", Path: "a'"}), gokvstore.ErrInvalidIndex)).To(BeTrue())
+
+	for _, index := range []gokvstore.Index{
+		{Name: "email", Path: "email", Unique: true},
+		{Name: "city", Path: "address.city"},
+		{Name: "age", Path: "age"},
+		{Name: "admin", Path: "admin"},
+	} {
+		g.Expect(s.CreateIndex(index)).To(BeNil())
+	}
+	// creating an existing index is a no-op
+	g.Expect(s.CreateIndex(gokvstore.Index{Name: "age", Path: "age"})).To(BeNil())
+
+	for k, v := range map[string]string{
+		"u1": `{"email":"a@x","address":{"city":"Paris"}}`,
+		"u2": `{"email":"b@x","address":{"city":"Paris"},"age":42}`,
+		"u3": `{"email":"c@x","address":{"city":"Rome"},"admin":true}`,
+		"n":  `1`,
+		"s":  `"a@x"`,
+		"a":  `["a@x"]`,
+		"e":  `{"email":null}`,
+		"e2": `{"email":null}`,
+	} {
+		g.Expect(s.AddValueKVT(k, v, "")).To(BeNil())
+	}
+
+	g.Expect(findKeys(g, s, "email", "a@x")).To(Equal([]string{"u1"}))
+	g.Expect(findKeys(g, s, "city", "Paris")).To(Equal([]string{"u1", "u2"}))
+	g.Expect(findKeys(g, s, "city", "Oslo")).To(BeEmpty())
+
+	// the keys of locks and queues are not found
+	l, err := s.TryLock("city", time.Minute)
+	g.Expect(err).To(BeNil())
+	_, err = s.Queue("cities", gokvstore.QueueOptions{}).Enqueue(`{"address":{"city":"Paris"}}`, 0)
+	g.Expect(err).To(BeNil())
+	g.Expect(findKeys(g, s, "city", "Paris")).To(Equal([]string{"u1", "u2"}))
+	g.Expect(l.Unlock()).To(BeNil())
+	g.Expect(findKeys(g, s, "age", "42")).To(Equal([]string{"u2"}))
+	g.Expect(findKeys(g, s, "admin", "true")).To(Equal([]string{"u3"}))
+
+	entries, err := s.FindBy("email", "c@x")
+	g.Expect(err).To(BeNil())
+	g.Expect(entries).To(HaveLen(1))
+	g.Expect(entries[0].Value).To(ContainSubstring("Rome"))
+
+	_, err = s.FindBy("missing", "x")
+	g.Expect(errors.Is(err, gokvstore.ErrUnknownIndex)).To(BeTrue())
+
+	// unique
+	err = s.AddValueKVT("u4", `{"email":"a@x"}`, "")
+	g.Expect(gokvstore.IsUniqueViolation(err)).To(BeTrue())
+	g.Expect(s.GetValue("u4")).To(BeNil())
+	g.Expect(gokvstore.IsUniqueViolation(errors.New("x"))).To(BeFalse())
+
+	err = s.Update(func(tx *gokvstore.Tx) error {
+		err := tx.AddValueKVT("u5", `{"email":"e@x"}`, "")
+		if err != nil {
+			return err
+		}
+		return tx.AddValueKVT("u6", `{"email":"e@x"}`, "")
+	})
+	g.Expect(gokvstore.IsUniqueViolation(err)).To(BeTrue())
+	g.Expect(s.GetValue("u5")).To(BeNil())
+
+	// a key keeps its own value
+	g.Expect(s.AddValueKVT("u1", `{"email":"a@x","address":{"city":"Oslo"}}`, "")).To(BeNil())
+	g.Expect(findKeys(g, s, "city", "Oslo")).To(Equal([]string{"u1"}))
+	g.Expect(s.AddValueKVT("u1", `{"email":"d@x"}`, "")).To(BeNil())
+	g.Expect(findKeys(g, s, "email", "a@x")).To(BeEmpty())
+	g.Expect(s.AddValueKVT("u4", `{"email":"a@x"}`, "")).To(BeNil())
+	g.Expect(findKeys(g, s, "email", "a@x")).To(Equal([]string{"u4"}))
+
+	// the existing values are checked
+	g.Expect(s.AddValueKVT("u5", `{"address":{"city":"Rome"}}`, "")).To(BeNil())
+	err = s.CreateIndex(gokvstore.Index{Name: "city_unique", Path: "address.city", Unique: true})
+	g.Expect(err).ToNot(BeNil())
+	_, err = s.FindBy("city_unique", "Rome")
+	g.Expect(errors.Is(err, gokvstore.ErrUnknownIndex)).To(BeTrue())
+
+	g.Expect(s.DropIndex("email")).To(BeNil())
+	_, err = s.FindBy("email", "a@x")
+	g.Expect(errors.Is(err, gokvstore.ErrUnknownIndex)).To(BeTrue())
+	g.Expect(s.AddValueKVT("u7", `{"email":"a@x"}`, "")).To(BeNil())
+}
+
+func TestSqliteIndexes(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	os.RemoveAll("kv_test_indexes.db")
+	defer os.RemoveAll("kv_test_indexes.db")
+
+	s, err := gokvstore.NewStoreSqlite("kv_test_indexes", ".")
+	g.Expect(err).To(BeNil())
+	defer s.CloseAndDelete()
+
+	// sqlite values don't have to be JSON
+	g.Expect(s.AddValueKVT("text", "not json", "")).To(BeNil())
+	checkIndexes(g, s)
+
+	// declared indexes
+	options := gokvstore.SqliteOptions{
+		Filename: "kv_test_indexes.db",
+		Indexes:  []gokvstore.Index{{Name: "email", Path: "email", Unique: true}},
+	}
+	_, err = gokvstore.NewStoreSqliteWithOptions(options)
+	g.Expect(gokvstore.IsUniqueViolation(err)).To(BeTrue())
+
+	g.Expect(s.DeleteValue("u7")).To(BeEquivalentTo(1))
+	s2, err := gokvstore.NewStoreSqliteWithOptions(options)
+	g.Expect(err).To(BeNil())
+	defer s2.Close()
+	_, err = s2.FindBy("city", "Rome")
+	g.Expect(errors.Is(err, gokvstore.ErrUnknownIndex)).To(BeTrue())
+	g.Expect(findKeys(g, s2, "email", "a@x")).To(Equal([]string{"u4"}))
+
+	var sql string
+	err = s2.Db.QueryRow(`SELECT sql FROM sqlite_master WHERE type = 'index' AND name = 'KV_i_email'`).Scan(&sql)
+	g.Expect(err).To(BeNil())
+	g.Expect(sql).To(HavePrefix("CREATE UNIQUE INDEX"))
+}
+
+func TestPQIndexes(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	s, err := gokvstore.NewStorePostgresWithOptions(gokvstore.PostgresOptions{
+		Name:       "test_indexes",
+		Connection: "host=localhost user=test password=test dbname=test sslmode=disable",
+	})
+	g.Expect(err).To(BeNil())
+	defer s.Close()
+
+	s.DeleteAll()
+	defer s.DeleteAll()
+	for _, name := range []string{"email", "city", "age", "admin"} {
+		g.Expect(s.DropIndex(name)).To(BeNil())
+	}
+	checkIndexes(g, s)
+
+	text, err := gokvstore.NewStorePostgresWithValueType(
+		"test_indexes_text",
+		"text",
+		"host=localhost user=test password=test dbname=test sslmode=disable",
+		nil)
+	g.Expect(err).To(BeNil())
+	defer text.Close()
+	err = text.CreateIndex(gokvstore.Index{Name: "email", Path: "email"})
+	g.Expect(errors.Is(err, gokvstore.ErrInvalidValueType)).To(BeTrue())
+}
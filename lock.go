@@ -0,0 +1,164 @@
+package gokvstore
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/korovkin/gotils"
+)
+
+// lockPrefix the keys of the locks, the value is the owner token and the tag
+// the expiry time (unix nanoseconds of the db clock, 20 digits)
+const lockPrefix = "\x01L\x01"
+
+// lockPollInterval how often Lock tries to take a lock held by another owner,
+// a quarter of the ttl for short ttls but not less than lockMinPollInterval
+const (
+	lockPollInterval    = 100 * time.Millisecond
+	lockMinPollInterval = 5 * time.Millisecond
+)
+
+// ErrInvalidLockTTL is returned for a lock ttl that is not positive
+var ErrInvalidLockTTL = errors.New("gokvstore: the ttl of a lock has to be positive")
+
+// ErrInvalidLockName is returned for empty lock names
+// and for lock names with control characters
+var ErrInvalidLockName = errors.New("gokvstore: invalid lock name")
+
+// ErrLockHeld is returned by TryLock for a lock held by another owner
+var ErrLockHeld = errors.New("gokvstore: the lock is held by another owner")
+
+// ErrLockLost is returned by Renew and Unlock for a lock that expired and
+// may have been taken over by another owner
+var ErrLockLost = errors.New("gokvstore: the lock expired")
+
+// Lock is a lease on a named lock: it's held by Owner until Expires,
+// unless it's renewed. A holder that dies stops renewing and the lock expires
+type Lock struct {
+	Name    string
+	Owner   string
+	Expires time.Time
+	c       kv
+}
+
+// newOwner a random owner token
+func newOwner() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	return hex.EncodeToString(b), err
+}
+
+// parseExpires parse the tag of a lock
+func parseExpires(t string) (time.Time, error) {
+	n, err := strconv.ParseInt(t, 10, 64)
+	return time.Unix(0, n), err
+}
+
+// queryLock run one of the lock statements that return the expiry time
+func queryLock(c kv, stmt *sql.Stmt, args ...interface{}) (time.Time, error) {
+	var t string
+	err := c.retry.do(func() error {
+		return stmt.QueryRow(args...).Scan(&t)
+	})
+	if err != nil {
+		return time.Time{}, err
+	}
+	return parseExpires(t)
+}
+
+// tryLock take the lock name if it's free or expired
+func tryLock(c kv, name string, ttl time.Duration) (*Lock, error) {
+	if ttl <= 0 {
+		return nil, ErrInvalidLockTTL
+	}
+	if !validBucketName(name) {
+		return nil, ErrInvalidLockName
+	}
+	owner, err := newOwner()
+	if err != nil {
+		return nil, err
+	}
+
+	// the owner is a JSON string, a valid value of every value type
+	expires, err := queryLock(c, c.stmts.lockAcquire, lockPrefix+name, strconv.Quote(owner), int64(ttl))
+	if err == sql.ErrNoRows {
+		return nil, ErrLockHeld
+	}
+	gotils.CheckNotFatal(err)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Lock{Name: name, Owner: owner, Expires: expires, c: c}, nil
+}
+
+// lock take the lock name, waiting for it until ctx is done
+func lock(ctx context.Context, c kv, name string, ttl time.Duration) (*Lock, error) {
+	if ttl <= 0 {
+		return nil, ErrInvalidLockTTL
+	}
+	poll := lockPollInterval
+	if ttl/4 < poll {
+		poll = ttl / 4
+	}
+	if poll < lockMinPollInterval {
+		poll = lockMinPollInterval
+	}
+
+	for {
+		l, err := tryLock(c, name, ttl)
+		if err != ErrLockHeld {
+			return l, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(poll):
+		}
+	}
+}
+
+// Renew extend the lock to ttl from now, fails with ErrLockLost if it expired
+func (l *Lock) Renew(ttl time.Duration) error {
+	if ttl <= 0 {
+		return ErrInvalidLockTTL
+	}
+	expires, err := queryLock(l.c, l.c.stmts.lockRenew, lockPrefix+l.Name, strconv.Quote(l.Owner), int64(ttl))
+	if err == sql.ErrNoRows {
+		return ErrLockLost
+	}
+	gotils.CheckNotFatal(err)
+	if err != nil {
+		return err
+	}
+
+	l.Expires = expires
+	return nil
+}
+
+// Unlock release the lock, fails with ErrLockLost if it was taken over by another owner
+func (l *Lock) Unlock() error {
+	var released int64
+	err := l.c.retry.do(func() error {
+		res, err := l.c.stmts.lockRelease.Exec(lockPrefix+l.Name, strconv.Quote(l.Owner))
+		if err != nil {
+			return err
+		}
+		released, err = res.RowsAffected()
+		return err
+	})
+	gotils.CheckNotFatal(err)
+	if err != nil {
+		return err
+	}
+	if released == 0 {
+		return ErrLockLost
+	}
+	return nil
+}
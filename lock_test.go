@@ -0,0 +1,184 @@
+package gokvstore_test
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/korovkin/gokvstore"
+	"github.com/korovkin/gotils"
+
+	. "github.com/onsi/gomega"
+)
+
+// lockStore the lock API shared by StoreSqlite and StorePostgres
+type lockStore interface {
+	Lock(ctx context.Context, name string, ttl time.Duration) (*gokvstore.Lock, error)
+	TryLock(name string, ttl time.Duration) (*gokvstore.Lock, error)
+}
+
+func checkLocks(g *GomegaWithT, s lockStore) {
+	l, err := s.TryLock("job", time.Second)
+	g.Expect(err).To(BeNil())
+	g.Expect(l.Owner).ToNot(BeEmpty())
+	g.Expect(l.Expires).To(BeTemporally("~", time.Now().Add(time.Second), 500*time.Millisecond))
+
+	_, err = s.TryLock("job", time.Second)
+	g.Expect(err).To(Equal(gokvstore.ErrLockHeld))
+
+	other, err := s.TryLock("other job", time.Second)
+	g.Expect(err).To(BeNil())
+	g.Expect(other.Unlock()).To(BeNil())
+
+	// locks that would already be expired
+	for _, ttl := range []time.Duration{0, -time.Second} {
+		_, err = s.TryLock("invalid", ttl)
+		g.Expect(err).To(Equal(gokvstore.ErrInvalidLockTTL))
+		_, err = s.Lock(context.Background(), "invalid", ttl)
+		g.Expect(err).To(Equal(gokvstore.ErrInvalidLockTTL))
+		g.Expect(l.Renew(ttl)).To(Equal(gokvstore.ErrInvalidLockTTL))
+	}
+
+	for _, name := range []string{"", "a\x01b", "a\nb"} {
+		_, err = s.TryLock(name, time.Second)
+		g.Expect(err).To(Equal(gokvstore.ErrInvalidLockName))
+		_, err = s.Lock(context.Background(), name, time.Second)
+		g.Expect(err).To(Equal(gokvstore.ErrInvalidLockName))
+	}
+
+	expires := l.Expires
+	g.Expect(l.Renew(10 * time.Second)).To(BeNil())
+	g.Expect(l.Expires).To(BeTemporally(">", expires))
+
+	g.Expect(l.Unlock()).To(BeNil())
+	g.Expect(l.Unlock()).To(Equal(gokvstore.ErrLockLost))
+
+	// a holder that crashed stops renewing, its lock expires
+	crashed, err := s.TryLock("job", 200*time.Millisecond)
+	g.Expect(err).To(BeNil())
+
+	now := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	l, err = s.Lock(ctx, "job", 10*time.Second)
+	g.Expect(err).To(BeNil())
+	g.Expect(time.Since(now)).To(BeNumerically(">=", 100*time.Millisecond))
+
+	g.Expect(crashed.Renew(time.Second)).To(Equal(gokvstore.ErrLockLost))
+	g.Expect(crashed.Unlock()).To(Equal(gokvstore.ErrLockLost))
+	_, err = s.TryLock("job", time.Second)
+	g.Expect(err).To(Equal(gokvstore.ErrLockHeld))
+
+	// waiting ends with ctx
+	short, cancelShort := context.WithTimeout(context.Background(), 150*time.Millisecond)
+	defer cancelShort()
+	_, err = s.Lock(short, "job", time.Second)
+	g.Expect(err).To(Equal(context.DeadlineExceeded))
+	g.Expect(l.Unlock()).To(BeNil())
+
+	// mutual exclusion
+	var inside int32
+	concurrently(4, 5, func() {
+		l, err := s.Lock(ctx, "mutex", 10*time.Second)
+		g.Expect(err).To(BeNil())
+		g.Expect(atomic.AddInt32(&inside, 1)).To(Equal(int32(1)))
+		time.Sleep(time.Millisecond)
+		atomic.AddInt32(&inside, -1)
+		g.Expect(l.Unlock()).To(BeNil())
+	})
+}
+
+func TestSqliteLocks(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	os.RemoveAll("kv_test_locks.db")
+	defer os.RemoveAll("kv_test_locks.db")
+
+	s, err := gokvstore.NewStoreSqlite("kv_test_locks", ".")
+	g.Expect(err).To(BeNil())
+	defer s.CloseAndDelete()
+
+	checkLocks(g, s)
+}
+
+// lockHolderEnv makes the test binary act as the lock holder killed by TestSqliteLockHolderCrash
+const lockHolderEnv = "GOKVSTORE_LOCK_HOLDER"
+
+func lockHolder(filename string) {
+	s, err := gokvstore.NewStoreSqliteWithOptions(gokvstore.SqliteOptions{Filename: filename})
+	gotils.CheckFatal(err)
+
+	l, err := s.TryLock("singleton", 300*time.Millisecond)
+	gotils.CheckFatal(err)
+	fmt.Println("locked", l.Owner)
+
+	for {
+		time.Sleep(100 * time.Millisecond)
+		gotils.CheckFatal(l.Renew(300 * time.Millisecond))
+	}
+}
+
+func TestSqliteLockHolderCrash(t *testing.T) {
+	if filename := os.Getenv(lockHolderEnv); filename != "" {
+		lockHolder(filename)
+		return
+	}
+
+	g := NewGomegaWithT(t)
+
+	filename := "kv_test_lock_crash.db"
+	os.RemoveAll(filename)
+
+	s, err := gokvstore.NewStoreSqliteWithOptions(gokvstore.SqliteOptions{Filename: filename})
+	g.Expect(err).To(BeNil())
+	defer s.CloseAndDelete()
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestSqliteLockHolderCrash$")
+	cmd.Env = append(os.Environ(), lockHolderEnv+"="+filename)
+	stdout, err := cmd.StdoutPipe()
+	g.Expect(err).To(BeNil())
+	g.Expect(cmd.Start()).To(BeNil())
+
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	g.Expect(err).To(BeNil())
+	g.Expect(line).To(HavePrefix("locked "))
+
+	// the holder keeps renewing its lock while it's alive
+	time.Sleep(500 * time.Millisecond)
+	_, err = s.TryLock("singleton", time.Second)
+	g.Expect(err).To(Equal(gokvstore.ErrLockHeld))
+
+	g.Expect(cmd.Process.Kill()).To(BeNil())
+	cmd.Wait()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	l, err := s.Lock(ctx, "singleton", time.Second)
+	g.Expect(err).To(BeNil())
+	g.Expect(l.Owner).ToNot(Equal(strings.TrimSpace(line[len("locked "):])))
+	g.Expect(l.Unlock()).To(BeNil())
+}
+
+func TestPQLocks(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	for _, valueType := range []string{"jsonb", "text"} {
+		s, err := gokvstore.NewStorePostgresWithValueType(
+			"test_locks_"+valueType,
+			valueType,
+			"host=localhost user=test password=test dbname=test sslmode=disable",
+			nil)
+		g.Expect(err).To(BeNil())
+
+		s.DeleteAll()
+		checkLocks(g, s)
+		s.DeleteAll()
+		s.Close()
+	}
+}
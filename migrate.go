@@ -0,0 +1,113 @@
+package gokvstore
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/korovkin/gotils"
+)
+
+// schemaTable records the schema version of every store table in the database
+const schemaTable = "gokvstore_schema"
+
+// ErrSchemaTooNew is returned when opening a store table
+// that was migrated by a newer version of this library
+var ErrSchemaTooNew = errors.New("gokvstore: the database schema is newer than this library")
+
+// migration upgrades a store table from version-1 to version
+type migration struct {
+	version     int
+	description string
+	up          func(tx *sql.Tx) error
+}
+
+// migrate bring the table up to the last version in migrations,
+// all the pending steps run in a single transaction
+func migrate(db *sql.DB, table string, migrations []migration, logger Logger) error {
+	_, err := db.Exec(fmt.Sprintf(
+		`CREATE TABLE IF NOT EXISTS %s
+			(table_name text primary key, version integer not null);`,
+		schemaTable,
+	))
+	gotils.CheckNotFatal(err)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	gotils.CheckNotFatal(err)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// both statements lock the version (the row in postgres, the db in sqlite)
+	// so concurrent openers wait for each other's migrations
+	_, err = tx.Exec(fmt.Sprintf(
+		`INSERT INTO %s (table_name, version)
+			VALUES($1, 0)
+			ON CONFLICT (table_name) DO NOTHING`,
+		schemaTable,
+	), table)
+	gotils.CheckNotFatal(err)
+	if err != nil {
+		return err
+	}
+
+	var version int
+	err = tx.QueryRow(fmt.Sprintf(
+		`UPDATE %s
+			SET version = version
+			WHERE table_name = $1
+			RETURNING version`,
+		schemaTable,
+	), table).Scan(&version)
+	gotils.CheckNotFatal(err)
+	if err != nil {
+		return err
+	}
+
+	latest := migrations[len(migrations)-1].version
+	if version > latest {
+		return fmt.Errorf("%w: table %s version %d, supported %d", ErrSchemaTooNew, table, version, latest)
+	}
+
+	for _, m := range migrations {
+		if m.version <= version {
+			continue
+		}
+
+		logger.Println("MIGRATE: table:", table, "version:", m.version, m.description)
+		err = m.up(tx)
+		if err != nil {
+			return fmt.Errorf("gokvstore: migrate table %s to version %d: %w", table, m.version, err)
+		}
+
+		_, err = tx.Exec(fmt.Sprintf(
+			`UPDATE %s
+				SET version = $1
+				WHERE table_name = $2`,
+			schemaTable,
+		), m.version, table)
+		gotils.CheckNotFatal(err)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// schemaVersion get the recorded schema version of table, 0 for unknown tables
+func schemaVersion(db *sql.DB, table string) (int, error) {
+	var version int
+	err := db.QueryRow(fmt.Sprintf(
+		`SELECT version FROM %s WHERE table_name = $1`,
+		schemaTable,
+	), table).Scan(&version)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return version, err
+}
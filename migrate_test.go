@@ -0,0 +1,144 @@
+package gokvstore_test
+
+import (
+	"database/sql"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/korovkin/gokvstore"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestSqliteMigrateLegacyTable(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	os.RemoveAll("kv_test_legacy.db")
+	defer os.RemoveAll("kv_test_legacy.db")
+
+	// a table created by an old version of the library
+	db, err := sql.Open("sqlite3", "./kv_test_legacy.db")
+	g.Expect(err).To(BeNil())
+	_, err = db.Exec(`CREATE TABLE KV (K string primary key, V string, T string);`)
+	g.Expect(err).To(BeNil())
+	_, err = db.Exec(`INSERT INTO KV (K, V, T) VALUES ('k', '{"a":1}', 't'), ('10', '33', '')`)
+	g.Expect(err).To(BeNil())
+	db.Close()
+
+	s, err := gokvstore.NewStoreSqlite("kv_test_legacy", ".")
+	g.Expect(err).To(BeNil())
+	defer s.Close()
+
+	version, err := s.SchemaVersion()
+	g.Expect(err).To(BeNil())
+	g.Expect(version).To(Equal(2))
+
+	var kType string
+	err = s.Db.QueryRow(`SELECT type FROM pragma_table_info('KV') WHERE name = 'K'`).Scan(&kType)
+	g.Expect(err).To(BeNil())
+	g.Expect(kType).To(Equal("TEXT"))
+
+	g.Expect(*s.GetValue("k")).To(Equal(`{"a":1}`))
+	g.Expect(*s.GetValue("10")).To(Equal("33"))
+
+	// numeric looking keys are text now
+	g.Expect(s.AddValueKV("9", "9")).To(BeNil())
+	list := []string{}
+	err = s.IterateByKeyPrefixASC(
+		"",
+		1000,
+		func(k *string, t *string, v *string, stop *bool) {
+			list = append(list, *k)
+		})
+	g.Expect(err).To(BeNil())
+	g.Expect(list).To(Equal([]string{"10", "9", "k"}))
+}
+
+func TestSqliteSchemaTooNew(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	os.RemoveAll("kv_test_schema.db")
+	defer os.RemoveAll("kv_test_schema.db")
+
+	s, err := gokvstore.NewStoreSqlite("kv_test_schema", ".")
+	g.Expect(err).To(BeNil())
+
+	version, err := s.SchemaVersion()
+	g.Expect(err).To(BeNil())
+	g.Expect(version).To(Equal(2))
+
+	// reopening doesn't migrate again
+	users, err := s.Table("users")
+	g.Expect(err).To(BeNil())
+	users.Close()
+
+	_, err = s.Db.Exec(`UPDATE gokvstore_schema SET version = 1000 WHERE table_name = 'KV'`)
+	g.Expect(err).To(BeNil())
+	s.Close()
+
+	_, err = gokvstore.NewStoreSqlite("kv_test_schema", ".")
+	g.Expect(errors.Is(err, gokvstore.ErrSchemaTooNew)).To(BeTrue())
+}
+
+func TestPQSchemaTooNew(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	connection := "host=localhost user=test password=test dbname=test sslmode=disable"
+
+	s, err := gokvstore.NewStorePostgres("test_schema", connection, nil)
+	g.Expect(err).To(BeNil())
+
+	version, err := s.SchemaVersion()
+	g.Expect(err).To(BeNil())
+	g.Expect(version).To(Equal(4))
+
+	_, err = s.Db.Exec(`UPDATE gokvstore_schema SET version = 1000 WHERE table_name = 'kv_test_schema'`)
+	g.Expect(err).To(BeNil())
+	defer s.Db.Exec(`DROP TABLE kv_test_schema; DELETE FROM gokvstore_schema WHERE table_name = 'kv_test_schema'`)
+
+	_, err = gokvstore.NewStorePostgres("test_schema", connection, s.Db)
+	g.Expect(errors.Is(err, gokvstore.ErrSchemaTooNew)).To(BeTrue())
+}
+
+func TestPQMigrateLegacyTable(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	connection := "host=localhost user=test password=test dbname=test sslmode=disable"
+	db, err := sql.Open("postgres", connection)
+	g.Expect(err).To(BeNil())
+	defer db.Close()
+
+	// a table created by an old version of the library, in the default collation
+	_, err = db.Exec(`DROP TABLE IF EXISTS kv_test_legacy; DELETE FROM gokvstore_schema WHERE table_name = 'kv_test_legacy'`)
+	g.Expect(err).To(BeNil())
+	_, err = db.Exec(`CREATE TABLE kv_test_legacy (K text primary key, V jsonb, T text); 
+		CREATE INDEX kv_t_test_legacy ON kv_test_legacy (T, K);`)
+	g.Expect(err).To(BeNil())
+	_, err = db.Exec(`INSERT INTO kv_test_legacy (K, V, T) VALUES ('a', '1', 'Z'), ('b', '2', 'a')`)
+	g.Expect(err).To(BeNil())
+	defer db.Exec(`DROP TABLE kv_test_legacy; DELETE FROM gokvstore_schema WHERE table_name = 'kv_test_legacy'`)
+
+	s, err := gokvstore.NewStorePostgres("test_legacy", connection, db)
+	g.Expect(err).To(BeNil())
+
+	version, err := s.SchemaVersion()
+	g.Expect(err).To(BeNil())
+	g.Expect(version).To(Equal(4))
+
+	for _, column := range []string{"k", "t"} {
+		var collation string
+		err = db.QueryRow(
+			`SELECT collation_name FROM information_schema.columns 
+				WHERE table_name = 'kv_test_legacy' AND column_name = $1`,
+			column,
+		).Scan(&collation)
+		g.Expect(err).To(BeNil())
+		g.Expect(collation).To(Equal("C"))
+	}
+
+	// the tags compare byte by byte
+	g.Expect(s.DeleteWhereTagLT("a")).To(BeEquivalentTo(1))
+	g.Expect(s.GetValue("a")).To(BeNil())
+	g.Expect(s.GetValue("b")).NotTo(BeNil())
+}
@@ -0,0 +1,267 @@
+package gokvstore
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Logger is used by the stores to log, *log.Logger implements it
+type Logger interface {
+	Println(v ...interface{})
+}
+
+// stdLogger log with the standard logger of the log package
+type stdLogger struct{}
+
+func (stdLogger) Println(v ...interface{}) {
+	log.Println(v...)
+}
+
+// SqliteOptions configure NewStoreSqliteWithOptions,
+// the zero value of every field selects its default
+type SqliteOptions struct {
+	// Filename the sqlite db file, ":memory:" for an in memory db
+	Filename string
+	// TableName the store table, defaults to "KV"
+	TableName string
+	// JournalMode the journal_mode pragma, defaults to "WAL"
+	JournalMode string
+	// Synchronous the synchronous pragma (OFF, NORMAL, FULL or EXTRA),
+	// defaults to NORMAL in WAL mode and to the sqlite default otherwise
+	Synchronous string
+	// CheckpointInterval how often to checkpoint the WAL into the db file
+	// (in addition to sqlite's automatic checkpoints), zero disables it
+	CheckpointInterval time.Duration
+	// UnsafeFast turn the journal off (journal_mode = OFF): faster writes,
+	// but no rollback and a crash in the middle of a write can corrupt the db
+	UnsafeFast bool
+	// BusyTimeout how long to wait for a locked db, defaults to 50 seconds
+	BusyTimeout time.Duration
+	// MaxOpenConns the maximum number of open read connections, defaults to unlimited.
+	// There is always a single write connection
+	MaxOpenConns int
+	// MaxIdleConns the maximum number of idle read connections, defaults to database/sql's default
+	MaxIdleConns int
+	// NoTagIndex don't index the tag column when creating the table
+	NoTagIndex bool
+	// Indexes the secondary indexes on JSON fields of the values, created if missing
+	Indexes []Index
+	// Search create the full text index of the values if it's missing, see EnableSearch.
+	// It needs the sqlite_fts5 build tag
+	Search bool
+	// Retry the retry policy of writes and transactions failing with a busy db,
+	// defaults to DefaultRetryPolicy
+	Retry RetryPolicy
+	// Logger defaults to the standard logger
+	Logger Logger
+}
+
+func (o SqliteOptions) withDefaults() SqliteOptions {
+	if o.TableName == "" {
+		o.TableName = "KV"
+	}
+	if o.UnsafeFast {
+		o.JournalMode = "OFF"
+	}
+	if o.JournalMode == "" {
+		o.JournalMode = "WAL"
+	}
+	if o.Synchronous == "" && strings.EqualFold(o.JournalMode, "WAL") {
+		o.Synchronous = "NORMAL"
+	}
+	if o.BusyTimeout == 0 {
+		o.BusyTimeout = 50 * time.Second
+	}
+	if o.Logger == nil {
+		o.Logger = stdLogger{}
+	}
+	return o
+}
+
+// dsn the data source name with the per connection pragmas
+func (o SqliteOptions) dsn() string {
+	params := url.Values{}
+	params.Set("_busy_timeout", strconv.FormatInt(int64(o.BusyTimeout/time.Millisecond), 10))
+	params.Set("_journal_mode", o.JournalMode)
+	if o.Synchronous != "" {
+		params.Set("_synchronous", o.Synchronous)
+	}
+	return withQuery(o.Filename, params.Encode())
+}
+
+// readerDsn the data source name of the read only connections
+func (o SqliteOptions) readerDsn() string {
+	params := url.Values{}
+	params.Set("_busy_timeout", strconv.FormatInt(int64(o.BusyTimeout/time.Millisecond), 10))
+	params.Set("_query_only", "true")
+	return withQuery(o.Filename, params.Encode())
+}
+
+// backupDsn the data source name of the connections that read the db and write
+// other files (VACUUM INTO), a query only connection can't write any file
+func (o SqliteOptions) backupDsn() string {
+	params := url.Values{}
+	params.Set("_busy_timeout", strconv.FormatInt(int64(o.BusyTimeout/time.Millisecond), 10))
+	return withQuery(o.Filename, params.Encode())
+}
+
+// withQuery append the query parameters to a file name or to a URL
+func withQuery(s string, query string) string {
+	if strings.Contains(s, "?") {
+		return s + "&" + query
+	}
+	return s + "?" + query
+}
+
+// PostgresOptions configure NewStorePostgresWithOptions,
+// the zero value of every field selects its default
+type PostgresOptions struct {
+	// Name the store name, names the indexes of the table
+	Name string
+	// Connection the connection string, used when Db is nil
+	Connection string
+	// Db an open db to share with other stores
+	Db *sql.DB
+	// Schema the schema of the store table (created if missing), defaults to the search_path
+	Schema string
+	// TableName the store table, defaults to "kv_" + Name
+	TableName string
+	// ValueType the type of the V column: "jsonb" (the default), "json" or "text"
+	ValueType string
+	// NoTagIndex don't index the tag column when creating the table
+	NoTagIndex bool
+	// Indexes the secondary indexes on JSON fields of the values, created if missing.
+	// The values of a store with indexes have to be json or jsonb
+	Indexes []Index
+	// Search create the full text index of the values if it's missing, see EnableSearch
+	Search bool
+	// StatementTimeout aborts statements that take longer,
+	// applies only when the store opens the connection (Db is nil)
+	StatementTimeout time.Duration
+	// MaxOpenConns the maximum number of open connections, defaults to unlimited
+	MaxOpenConns int
+	// MaxIdleConns the maximum number of idle connections, defaults to database/sql's default
+	MaxIdleConns int
+	// ConnMaxLifetime the maximum time a connection is reused, defaults to forever
+	ConnMaxLifetime time.Duration
+	// Retry the retry policy of writes and transactions failing with a serialization
+	// failure or a deadlock, defaults to DefaultRetryPolicy
+	Retry RetryPolicy
+	// Logger defaults to the standard logger
+	Logger Logger
+}
+
+func (o PostgresOptions) withDefaults() PostgresOptions {
+	if o.TableName == "" {
+		o.TableName = "kv_" + o.Name
+	}
+	if o.ValueType == "" {
+		o.ValueType = "jsonb"
+	}
+	o.ValueType = strings.ToLower(o.ValueType)
+	if o.Logger == nil {
+		o.Logger = stdLogger{}
+	}
+	return o
+}
+
+// ErrInvalidIdentifier is returned for a store, schema or table name postgres can't use
+var ErrInvalidIdentifier = errors.New("gokvstore: invalid postgres identifier")
+
+// ErrInvalidValueType is returned for a value column type other than jsonb, json or text
+var ErrInvalidValueType = errors.New("gokvstore: invalid postgres value type")
+
+// postgresMaxIdentifier postgres truncates longer identifiers (NAMEDATALEN - 1)
+const postgresMaxIdentifier = 63
+
+// postgresIndexPrefix the prefix of the index names of a store, see postgresMigrations
+const postgresIndexPrefix = "kv_k_"
+
+// postgresValueTypes the supported types of the V column
+var postgresValueTypes = map[string]bool{
+	"jsonb": true,
+	"json":  true,
+	"text":  true,
+}
+
+// validate check the options after withDefaults
+func (o PostgresOptions) validate() error {
+	// the name is part of the index names
+	err := validatePostgresIdentifier("name", o.Name, postgresMaxIdentifier-len(postgresIndexPrefix))
+	if err != nil {
+		return err
+	}
+
+	err = validatePostgresIdentifier("table", o.TableName, postgresMaxIdentifier)
+	if err != nil {
+		return err
+	}
+
+	if o.Schema != "" {
+		err = validatePostgresIdentifier("schema", o.Schema, postgresMaxIdentifier)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !postgresValueTypes[o.ValueType] {
+		return fmt.Errorf("%w: %q", ErrInvalidValueType, o.ValueType)
+	}
+	return nil
+}
+
+// validatePostgresIdentifier check that name is a non empty identifier of at most
+// maxLen bytes, any other character is fine once the identifier is quoted
+func validatePostgresIdentifier(kind string, name string, maxLen int) error {
+	if name == "" {
+		return fmt.Errorf("%w: empty %s", ErrInvalidIdentifier, kind)
+	}
+	if len(name) > maxLen {
+		return fmt.Errorf("%w: %s %q is longer than %d bytes", ErrInvalidIdentifier, kind, name, maxLen)
+	}
+	if !utf8.ValidString(name) {
+		return fmt.Errorf("%w: %s %q is not valid UTF-8", ErrInvalidIdentifier, kind, name)
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			return fmt.Errorf("%w: %s %q has control characters", ErrInvalidIdentifier, kind, name)
+		}
+	}
+	return nil
+}
+
+// connection the connection string with the per connection run-time parameters
+func (o PostgresOptions) connection() string {
+	if o.StatementTimeout == 0 {
+		return o.Connection
+	}
+
+	timeout := "statement_timeout=" +
+		strconv.FormatInt(int64(o.StatementTimeout/time.Millisecond), 10)
+	if strings.HasPrefix(o.Connection, "postgres://") ||
+		strings.HasPrefix(o.Connection, "postgresql://") {
+		return withQuery(o.Connection, timeout)
+	}
+	return o.Connection + " " + timeout
+}
+
+// configurePool apply the pool sizes of the options to db
+func configurePool(db *sql.DB, maxOpenConns int, maxIdleConns int, connMaxLifetime time.Duration) {
+	if maxOpenConns > 0 {
+		db.SetMaxOpenConns(maxOpenConns)
+	}
+	if maxIdleConns > 0 {
+		db.SetMaxIdleConns(maxIdleConns)
+	}
+	if connMaxLifetime > 0 {
+		db.SetConnMaxLifetime(connMaxLifetime)
+	}
+}
@@ -0,0 +1,168 @@
+package gokvstore_test
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/korovkin/gokvstore"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestSqliteOptions(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	os.RemoveAll("kv_test_options.db")
+	defer os.RemoveAll("kv_test_options.db")
+
+	logs := bytes.Buffer{}
+	s, err := gokvstore.NewStoreSqliteWithOptions(gokvstore.SqliteOptions{
+		Filename:     "kv_test_options.db",
+		TableName:    "things",
+		JournalMode:  "TRUNCATE",
+		Synchronous:  "FULL",
+		BusyTimeout:  time.Second,
+		MaxOpenConns: 2,
+		NoTagIndex:   true,
+		Logger:       log.New(&logs, "", 0),
+	})
+	g.Expect(err).To(BeNil())
+	defer s.Close()
+
+	g.Expect(s.TableName).To(Equal("things"))
+	g.Expect(logs.String()).To(ContainSubstring("MIGRATE: table: things version: 1"))
+	// a single writer connection, MaxOpenConns applies to the readers
+	g.Expect(s.Db.Stats().MaxOpenConnections).To(Equal(1))
+
+	g.Expect(s.AddValueKVT("k", "v", "t")).To(BeNil())
+	g.Expect(*s.GetValue("k")).To(Equal("v"))
+
+	var journalMode string
+	err = s.Db.QueryRow(`PRAGMA journal_mode`).Scan(&journalMode)
+	g.Expect(err).To(BeNil())
+	g.Expect(journalMode).To(Equal("truncate"))
+
+	var synchronous int
+	err = s.Db.QueryRow(`PRAGMA synchronous`).Scan(&synchronous)
+	g.Expect(err).To(BeNil())
+	g.Expect(synchronous).To(Equal(2))
+
+	var busyTimeout int
+	err = s.Db.QueryRow(`PRAGMA busy_timeout`).Scan(&busyTimeout)
+	g.Expect(err).To(BeNil())
+	g.Expect(busyTimeout).To(Equal(1000))
+
+	var indexes int
+	err = s.Db.QueryRow(
+		`SELECT COUNT(*) FROM sqlite_master WHERE type = 'index' AND tbl_name = 'things' AND name = 'things_T'`,
+	).Scan(&indexes)
+	g.Expect(err).To(BeNil())
+	g.Expect(indexes).To(Equal(0))
+}
+
+func TestPQOptions(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	logs := bytes.Buffer{}
+	s, err := gokvstore.NewStorePostgresWithOptions(gokvstore.PostgresOptions{
+		Name:             "test_options",
+		Connection:       "host=localhost user=test password=test dbname=test sslmode=disable",
+		TableName:        "things",
+		ValueType:        "text",
+		StatementTimeout: 5 * time.Second,
+		MaxOpenConns:     2,
+		Logger:           log.New(&logs, "", 0),
+	})
+	g.Expect(err).To(BeNil())
+	defer s.Close()
+	defer s.Db.Exec(`DROP TABLE things; DELETE FROM gokvstore_schema WHERE table_name = 'things'`)
+
+	g.Expect(s.TableName).To(Equal("things"))
+	g.Expect(logs.String()).To(ContainSubstring("NewStorePostgres: table: things"))
+	g.Expect(s.Db.Stats().MaxOpenConnections).To(Equal(2))
+
+	var statementTimeout string
+	err = s.Db.QueryRow(`SHOW statement_timeout`).Scan(&statementTimeout)
+	g.Expect(err).To(BeNil())
+	g.Expect(statementTimeout).To(Equal("5s"))
+
+	// text values don't have to be JSON
+	g.Expect(s.AddValueKVT("k", "not json", "t")).To(BeNil())
+	g.Expect(*s.GetValue("k")).To(Equal("not json"))
+}
+
+func TestPostgresOptionsValidation(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	for _, options := range []gokvstore.PostgresOptions{
+		{Name: ""},
+		{Name: strings.Repeat("n", 59)},
+		{Name: "n", TableName: strings.Repeat("t", 64)},
+		{Name: "n", Schema: strings.Repeat("s", 64)},
+		{Name: "bad\x00name"},
+		{Name: "bad\nname"},
+		{Name: "\xff"},
+	} {
+		_, err := gokvstore.NewStorePostgresWithOptions(options)
+		g.Expect(errors.Is(err, gokvstore.ErrInvalidIdentifier)).To(BeTrue(), "%q", options.Name)
+	}
+
+	for _, valueType := range []string{"int", "jsonb; DROP TABLE users", "text primary key"} {
+		_, err := gokvstore.NewStorePostgresWithOptions(gokvstore.PostgresOptions{
+			Name:      "n",
+			ValueType: valueType,
+		})
+		g.Expect(errors.Is(err, gokvstore.ErrInvalidValueType)).To(BeTrue(), valueType)
+	}
+}
+
+func TestPQIdentifiers(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	connection := "host=localhost user=test password=test dbname=test sslmode=disable"
+
+	// names that have to be quoted
+	s, err := gokvstore.NewStorePostgresWithOptions(gokvstore.PostgresOptions{
+		Name:       `My-Store "1"`,
+		Connection: connection,
+		Schema:     "Test-Schema",
+		ValueType:  "JSON",
+	})
+	g.Expect(err).To(BeNil())
+	defer s.Close()
+	defer s.Db.Exec(`DROP SCHEMA "Test-Schema" CASCADE; DELETE FROM gokvstore_schema WHERE table_name LIKE 'Test-Schema.%'`)
+
+	g.Expect(s.TableName).To(Equal(`Test-Schema.kv_My-Store "1"`))
+	g.Expect(s.AddValueKVT("k", `{"a": 1}`, "t")).To(BeNil())
+	g.Expect(*s.GetValue("k")).To(Equal(`{"a": 1}`))
+
+	var indexes int
+	err = s.Db.QueryRow(
+		`SELECT COUNT(*) FROM pg_indexes WHERE schemaname = 'Test-Schema' AND indexname LIKE 'kv\__\_My-Store "1"'`,
+	).Scan(&indexes)
+	g.Expect(err).To(BeNil())
+	g.Expect(indexes).To(Equal(2))
+
+	// a table created with an unquoted mixed case name, before there were schema versions
+	_, err = s.Db.Exec(`CREATE TABLE kv_LegacyStore (K text primary key, V jsonb, T text);
+		CREATE INDEX KV_K_LegacyStore ON kv_LegacyStore (K, T);
+		INSERT INTO kv_LegacyStore VALUES ('k', '"v"', 't')`)
+	g.Expect(err).To(BeNil())
+	defer s.Db.Exec(`DROP TABLE IF EXISTS kv_legacystore; DROP TABLE IF EXISTS "kv_LegacyStore";
+		DELETE FROM gokvstore_schema WHERE table_name = 'kv_LegacyStore'`)
+
+	legacy, err := gokvstore.NewStorePostgres("LegacyStore", "", s.Db)
+	g.Expect(err).To(BeNil())
+	g.Expect(*legacy.GetValue("k")).To(Equal(`"v"`))
+
+	err = s.Db.QueryRow(
+		`SELECT COUNT(*) FROM pg_indexes WHERE indexname IN ('kv_k_LegacyStore', 'kv_t_LegacyStore')`,
+	).Scan(&indexes)
+	g.Expect(err).To(BeNil())
+	g.Expect(indexes).To(Equal(2))
+}
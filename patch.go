@@ -0,0 +1,130 @@
+package gokvstore
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrInvalidPatch is returned by Patch for a patch that is not valid JSON,
+// or a JSON patch with an unsupported operation or path
+var ErrInvalidPatch = errors.New("gokvstore: invalid patch")
+
+// ErrPatchFailed is returned by Patch when a test of a JSON patch fails,
+// or when the value doesn't have a path the patch removes or replaces
+var ErrPatchFailed = errors.New("gokvstore: patch failed")
+
+// patches are applied by the database in a single UPDATE:
+//
+//   - a JSON array is a JSON patch (RFC 6902): the add, remove, replace
+//     and test operations on object members ("/address/city")
+//   - anything else is a JSON merge patch (RFC 7386)
+
+// jsonPatchOp an operation of a JSON patch
+type jsonPatchOp struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value"`
+}
+
+// patchDialect compiles patches for a backend
+type patchDialect interface {
+	// at the query dialect of the JSON value doc
+	at(doc string) queryDialect
+	// isObject the field path of doc is an object, the whole doc for an empty path
+	isObject(doc string, path []string) string
+	// set the field path of doc to the JSON value
+	set(doc string, path []string, value string) string
+	// remove the field path of doc
+	remove(doc string, path []string) string
+	// mergePatch apply the merge patch to doc
+	mergePatch(doc string, patch interface{}) string
+}
+
+// sqlQuote a SQL string literal
+func sqlQuote(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
+
+// decodeJSON decode b keeping the numbers as written
+func decodeJSON(b []byte) (interface{}, error) {
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var v interface{}
+	err := d.Decode(&v)
+	if err == nil && d.More() {
+		err = errors.New("trailing data")
+	}
+	return v, err
+}
+
+// jsonPointer the segments of a JSON pointer to an object member
+func jsonPointer(pointer string) ([]string, error) {
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("%w: path %q", ErrInvalidPatch, pointer)
+	}
+	segments := strings.Split(pointer[1:], "/")
+	for _, segment := range segments {
+		if !indexName.MatchString(segment) {
+			return nil, fmt.Errorf("%w: path %q", ErrInvalidPatch, pointer)
+		}
+	}
+	return segments, nil
+}
+
+// compilePatch get the expression of the patched doc and the conditions the doc
+// has to meet for the patch to apply, the parameters of the conditions go to args
+func compilePatch(patch string, doc string, d patchDialect, args *[]interface{}) (string, []string, error) {
+	if !strings.HasPrefix(strings.TrimSpace(patch), "[") {
+		merge, err := decodeJSON([]byte(patch))
+		if err != nil {
+			return "", nil, fmt.Errorf("%w: %v", ErrInvalidPatch, err)
+		}
+		return d.mergePatch(doc, merge), nil, nil
+	}
+
+	ops := []jsonPatchOp{}
+	err := json.Unmarshal([]byte(patch), &ops)
+	if err != nil {
+		return "", nil, fmt.Errorf("%w: %v", ErrInvalidPatch, err)
+	}
+
+	// every operation applies to the doc patched by the previous ones
+	conditions := []string{}
+	for _, op := range ops {
+		path, err := jsonPointer(op.Path)
+		if err != nil {
+			return "", nil, err
+		}
+		var value interface{}
+		if op.Op != "remove" {
+			value, err = decodeJSON(op.Value)
+			if err != nil {
+				return "", nil, fmt.Errorf("%w: %s %s: %v", ErrInvalidPatch, op.Op, op.Path, err)
+			}
+		}
+
+		switch op.Op {
+		case "add":
+			conditions = append(conditions, d.isObject(doc, path[:len(path)-1]))
+			doc = d.set(doc, path, string(op.Value))
+		case "replace":
+			conditions = append(conditions, d.at(doc).exists(path))
+			doc = d.set(doc, path, string(op.Value))
+		case "remove":
+			conditions = append(conditions, d.at(doc).exists(path))
+			doc = d.remove(doc, path)
+		case "test":
+			s, err := newJSONScalar(value)
+			if err != nil {
+				return "", nil, fmt.Errorf("%w: test %s: only scalars are tested", ErrInvalidPatch, op.Path)
+			}
+			conditions = append(conditions, d.at(doc).compare(path, "=", s, args))
+		default:
+			return "", nil, fmt.Errorf("%w: unsupported op %q", ErrInvalidPatch, op.Op)
+		}
+	}
+	return doc, conditions, nil
+}
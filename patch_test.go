@@ -0,0 +1,147 @@
+package gokvstore_test
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	"github.com/korovkin/gokvstore"
+
+	. "github.com/onsi/gomega"
+)
+
+type patchStore interface {
+	Patch(k string, patch string) (*string, error)
+	AddValueKVT(k string, v string, t string) error
+	GetValue(k string) *string
+}
+
+func checkPatch(g *GomegaWithT, s patchStore) {
+	g.Expect(s.AddValueKVT("u",
+		`{"name":"ann","age":30,"address":{"city":"Paris","zip":"75"},"tags":["a"]}`, "t")).To(BeNil())
+
+	patch := func(p string) string {
+		v, err := s.Patch("u", p)
+		g.Expect(err).To(BeNil())
+		g.Expect(v).ToNot(BeNil())
+		g.Expect(*s.GetValue("u")).To(MatchJSON(*v))
+		return *v
+	}
+
+	// merge patches
+	g.Expect(patch(`{"age":31,"address":{"zip":null,"country":"FR"},"nick":"a'n"}`)).To(MatchJSON(
+		`{"name":"ann","age":31,"address":{"city":"Paris","country":"FR"},"tags":["a"],"nick":"a'n"}`))
+	g.Expect(patch(`{"meta":{"a":{"b":1}},"tags":{"x":null,"y":[1]}}`)).To(MatchJSON(
+		`{"name":"ann","age":31,"address":{"city":"Paris","country":"FR"},"tags":{"y":[1]},"nick":"a'n","meta":{"a":{"b":1}}}`))
+	g.Expect(patch(`{"meta":null,"tags":["a"]}`)).To(MatchJSON(
+		`{"name":"ann","age":31,"address":{"city":"Paris","country":"FR"},"tags":["a"],"nick":"a'n"}`))
+
+	// JSON patches
+	g.Expect(patch(`[
+		{"op":"test","path":"/name","value":"ann"},
+		{"op":"test","path":"/age","value":31.0},
+		{"op":"replace","path":"/age","value":32},
+		{"op":"add","path":"/address/street","value":"rue"},
+		{"op":"remove","path":"/nick"},
+		{"op":"add","path":"/x","value":{}},
+		{"op":"add","path":"/x/y","value":1},
+		{"op":"replace","path":"/x/y","value":[2]}
+	]`)).To(MatchJSON(
+		`{"name":"ann","age":32,"address":{"city":"Paris","country":"FR","street":"rue"},"tags":["a"],"x":{"y":[2]}}`))
+
+	before := *s.GetValue("u")
+	for _, p := range []string{
+		`[{"op":"test","path":"/age","value":99},{"op":"replace","path":"/age","value":0}]`,
+		`[{"op":"test","path":"/age","value":"32"}]`,
+		`[{"op":"replace","path":"/missing","value":0}]`,
+		`[{"op":"remove","path":"/missing"}]`,
+		`[{"op":"add","path":"/missing/a","value":0}]`,
+		`[{"op":"add","path":"/name/a","value":0}]`,
+		`[{"op":"remove","path":"/x"},{"op":"remove","path":"/x/y"}]`,
+	} {
+		_, err := s.Patch("u", p)
+		g.Expect(errors.Is(err, gokvstore.ErrPatchFailed)).To(BeTrue(), p)
+	}
+	g.Expect(*s.GetValue("u")).To(Equal(before))
+
+	for _, p := range []string{
+		`{`,
+		`{"a":1} {}`,
+		`[{"op":"move","path":"/a","from":"/b"}]`,
+		`[{"op":"add","path":"a","value":1}]`,
+		`[{"op":"add","path":"/a","value":}]`,
+		`[{"op":"add","path":"/a'","value":1}]`,
+		`[{"op":"test","path":"/address","value":{"city":"Paris"}}]`,
+	} {
+		_, err := s.Patch("u", p)
+		g.Expect(errors.Is(err, gokvstore.ErrInvalidPatch)).To(BeTrue(), p)
+	}
+
+	v, err := s.Patch("missing", `{"a":1}`)
+	g.Expect(err).To(BeNil())
+	g.Expect(v).To(BeNil())
+	g.Expect(s.GetValue("missing")).To(BeNil())
+
+	// a merge patch that is not an object replaces the value
+	g.Expect(s.AddValueKVT("n", `{"a":1}`, "")).To(BeNil())
+	_, err = s.Patch("n", `[1, 2]`)
+	g.Expect(errors.Is(err, gokvstore.ErrInvalidPatch)).To(BeTrue())
+	v, err = s.Patch("n", `"s"`)
+	g.Expect(err).To(BeNil())
+	g.Expect(*v).To(MatchJSON(`"s"`))
+	v, err = s.Patch("n", `{"a":{"b":1}}`)
+	g.Expect(err).To(BeNil())
+	g.Expect(*v).To(MatchJSON(`{"a":{"b":1}}`))
+
+	// concurrent patches of different fields don't overwrite each other
+	g.Expect(s.AddValueKVT("c", `{}`, "")).To(BeNil())
+	var worker int32
+	concurrently(8, 1, func() {
+		w := atomic.AddInt32(&worker, 1)
+		for i := 1; i <= 20; i++ {
+			_, err := s.Patch("c", fmt.Sprintf(`{"f%d":%d}`, w, i))
+			g.Expect(err).To(BeNil())
+		}
+	})
+	g.Expect(*s.GetValue("c")).To(MatchJSON(
+		`{"f1":20,"f2":20,"f3":20,"f4":20,"f5":20,"f6":20,"f7":20,"f8":20}`))
+}
+
+func TestSqlitePatch(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	os.RemoveAll("kv_test_patch.db")
+	defer os.RemoveAll("kv_test_patch.db")
+
+	s, err := gokvstore.NewStoreSqlite("kv_test_patch", ".")
+	g.Expect(err).To(BeNil())
+	defer s.CloseAndDelete()
+
+	checkPatch(g, s)
+
+	// values that are not JSON can't be patched
+	g.Expect(s.AddValueKVT("text", "not json", "")).To(BeNil())
+	_, err = s.Patch("text", `{"a":1}`)
+	g.Expect(errors.Is(err, gokvstore.ErrPatchFailed)).To(BeTrue())
+	g.Expect(*s.GetValue("text")).To(Equal("not json"))
+}
+
+func TestPQPatch(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	for _, valueType := range []string{"jsonb", "json", "text"} {
+		s, err := gokvstore.NewStorePostgresWithValueType(
+			"test_patch_"+valueType,
+			valueType,
+			"host=localhost user=test password=test dbname=test sslmode=disable",
+			nil)
+		g.Expect(err).To(BeNil())
+
+		s.DeleteAll()
+		checkPatch(g, s)
+		s.DeleteAll()
+		s.Close()
+	}
+}
@@ -0,0 +1,102 @@
+package gokvstore_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/korovkin/gokvstore"
+
+	. "github.com/onsi/gomega"
+)
+
+type prefixStore interface {
+	AddValueKV(k string, v string) error
+	DeletePrefix(prefix string) (int64, error)
+	DeleteRange(begin string, end string) (int64, error)
+	CountPrefix(prefix string) (int64, error)
+	CountRange(begin string, end string) (int64, error)
+	Update(block func(tx *gokvstore.Tx) error) error
+	Snapshot(ctx context.Context) (*gokvstore.Snapshot, error)
+}
+
+func checkPrefix(g *GomegaWithT, s prefixStore) {
+	keys := []string{
+		"user/1", "user/2", "user/3", "user0", "users",
+		"order/1", "order/2",
+		"é/1", "é/2", "ê",
+		"~", "~~", "\u007f", "\u0080",
+		"\U0010FFFF", "\U0010FFFFa",
+	}
+	for _, k := range keys {
+		g.Expect(s.AddValueKV(k, `{}`)).To(BeNil())
+	}
+
+	g.Expect(s.CountPrefix("user/")).To(BeEquivalentTo(3))
+	g.Expect(s.CountPrefix("user")).To(BeEquivalentTo(5))
+	g.Expect(s.CountPrefix("é")).To(BeEquivalentTo(2))
+	g.Expect(s.CountPrefix("~")).To(BeEquivalentTo(2))
+	g.Expect(s.CountPrefix("\u007f")).To(BeEquivalentTo(1))
+	g.Expect(s.CountPrefix("\U0010FFFF")).To(BeEquivalentTo(2))
+	g.Expect(s.CountPrefix("nope")).To(BeEquivalentTo(0))
+	g.Expect(s.CountPrefix("")).To(BeEquivalentTo(len(keys)))
+	g.Expect(s.CountRange("order/", "user/2")).To(BeEquivalentTo(3))
+	g.Expect(s.CountRange("user/", "")).To(BeEquivalentTo(len(keys) - 2))
+
+	// transactions see their own deletes, the counts roll back with them
+	rollback := errors.New("rollback")
+	err := s.Update(func(tx *gokvstore.Tx) error {
+		g.Expect(tx.DeletePrefix("user/")).To(BeEquivalentTo(3))
+		g.Expect(tx.CountPrefix("user")).To(BeEquivalentTo(2))
+		g.Expect(tx.DeleteRange("order/", "order/2")).To(BeEquivalentTo(1))
+		g.Expect(tx.CountRange("order/", "")).To(BeEquivalentTo(len(keys) - 4))
+		return rollback
+	})
+	g.Expect(err).To(Equal(rollback))
+	g.Expect(s.CountPrefix("user/")).To(BeEquivalentTo(3))
+
+	snapshot, err := s.Snapshot(context.Background())
+	g.Expect(err).To(BeNil())
+	defer snapshot.Release()
+
+	g.Expect(s.DeletePrefix("user/")).To(BeEquivalentTo(3))
+	g.Expect(s.DeletePrefix("user/")).To(BeEquivalentTo(0))
+	g.Expect(s.CountPrefix("user")).To(BeEquivalentTo(2))
+	g.Expect(s.DeletePrefix("é")).To(BeEquivalentTo(2))
+	g.Expect(s.CountPrefix("ê")).To(BeEquivalentTo(1))
+	g.Expect(s.DeleteRange("order/2", "user0")).To(BeEquivalentTo(1))
+	g.Expect(s.CountPrefix("order/")).To(BeEquivalentTo(1))
+	g.Expect(s.DeletePrefix("\U0010FFFF")).To(BeEquivalentTo(2))
+
+	// the snapshot still sees the deleted keys
+	g.Expect(snapshot.CountPrefix("user/")).To(BeEquivalentTo(3))
+	g.Expect(snapshot.CountRange("", "")).To(BeEquivalentTo(len(keys)))
+
+	g.Expect(s.DeleteRange("", "")).To(BeEquivalentTo(len(keys) - 8))
+	g.Expect(s.CountPrefix("")).To(BeEquivalentTo(0))
+}
+
+func TestSqlitePrefix(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	s, err := gokvstore.NewStoreSqlite("kv_test_prefix", ".")
+	g.Expect(err).To(BeNil())
+	defer s.CloseAndDelete()
+
+	checkPrefix(g, s)
+}
+
+func TestPQPrefix(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	s, err := gokvstore.NewStorePostgres(
+		"test_prefix",
+		"host=localhost user=test password=test dbname=test sslmode=disable",
+		nil)
+	g.Expect(err).To(BeNil())
+	defer s.Close()
+
+	s.DeleteAll()
+	defer s.DeleteAll()
+	checkPrefix(g, s)
+}
@@ -0,0 +1,126 @@
+package gokvstore_test
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/korovkin/gokvstore"
+
+	. "github.com/onsi/gomega"
+)
+
+type projectionStore interface {
+	GetFields(k string, paths ...string) (*string, error)
+	IterateFieldsByKeyRangeASC(
+		begin string,
+		end string,
+		limit int,
+		paths []string,
+		block func(k *string, t *string, v *string, stop *bool)) error
+	IterateFieldsByKeyRangeDESC(
+		begin string,
+		end string,
+		limit int,
+		paths []string,
+		block func(k *string, t *string, v *string, stop *bool)) error
+	Find(q *gokvstore.Query) ([]gokvstore.Entry, error)
+	AddValueKVT(k string, v string, t string) error
+}
+
+func checkProjection(g *GomegaWithT, s projectionStore) {
+	for k, v := range map[string]string{
+		"u1": `{"name":"ann","age":30,"address":{"city":"Paris","zip":"75"},"tags":["a"],"bio":"long"}`,
+		"u2": `{"name":"bob","address":{"city":"Rome"},"tags":[],"bio":"longer"}`,
+		"u3": `[1,2]`,
+	} {
+		g.Expect(s.AddValueKVT(k, v, "t"+k)).To(BeNil())
+	}
+
+	v, err := s.GetFields("u1", "name", "address.city", "tags", "address", "missing")
+	g.Expect(err).To(BeNil())
+	g.Expect(*v).To(MatchJSON(
+		`{"name":"ann","address.city":"Paris","tags":["a"],"address":{"city":"Paris","zip":"75"},"missing":null}`))
+
+	v, err = s.GetFields("u3", "name")
+	g.Expect(err).To(BeNil())
+	g.Expect(*v).To(MatchJSON(`{"name":null}`))
+
+	v, err = s.GetFields("missing", "name")
+	g.Expect(err).To(BeNil())
+	g.Expect(v).To(BeNil())
+
+	for _, paths := range [][]string{{}, {"a b"}, {"a", "'"}} {
+		_, err = s.GetFields("u1", paths...)
+		g.Expect(errors.Is(err, gokvstore.ErrInvalidQuery)).To(BeTrue())
+	}
+
+	keys := []string{}
+	fields := []string{}
+	err = s.IterateFieldsByKeyRangeASC("u", "v", 10, []string{"name", "age"}, func(k *string, t *string, v *string, stop *bool) {
+		g.Expect(*t).To(Equal("t" + *k))
+		keys = append(keys, *k)
+		fields = append(fields, *v)
+	})
+	g.Expect(err).To(BeNil())
+	g.Expect(keys).To(Equal([]string{"u1", "u2", "u3"}))
+	g.Expect(fields[0]).To(MatchJSON(`{"name":"ann","age":30}`))
+	g.Expect(fields[1]).To(MatchJSON(`{"name":"bob","age":null}`))
+	g.Expect(fields[2]).To(MatchJSON(`{"name":null,"age":null}`))
+
+	keys = []string{}
+	err = s.IterateFieldsByKeyRangeDESC("u", "", 2, []string{"name"}, func(k *string, t *string, v *string, stop *bool) {
+		keys = append(keys, *k)
+	})
+	g.Expect(err).To(BeNil())
+	g.Expect(keys).To(Equal([]string{"u3", "u2"}))
+
+	err = s.IterateFieldsByKeyRangeASC("u", "", 10, nil, func(k *string, t *string, v *string, stop *bool) {})
+	g.Expect(errors.Is(err, gokvstore.ErrInvalidQuery)).To(BeTrue())
+
+	entries, err := s.Find(gokvstore.Where(gokvstore.Exists("name")).OrderByDesc("name").Select("name", "address.city"))
+	g.Expect(err).To(BeNil())
+	g.Expect(entries).To(HaveLen(2))
+	g.Expect(entries[0].Key).To(Equal("u2"))
+	g.Expect(entries[0].Value).To(MatchJSON(`{"name":"bob","address.city":"Rome"}`))
+	g.Expect(entries[1].Value).To(MatchJSON(`{"name":"ann","address.city":"Paris"}`))
+
+	_, err = s.Find(gokvstore.Where().Select())
+	g.Expect(errors.Is(err, gokvstore.ErrInvalidQuery)).To(BeTrue())
+}
+
+func TestSqliteProjection(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	os.RemoveAll("kv_test_projection.db")
+	defer os.RemoveAll("kv_test_projection.db")
+
+	s, err := gokvstore.NewStoreSqlite("kv_test_projection", ".")
+	g.Expect(err).To(BeNil())
+	defer s.CloseAndDelete()
+
+	checkProjection(g, s)
+
+	g.Expect(s.AddValueKVT("u4", "not json", "")).To(BeNil())
+	v, err := s.GetFields("u4", "name")
+	g.Expect(err).To(BeNil())
+	g.Expect(*v).To(Equal("null"))
+}
+
+func TestPQProjection(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	for _, valueType := range []string{"jsonb", "json"} {
+		s, err := gokvstore.NewStorePostgresWithValueType(
+			"test_projection_"+valueType,
+			valueType,
+			"host=localhost user=test password=test dbname=test sslmode=disable",
+			nil)
+		g.Expect(err).To(BeNil())
+
+		s.DeleteAll()
+		checkProjection(g, s)
+		s.DeleteAll()
+		s.Close()
+	}
+}
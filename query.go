@@ -0,0 +1,312 @@
+package gokvstore
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrInvalidQuery is returned by Find for a query with an invalid path or value
+var ErrInvalidQuery = errors.New("gokvstore: invalid query")
+
+// queries filter and sort the JSON values of a store by their fields,
+// they compile to the JSON functions of each backend with the same results:
+//
+//   - a field matches a value of its own JSON type only: 42 doesn't match "42"
+//   - numbers compare as numbers (1 and 1.0 are equal), strings byte by byte
+//   - values that are not JSON never match
+//
+// Paths name object fields, nested fields are separated by dots: "address.city"
+
+// filterOp the operation of a Filter
+type filterOp int
+
+const (
+	opEq filterOp = iota
+	opGt
+	opGte
+	opLt
+	opLte
+	opIn
+	opExists
+	opContains
+)
+
+// sqlOp the SQL comparison of the comparison operations
+var sqlOp = map[filterOp]string{
+	opEq:  "=",
+	opGt:  ">",
+	opGte: ">=",
+	opLt:  "<",
+	opLte: "<=",
+}
+
+// jsonScalar a JSON scalar of a filter
+type jsonScalar struct {
+	// kind "number", "string", "boolean" or "null" (as jsonb_typeof)
+	kind string
+	// text the number as written, the string, "true" or "false"
+	text string
+	// json the scalar as JSON
+	json string
+}
+
+func newJSONScalar(v interface{}) (jsonScalar, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return jsonScalar{}, fmt.Errorf("%w: %v", ErrInvalidQuery, err)
+	}
+
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var decoded interface{}
+	err = d.Decode(&decoded)
+	if err != nil {
+		return jsonScalar{}, fmt.Errorf("%w: %v", ErrInvalidQuery, err)
+	}
+
+	switch s := decoded.(type) {
+	case json.Number:
+		return jsonScalar{kind: "number", text: s.String(), json: string(b)}, nil
+	case string:
+		return jsonScalar{kind: "string", text: s, json: string(b)}, nil
+	case bool:
+		return jsonScalar{kind: "boolean", text: string(b), json: string(b)}, nil
+	case nil:
+		return jsonScalar{kind: "null", text: "null", json: "null"}, nil
+	}
+	return jsonScalar{}, fmt.Errorf("%w: %s is not a JSON scalar", ErrInvalidQuery, b)
+}
+
+// number the number as an int64 or a float64
+func (s jsonScalar) number() interface{} {
+	n := json.Number(s.text)
+	if i, err := n.Int64(); err == nil {
+		return i
+	}
+	f, _ := n.Float64()
+	return f
+}
+
+// Filter is a condition on a field of the values, see Eq, Gt, In, Exists and Contains
+type Filter struct {
+	op     filterOp
+	path   []string
+	values []jsonScalar
+	err    error
+}
+
+func newFilter(op filterOp, path string, values ...interface{}) Filter {
+	f := Filter{op: op}
+	f.path, f.err = queryPath(path)
+	for _, v := range values {
+		s, err := newJSONScalar(v)
+		if err != nil && f.err == nil {
+			f.err = err
+		}
+		if op != opEq && op != opIn && op != opContains && s.kind != "number" && s.kind != "string" {
+			f.err = fmt.Errorf("%w: only numbers and strings are ordered", ErrInvalidQuery)
+		}
+		f.values = append(f.values, s)
+	}
+	return f
+}
+
+func queryPath(path string) ([]string, error) {
+	segments := strings.Split(path, ".")
+	for _, segment := range segments {
+		if !indexName.MatchString(segment) {
+			return nil, fmt.Errorf("%w: path %q", ErrInvalidQuery, path)
+		}
+	}
+	return segments, nil
+}
+
+// Eq the field path is value (a string, a number, a bool or nil)
+func Eq(path string, value interface{}) Filter {
+	return newFilter(opEq, path, value)
+}
+
+// Gt the field path is greater than value (a string or a number)
+func Gt(path string, value interface{}) Filter {
+	return newFilter(opGt, path, value)
+}
+
+// Gte the field path is greater than or equal to value (a string or a number)
+func Gte(path string, value interface{}) Filter {
+	return newFilter(opGte, path, value)
+}
+
+// Lt the field path is less than value (a string or a number)
+func Lt(path string, value interface{}) Filter {
+	return newFilter(opLt, path, value)
+}
+
+// Lte the field path is less than or equal to value (a string or a number)
+func Lte(path string, value interface{}) Filter {
+	return newFilter(opLte, path, value)
+}
+
+// In the field path is one of values
+func In(path string, values ...interface{}) Filter {
+	return newFilter(opIn, path, values...)
+}
+
+// Exists the value has the field path, null included
+func Exists(path string) Filter {
+	return newFilter(opExists, path)
+}
+
+// Contains the field path is an array with the element value
+func Contains(path string, value interface{}) Filter {
+	return newFilter(opContains, path, value)
+}
+
+// queryOrder an ORDER BY of a query
+type queryOrder struct {
+	path []string
+	desc bool
+}
+
+// Query selects the values that match all its filters, see Where
+type Query struct {
+	filters []Filter
+	order   []queryOrder
+	fields  []string
+	limit   int
+	err     error
+}
+
+// Where a query for the values that match all the filters
+func Where(filters ...Filter) *Query {
+	q := &Query{filters: filters}
+	for _, f := range filters {
+		if f.err != nil {
+			q.err = f.err
+			break
+		}
+	}
+	return q
+}
+
+func (q *Query) orderBy(path string, desc bool) *Query {
+	segments, err := queryPath(path)
+	if err != nil && q.err == nil {
+		q.err = err
+	}
+	q.order = append(q.order, queryOrder{path: segments, desc: desc})
+	return q
+}
+
+// OrderBy sort by the field path in ASC order: numbers, then strings,
+// then the values without the field (or with another type).
+// The keys break the ties, in ASC order
+func (q *Query) OrderBy(path string) *Query {
+	return q.orderBy(path, false)
+}
+
+// OrderByDesc sort by the field path in DESC order: numbers, then strings,
+// then the values without the field (or with another type)
+func (q *Query) OrderByDesc(path string) *Query {
+	return q.orderBy(path, true)
+}
+
+// Select get only the fields paths of the values, see GetFields
+func (q *Query) Select(paths ...string) *Query {
+	q.fields = append([]string{}, paths...)
+	return q
+}
+
+// Limit return at most limit values, zero means no limit
+func (q *Query) Limit(limit int) *Query {
+	q.limit = limit
+	return q
+}
+
+func (q *Query) sqlLimit() int {
+	if q.limit <= 0 {
+		return noLimit
+	}
+	return q.limit
+}
+
+// queryDialect compiles the filters and the orders of a query for a backend
+type queryDialect interface {
+	// exists the field path is present
+	exists(path []string) string
+	// compare the field path op s
+	compare(path []string, op string, s jsonScalar, args *[]interface{}) string
+	// contains the field path is an array with the element s
+	contains(path []string, s jsonScalar, args *[]interface{}) string
+	// orderBy the ORDER BY terms of the field path: its type rank, the number and the string
+	orderBy(path []string) []string
+	// project the JSON object with the fields paths, named by names
+	project(names []string, paths [][]string) string
+}
+
+// maxProjectedFields the most fields of a projection, the arguments of the
+// JSON object functions are limited
+const maxProjectedFields = 50
+
+// projectFields get the expression of the JSON object with the fields paths of the values
+func projectFields(paths []string, d queryDialect) (string, error) {
+	if len(paths) == 0 || len(paths) > maxProjectedFields {
+		return "", fmt.Errorf("%w: %d fields, 1 to %d fields are projected", ErrInvalidQuery, len(paths), maxProjectedFields)
+	}
+	segments := [][]string{}
+	for _, path := range paths {
+		s, err := queryPath(path)
+		if err != nil {
+			return "", err
+		}
+		segments = append(segments, s)
+	}
+	return d.project(paths, segments), nil
+}
+
+// compileQuery get the WHERE condition and the ORDER BY of q, the parameters go to args
+func compileQuery(q *Query, d queryDialect, args *[]interface{}) (string, string, error) {
+	if q.err != nil {
+		return "", "", q.err
+	}
+
+	conditions := []string{}
+	for _, f := range q.filters {
+		switch f.op {
+		case opExists:
+			conditions = append(conditions, d.exists(f.path))
+		case opContains:
+			conditions = append(conditions, d.contains(f.path, f.values[0], args))
+		case opIn:
+			in := []string{}
+			for _, v := range f.values {
+				in = append(in, d.compare(f.path, "=", v, args))
+			}
+			if len(in) == 0 {
+				in = append(in, "1 = 0")
+			}
+			conditions = append(conditions, "("+strings.Join(in, " OR ")+")")
+		default:
+			conditions = append(conditions, d.compare(f.path, sqlOp[f.op], f.values[0], args))
+		}
+	}
+	where := "1 = 1"
+	if len(conditions) > 0 {
+		where = strings.Join(conditions, " AND ")
+	}
+
+	order := []string{}
+	for _, o := range q.order {
+		terms := d.orderBy(o.path)
+		direction := " ASC"
+		if o.desc {
+			direction = " DESC"
+		}
+		// the type rank is always ASC, the values without the field go last
+		order = append(order, terms[0]+" ASC", terms[1]+direction, terms[2]+direction)
+	}
+
+	return where, strings.Join(order, ", "), nil
+}
@@ -0,0 +1,145 @@
+package gokvstore_test
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/korovkin/gokvstore"
+
+	. "github.com/onsi/gomega"
+)
+
+type queryStore interface {
+	Find(q *gokvstore.Query) ([]gokvstore.Entry, error)
+	AddValueKVT(k string, v string, t string) error
+	TryLock(name string, ttl time.Duration) (*gokvstore.Lock, error)
+	Queue(name string, options gokvstore.QueueOptions) *gokvstore.Queue
+}
+
+func checkQuery(g *GomegaWithT, s queryStore) {
+	for k, v := range map[string]string{
+		"p1": `{"name":"ann","age":30,"tags":["a","b"],"address":{"city":"Paris"},"admin":true}`,
+		"p2": `{"name":"bob","age":25.5,"tags":["b"],"address":{"city":"Rome"},"admin":false}`,
+		"p3": `{"name":"cid","age":"30","tags":[],"nick":null}`,
+		"p4": `{"name":"Dan","age":40,"tags":["a",1,true]}`,
+		"p5": `{"name":"eve","age":30.0,"tags":{"b":1}}`,
+		"n":  `1`,
+		"s":  `"ann"`,
+		"a":  `["b"]`,
+	} {
+		g.Expect(s.AddValueKVT(k, v, "")).To(BeNil())
+	}
+
+	find := func(q *gokvstore.Query) []string {
+		entries, err := s.Find(q)
+		g.Expect(err).To(BeNil())
+		keys := []string{}
+		for _, e := range entries {
+			keys = append(keys, e.Key)
+		}
+		return keys
+	}
+
+	// the keys of locks and queues never match
+	l, err := s.TryLock("ann", time.Minute)
+	g.Expect(err).To(BeNil())
+	defer l.Unlock()
+	_, err = s.Queue("people", gokvstore.QueueOptions{}).Enqueue(`{"name":"ann","age":30}`, 0)
+	g.Expect(err).To(BeNil())
+	g.Expect(find(gokvstore.Where())).To(Equal([]string{"a", "n", "p1", "p2", "p3", "p4", "p5", "s"}))
+
+	// a field matches values of its own type
+	g.Expect(find(gokvstore.Where(gokvstore.Eq("age", 30)))).To(Equal([]string{"p1", "p5"}))
+	g.Expect(find(gokvstore.Where(gokvstore.Eq("age", "30")))).To(Equal([]string{"p3"}))
+	g.Expect(find(gokvstore.Where(gokvstore.Eq("name", "ann")))).To(Equal([]string{"p1"}))
+	g.Expect(find(gokvstore.Where(gokvstore.Eq("address.city", "Rome")))).To(Equal([]string{"p2"}))
+	g.Expect(find(gokvstore.Where(gokvstore.Eq("admin", true)))).To(Equal([]string{"p1"}))
+	g.Expect(find(gokvstore.Where(gokvstore.Eq("admin", false)))).To(Equal([]string{"p2"}))
+	g.Expect(find(gokvstore.Where(gokvstore.Eq("nick", nil)))).To(Equal([]string{"p3"}))
+
+	// comparisons
+	g.Expect(find(gokvstore.Where(gokvstore.Gt("age", 28)))).To(Equal([]string{"p1", "p4", "p5"}))
+	g.Expect(find(gokvstore.Where(gokvstore.Gte("age", 30.0)))).To(Equal([]string{"p1", "p4", "p5"}))
+	g.Expect(find(gokvstore.Where(gokvstore.Lt("age", 30)))).To(Equal([]string{"p2"}))
+	g.Expect(find(gokvstore.Where(gokvstore.Lte("age", 30)))).To(Equal([]string{"p1", "p2", "p5"}))
+	g.Expect(find(gokvstore.Where(gokvstore.Gt("name", "bob")))).To(Equal([]string{"p3", "p5"}))
+	g.Expect(find(gokvstore.Where(gokvstore.Gt("age", 26), gokvstore.Lt("age", 35)))).To(Equal([]string{"p1", "p5"}))
+
+	// in, exists, contains
+	g.Expect(find(gokvstore.Where(gokvstore.In("age", 25.5, "30", 99)))).To(Equal([]string{"p2", "p3"}))
+	g.Expect(find(gokvstore.Where(gokvstore.In("age")))).To(BeEmpty())
+	g.Expect(find(gokvstore.Where(gokvstore.Exists("nick")))).To(Equal([]string{"p3"}))
+	g.Expect(find(gokvstore.Where(gokvstore.Exists("address.city")))).To(Equal([]string{"p1", "p2"}))
+	g.Expect(find(gokvstore.Where(gokvstore.Contains("tags", "b")))).To(Equal([]string{"p1", "p2"}))
+	g.Expect(find(gokvstore.Where(gokvstore.Contains("tags", 1)))).To(Equal([]string{"p4"}))
+	g.Expect(find(gokvstore.Where(gokvstore.Contains("tags", 1.0)))).To(Equal([]string{"p4"}))
+	g.Expect(find(gokvstore.Where(gokvstore.Contains("tags", true)))).To(Equal([]string{"p4"}))
+	g.Expect(find(gokvstore.Where(gokvstore.Contains("tags", "1")))).To(BeEmpty())
+	g.Expect(find(gokvstore.Where(gokvstore.Eq("age", 30), gokvstore.Exists("admin")))).To(Equal([]string{"p1"}))
+
+	// order and limit
+	g.Expect(find(gokvstore.Where(gokvstore.Exists("age")).OrderBy("age"))).
+		To(Equal([]string{"p2", "p1", "p5", "p4", "p3"}))
+	g.Expect(find(gokvstore.Where(gokvstore.Exists("age")).OrderByDesc("age"))).
+		To(Equal([]string{"p4", "p1", "p5", "p2", "p3"}))
+	g.Expect(find(gokvstore.Where(gokvstore.Exists("age")).OrderByDesc("age").Limit(2))).
+		To(Equal([]string{"p4", "p1"}))
+	g.Expect(find(gokvstore.Where().OrderBy("name"))).
+		To(Equal([]string{"p4", "p1", "p2", "p3", "p5", "a", "n", "s"}))
+	g.Expect(find(gokvstore.Where().OrderBy("age").OrderByDesc("name"))).
+		To(Equal([]string{"p2", "p5", "p1", "p4", "p3", "a", "n", "s"}))
+
+	entries, err := s.Find(gokvstore.Where(gokvstore.Eq("name", "bob")))
+	g.Expect(err).To(BeNil())
+	g.Expect(entries).To(HaveLen(1))
+	g.Expect(entries[0].Value).To(ContainSubstring("Rome"))
+
+	// invalid queries
+	for _, q := range []*gokvstore.Query{
+		gokvstore.Where(gokvstore.Eq("a b", 1)),
+		gokvstore.Where(gokvstore.Eq("a..b", 1)),
+		gokvstore.Where(gokvstore.Eq("a", []int{1})),
+		gokvstore.Where(gokvstore.Gt("age", true)),
+		gokvstore.Where(gokvstore.Lt("age", nil)),
+		gokvstore.Where(gokvstore.Contains("tags", map[string]int{"a": 1})),
+		gokvstore.Where().OrderBy("'"),
+	} {
+		_, err := s.Find(q)
+		g.Expect(errors.Is(err, gokvstore.ErrInvalidQuery)).To(BeTrue())
+	}
+}
+
+func TestSqliteQuery(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	os.RemoveAll("kv_test_query.db")
+	defer os.RemoveAll("kv_test_query.db")
+
+	s, err := gokvstore.NewStoreSqlite("kv_test_query", ".")
+	g.Expect(err).To(BeNil())
+	defer s.CloseAndDelete()
+
+	// values that are not JSON never match
+	g.Expect(s.AddValueKVT("text", "not json", "")).To(BeNil())
+	checkQuery(g, s)
+}
+
+func TestPQQuery(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	for _, valueType := range []string{"jsonb", "json"} {
+		s, err := gokvstore.NewStorePostgresWithValueType(
+			"test_query_"+valueType,
+			valueType,
+			"host=localhost user=test password=test dbname=test sslmode=disable",
+			nil)
+		g.Expect(err).To(BeNil())
+
+		s.DeleteAll()
+		checkQuery(g, s)
+		s.DeleteAll()
+		s.Close()
+	}
+}
@@ -0,0 +1,360 @@
+package gokvstore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/korovkin/gotils"
+)
+
+// queues live in the same table as the rest of the store:
+//
+//	"\x01Q\x01" + name + "\x01M" + id  a message of the queue
+//	"\x01Q\x01" + name + "\x01D" + id  a dead letter of the queue
+//
+// the value is the body of the message and the tag is its receipt:
+// the time it becomes visible (unix nanoseconds of the db clock, 20 digits),
+// a dot and the number of deliveries. Every delivery changes the receipt
+const queuePrefix = "\x01Q\x01"
+
+// queuePollInterval how often DequeueWait looks for a visible message
+const queuePollInterval = 100 * time.Millisecond
+
+// ErrInvalidQueueName is returned for empty queue names
+// and for queue names with control characters
+var ErrInvalidQueueName = errors.New("gokvstore: invalid queue name")
+
+// ErrMessageLost is returned by Ack, Nack and Extend for a message
+// whose visibility timeout expired and that was delivered again
+var ErrMessageLost = errors.New("gokvstore: the message was delivered again")
+
+// QueueOptions the options of a queue
+type QueueOptions struct {
+	// Visibility how long a dequeued message stays hidden from the other
+	// consumers, it's delivered again unless it's acked in time
+	Visibility time.Duration
+
+	// MaxAttempts the deliveries of a message before it's moved to the dead letters,
+	// a negative MaxAttempts never moves messages to the dead letters
+	MaxAttempts int
+}
+
+// DefaultQueueOptions is used for the zero fields of QueueOptions
+var DefaultQueueOptions = QueueOptions{
+	Visibility:  30 * time.Second,
+	MaxAttempts: 5,
+}
+
+func (o QueueOptions) withDefaults() QueueOptions {
+	if o.Visibility <= 0 {
+		o.Visibility = DefaultQueueOptions.Visibility
+	}
+	if o.MaxAttempts == 0 {
+		o.MaxAttempts = DefaultQueueOptions.MaxAttempts
+	}
+	return o
+}
+
+// Queue is a durable work queue inside a store: every message is delivered
+// to a single consumer at a time, until it's acked or moved to the dead letters.
+// Queue handles are cheap, all the queues of a store share its prepared statements
+type Queue struct {
+	Name    string
+	Options QueueOptions
+	prefix  string
+	err     error
+	kv
+	update func(block func(tx *Tx) error) error
+}
+
+func newQueue(c kv, update func(block func(tx *Tx) error) error, name string, options QueueOptions) *Queue {
+	q := &Queue{
+		Name:    name,
+		Options: options.withDefaults(),
+		prefix:  queuePrefix + name + "\x01",
+		kv:      c,
+		update:  update,
+	}
+	if !validBucketName(name) {
+		q.err = ErrInvalidQueueName
+	}
+	return q
+}
+
+func (q *Queue) messages() (string, string) {
+	return q.prefix + "M", q.prefix + "N"
+}
+
+func (q *Queue) deadLetters() (string, string) {
+	return q.prefix + "D", q.prefix + "E"
+}
+
+// Message is a message delivered by Dequeue
+type Message struct {
+	ID       string
+	Body     string
+	Attempts int
+
+	// Receipt identifies this delivery of the message
+	Receipt string
+
+	// VisibleAt when the message is delivered again if it's not acked
+	VisibleAt time.Time
+
+	q *Queue
+}
+
+// newMessageID a message id that sorts by enqueue time
+func newMessageID() (string, error) {
+	r, err := newOwner()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%020d.%s", time.Now().UnixNano(), r[:8]), nil
+}
+
+// parseReceipt parse the tag of a message
+func parseReceipt(t string) (time.Time, int, error) {
+	if len(t) < 22 || t[20] != '.' {
+		return time.Time{}, 0, fmt.Errorf("gokvstore: invalid receipt %q", t)
+	}
+	visibleAt, err := parseExpires(t[:20])
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	attempts, err := strconv.Atoi(t[21:])
+	return visibleAt, attempts, err
+}
+
+func (q *Queue) newMessage(k string, v string, t string) (*Message, error) {
+	visibleAt, attempts, err := parseReceipt(t)
+	if err != nil {
+		return nil, err
+	}
+	// the id follows the prefix and the M or D of the key
+	id := k[len(q.prefix)+1:]
+	return &Message{ID: id, Body: v, Attempts: attempts, Receipt: t, VisibleAt: visibleAt, q: q}, nil
+}
+
+// Enqueue add a message with body to the queue, it becomes visible after delay.
+// The body is stored as a value, so it has to be valid JSON in jsonb and json stores
+func (q *Queue) Enqueue(body string, delay time.Duration) (string, error) {
+	if q.err != nil {
+		return "", q.err
+	}
+	id, err := newMessageID()
+	if err != nil {
+		return "", err
+	}
+	begin, _ := q.messages()
+	err = q.exec(q.stmts.queueEnqueue, begin+id, body, int64(delay))
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// Dequeue get the next visible message and hide it for the visibility timeout,
+// nil if there's none. Messages delivered MaxAttempts times are moved to the dead letters
+func (q *Queue) Dequeue() (*Message, error) {
+	if q.err != nil {
+		return nil, q.err
+	}
+	begin, end := q.messages()
+
+	for {
+		var k, v, t string
+		err := q.retry.do(func() error {
+			return q.stmts.queueDequeue.QueryRow(begin, end, int64(q.Options.Visibility)).Scan(&k, &v, &t)
+		})
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		gotils.CheckNotFatal(err)
+		if err != nil {
+			return nil, err
+		}
+
+		m, err := q.newMessage(k, v, t)
+		if err != nil {
+			return nil, err
+		}
+		if q.Options.MaxAttempts < 0 || m.Attempts <= q.Options.MaxAttempts {
+			return m, nil
+		}
+
+		err = m.deadLetter()
+		if err != nil && err != ErrMessageLost {
+			return nil, err
+		}
+	}
+}
+
+// DequeueWait get the next visible message, waiting for one until ctx is done
+func (q *Queue) DequeueWait(ctx context.Context) (*Message, error) {
+	for {
+		m, err := q.Dequeue()
+		if m != nil || err != nil {
+			return m, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(queuePollInterval):
+		}
+	}
+}
+
+// DeadLetters get up to limit of the messages moved to the dead letters
+func (q *Queue) DeadLetters(limit int) ([]*Message, error) {
+	if q.err != nil {
+		return nil, q.err
+	}
+	return q.deadLettersIn(q.kv, limit)
+}
+
+// deadLettersIn get up to limit of the dead letters under c
+func (q *Queue) deadLettersIn(c kv, limit int) ([]*Message, error) {
+	begin, end := q.deadLetters()
+
+	messages := []*Message{}
+	var merr error
+	err := c.iterateByKeyRange(false, begin, end, limit, func(k *string, t *string, v *string, stop *bool) {
+		var m *Message
+		m, merr = q.newMessage(*k, *v, *t)
+		if merr != nil {
+			*stop = true
+			return
+		}
+		messages = append(messages, m)
+	})
+	if err == nil {
+		err = merr
+	}
+	return messages, err
+}
+
+// Redrive move all the dead letters back to the queue in a single transaction,
+// get the number of moved messages. The messages dead lettered meanwhile stay
+func (q *Queue) Redrive() (int, error) {
+	if q.err != nil {
+		return 0, q.err
+	}
+
+	moved := 0
+	err := q.update(func(tx *Tx) error {
+		moved = 0
+		// the rows of a query have to be read before the next statement of the transaction
+		messages, err := q.deadLettersIn(tx.kv, noLimit)
+		if err != nil {
+			return err
+		}
+		for _, m := range messages {
+			// only the dead letter that was read, by its receipt
+			deleted, err := tx.execCount(tx.stmts.queueAck, q.prefix+"D"+m.ID, m.Receipt)
+			if err != nil {
+				return err
+			}
+			if deleted == 0 {
+				continue
+			}
+			err = tx.exec(tx.stmts.queueEnqueue, q.prefix+"M"+m.ID, m.Body, int64(0))
+			if err != nil {
+				return err
+			}
+			moved++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return moved, nil
+}
+
+// ack delete this delivery of m under c
+func (m *Message) ack(c kv) error {
+	var deleted int64
+	op := func() error {
+		res, err := c.stmt(c.stmts.queueAck).Exec(m.q.prefix+"M"+m.ID, m.Receipt)
+		if err != nil {
+			return err
+		}
+		deleted, err = res.RowsAffected()
+		return err
+	}
+
+	var err error
+	if c.tx == nil {
+		err = c.retry.do(op)
+	} else {
+		err = op()
+	}
+	gotils.CheckNotFatal(err)
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return ErrMessageLost
+	}
+	return nil
+}
+
+// Ack delete the message from the queue, fails with ErrMessageLost
+// if it was delivered again after its visibility timeout
+func (m *Message) Ack() error {
+	return m.ack(m.q.kv)
+}
+
+// setVisibleAt make the message visible again after d
+func (m *Message) setVisibleAt(d time.Duration) error {
+	var t string
+	err := m.q.retry.do(func() error {
+		return m.q.stmts.queueNack.QueryRow(m.q.prefix+"M"+m.ID, m.Receipt, int64(d)).Scan(&t)
+	})
+	if err == sql.ErrNoRows {
+		return ErrMessageLost
+	}
+	gotils.CheckNotFatal(err)
+	if err != nil {
+		return err
+	}
+
+	visibleAt, _, err := parseReceipt(t)
+	if err != nil {
+		return err
+	}
+	m.Receipt = t
+	m.VisibleAt = visibleAt
+	return nil
+}
+
+// Nack give the message back to the queue, it's delivered again after delay.
+// A message delivered MaxAttempts times is moved to the dead letters instead
+func (m *Message) Nack(delay time.Duration) error {
+	if m.q.Options.MaxAttempts >= 0 && m.Attempts >= m.q.Options.MaxAttempts {
+		return m.deadLetter()
+	}
+	return m.setVisibleAt(delay)
+}
+
+// Extend keep the message hidden from the other consumers for d from now
+func (m *Message) Extend(d time.Duration) error {
+	return m.setVisibleAt(d)
+}
+
+// deadLetter move the message to the dead letters of its queue
+func (m *Message) deadLetter() error {
+	return m.q.update(func(tx *Tx) error {
+		err := m.ack(tx.kv)
+		if err != nil {
+			return err
+		}
+		return tx.addValueKVT(m.q.prefix+"D"+m.ID, m.Body, m.Receipt)
+	})
+}
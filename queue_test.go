@@ -0,0 +1,240 @@
+package gokvstore_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/korovkin/gokvstore"
+
+	. "github.com/onsi/gomega"
+)
+
+type queueStore interface {
+	Queue(name string, options gokvstore.QueueOptions) *gokvstore.Queue
+}
+
+func checkQueue(g *GomegaWithT, s queueStore) {
+	_, err := s.Queue("", gokvstore.QueueOptions{}).Enqueue("1", 0)
+	g.Expect(err).To(Equal(gokvstore.ErrInvalidQueueName))
+
+	q := s.Queue("jobs", gokvstore.QueueOptions{Visibility: 300 * time.Millisecond, MaxAttempts: 2})
+	m, err := q.Dequeue()
+	g.Expect(err).To(BeNil())
+	g.Expect(m).To(BeNil())
+
+	for _, body := range []string{"1", "2", "3"} {
+		_, err = q.Enqueue(body, 0)
+		g.Expect(err).To(BeNil())
+	}
+
+	// in order
+	m, err = q.Dequeue()
+	g.Expect(err).To(BeNil())
+	g.Expect(m.Body).To(Equal("1"))
+	g.Expect(m.Attempts).To(Equal(1))
+	g.Expect(m.Ack()).To(BeNil())
+	g.Expect(m.Ack()).To(Equal(gokvstore.ErrMessageLost))
+
+	// a message that's not acked is delivered again after the visibility timeout
+	lost, err := q.Dequeue()
+	g.Expect(err).To(BeNil())
+	g.Expect(lost.Body).To(Equal("2"))
+
+	m, err = q.Dequeue()
+	g.Expect(err).To(BeNil())
+	g.Expect(m.Body).To(Equal("3"))
+	g.Expect(m.Ack()).To(BeNil())
+
+	m, err = q.Dequeue()
+	g.Expect(err).To(BeNil())
+	g.Expect(m).To(BeNil())
+
+	time.Sleep(400 * time.Millisecond)
+	m, err = q.Dequeue()
+	g.Expect(err).To(BeNil())
+	g.Expect(m.ID).To(Equal(lost.ID))
+	g.Expect(m.Attempts).To(Equal(2))
+	g.Expect(m.Receipt).ToNot(Equal(lost.Receipt))
+	g.Expect(lost.Ack()).To(Equal(gokvstore.ErrMessageLost))
+	g.Expect(lost.Nack(0)).To(Equal(gokvstore.ErrMessageLost))
+
+	// the last attempt goes to the dead letters
+	g.Expect(m.Nack(0)).To(BeNil())
+	m, err = q.Dequeue()
+	g.Expect(err).To(BeNil())
+	g.Expect(m).To(BeNil())
+
+	dead, err := q.DeadLetters(10)
+	g.Expect(err).To(BeNil())
+	g.Expect(dead).To(HaveLen(1))
+	g.Expect(dead[0].ID).To(Equal(lost.ID))
+	g.Expect(dead[0].Body).To(Equal("2"))
+	g.Expect(dead[0].Attempts).To(Equal(2))
+
+	moved, err := q.Redrive()
+	g.Expect(err).To(BeNil())
+	g.Expect(moved).To(Equal(1))
+	dead, err = q.DeadLetters(10)
+	g.Expect(err).To(BeNil())
+	g.Expect(dead).To(BeEmpty())
+
+	m, err = q.Dequeue()
+	g.Expect(err).To(BeNil())
+	g.Expect(m.Body).To(Equal("2"))
+	g.Expect(m.Attempts).To(Equal(1))
+	g.Expect(m.Nack(0)).To(BeNil())
+
+	m, err = q.Dequeue()
+	g.Expect(err).To(BeNil())
+	g.Expect(m.Attempts).To(Equal(2))
+	visibleAt := m.VisibleAt
+	g.Expect(m.Extend(time.Second)).To(BeNil())
+	g.Expect(m.VisibleAt).To(BeTemporally(">", visibleAt))
+	g.Expect(m.Ack()).To(BeNil())
+
+	// delayed messages
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = q.Enqueue("4", 200*time.Millisecond)
+	g.Expect(err).To(BeNil())
+	m, err = q.Dequeue()
+	g.Expect(err).To(BeNil())
+	g.Expect(m).To(BeNil())
+	now := time.Now()
+	m, err = q.DequeueWait(ctx)
+	g.Expect(err).To(BeNil())
+	g.Expect(m.Body).To(Equal("4"))
+	g.Expect(time.Since(now)).To(BeNumerically(">=", 100*time.Millisecond))
+	g.Expect(m.Ack()).To(BeNil())
+
+	short, cancelShort := context.WithTimeout(context.Background(), 150*time.Millisecond)
+	defer cancelShort()
+	_, err = q.DequeueWait(short)
+	g.Expect(err).To(Equal(context.DeadlineExceeded))
+
+	// a consumer that died on the last attempt
+	once := s.Queue("once", gokvstore.QueueOptions{Visibility: 50 * time.Millisecond, MaxAttempts: 1})
+	_, err = once.Enqueue("5", 0)
+	g.Expect(err).To(BeNil())
+	m, err = once.Dequeue()
+	g.Expect(err).To(BeNil())
+	g.Expect(m.Body).To(Equal("5"))
+	time.Sleep(100 * time.Millisecond)
+	m, err = once.Dequeue()
+	g.Expect(err).To(BeNil())
+	g.Expect(m).To(BeNil())
+	dead, err = once.DeadLetters(10)
+	g.Expect(err).To(BeNil())
+	g.Expect(dead).To(HaveLen(1))
+
+	// every message is delivered to a single consumer
+	work := s.Queue("work", gokvstore.QueueOptions{Visibility: time.Minute})
+	for i := 0; i < 100; i++ {
+		_, err = work.Enqueue(fmt.Sprint(i), 0)
+		g.Expect(err).To(BeNil())
+	}
+
+	mutex := sync.Mutex{}
+	delivered := map[string]int{}
+	concurrently(8, 1, func() {
+		for {
+			m, err := work.Dequeue()
+			g.Expect(err).To(BeNil())
+			if m == nil {
+				return
+			}
+			mutex.Lock()
+			delivered[m.Body]++
+			mutex.Unlock()
+			g.Expect(m.Ack()).To(BeNil())
+		}
+	})
+	g.Expect(delivered).To(HaveLen(100))
+	for _, n := range delivered {
+		g.Expect(n).To(Equal(1))
+	}
+}
+
+// checkRedriveRace dead letters messages while they are redriven, none is lost
+func checkRedriveRace(g *GomegaWithT, s queueStore) {
+	q := s.Queue("redrive", gokvstore.QueueOptions{Visibility: time.Minute, MaxAttempts: 1})
+	const messages = 300
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < messages; i++ {
+			_, err := q.Enqueue(fmt.Sprint(i), 0)
+			g.Expect(err).To(BeNil())
+			m, err := q.Dequeue()
+			g.Expect(err).To(BeNil())
+			g.Expect(m).ToNot(BeNil())
+			g.Expect(m.Nack(0)).To(BeNil())
+		}
+	}()
+
+	redriving := true
+	for redriving {
+		select {
+		case <-done:
+			redriving = false
+		default:
+		}
+		_, err := q.Redrive()
+		g.Expect(err).To(BeNil())
+	}
+
+	bodies := map[string]bool{}
+	dead, err := q.DeadLetters(messages * 2)
+	g.Expect(err).To(BeNil())
+	for _, m := range dead {
+		bodies[m.Body] = true
+	}
+	for {
+		m, err := q.Dequeue()
+		g.Expect(err).To(BeNil())
+		if m == nil {
+			break
+		}
+		bodies[m.Body] = true
+		g.Expect(m.Ack()).To(BeNil())
+	}
+	g.Expect(len(bodies)).To(Equal(messages))
+}
+
+func TestSqliteQueue(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	os.RemoveAll("kv_test_queue.db")
+	defer os.RemoveAll("kv_test_queue.db")
+
+	s, err := gokvstore.NewStoreSqlite("kv_test_queue", ".")
+	g.Expect(err).To(BeNil())
+	defer s.CloseAndDelete()
+
+	checkQueue(g, s)
+	checkRedriveRace(g, s)
+}
+
+func TestPQQueue(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	for _, valueType := range []string{"jsonb", "text"} {
+		s, err := gokvstore.NewStorePostgresWithValueType(
+			"test_queue_"+valueType,
+			valueType,
+			"host=localhost user=test password=test dbname=test sslmode=disable",
+			nil)
+		g.Expect(err).To(BeNil())
+
+		s.DeleteAll()
+		checkQueue(g, s)
+		checkRedriveRace(g, s)
+		s.DeleteAll()
+		s.Close()
+	}
+}
@@ -0,0 +1,188 @@
+package gokvstore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/korovkin/gotils"
+)
+
+// retention treats the tags as generations: every write of an ingest tags its keys
+// with the generation of the ingest, and generations sort like their tags (byte by byte).
+// The untagged keys and the keys of buckets, locks and queues are never deleted
+
+// ErrInvalidRetention is returned for a retention policy that keeps everything
+// or keeps a duration without a Generation
+var ErrInvalidRetention = errors.New("gokvstore: invalid retention policy")
+
+// RetentionPolicy which generations a Retention keeps: the last KeepGenerations
+// generations and the generations newer than KeepFor, the older ones are deleted
+type RetentionPolicy struct {
+	// KeepGenerations keep the keys of the newest KeepGenerations tags, zero doesn't keep by count
+	KeepGenerations int
+
+	// KeepFor keep the keys of the generations newer than KeepFor, zero doesn't keep by age
+	KeepFor time.Duration
+
+	// Generation the tag of the generation ingested at t, needed by KeepFor.
+	// The tags of later generations are greater, e.g. fixed width timestamps
+	Generation func(t time.Time) string
+
+	// DryRun count the keys that would be deleted, nothing is deleted
+	DryRun bool
+}
+
+func (p RetentionPolicy) validate() error {
+	if p.KeepGenerations < 0 || p.KeepFor < 0 {
+		return ErrInvalidRetention
+	}
+	if p.KeepGenerations == 0 && p.KeepFor == 0 {
+		return ErrInvalidRetention
+	}
+	if p.KeepFor > 0 && p.Generation == nil {
+		return ErrInvalidRetention
+	}
+	return nil
+}
+
+// RetentionStats counts the runs of a Retention
+type RetentionStats struct {
+	// Runs the number of runs, the failed ones included
+	Runs int64
+	// Failures the number of failed runs
+	Failures int64
+	// Deleted the number of keys deleted (or counted by dry runs) by all the runs
+	Deleted int64
+	// LastRun when the last run started
+	LastRun time.Time
+	// LastDeleted the number of keys deleted by the last successful run
+	LastDeleted int64
+	// LastGeneration the oldest generation kept by the last successful run, empty if it kept everything
+	LastGeneration string
+}
+
+// Retention deletes the old generations of a store, see RetentionPolicy
+type Retention struct {
+	Policy RetentionPolicy
+	update func(block func(tx *Tx) error) error
+	dryRun func(block func(tx *Tx) error) ([]string, error)
+	logger Logger
+	mutex  sync.Mutex
+	stats  RetentionStats
+}
+
+func newRetention(
+	update func(block func(tx *Tx) error) error,
+	dryRun func(block func(tx *Tx) error) ([]string, error),
+	logger Logger,
+	policy RetentionPolicy) (*Retention, error) {
+	err := policy.validate()
+	if err != nil {
+		return nil, err
+	}
+	return &Retention{Policy: policy, update: update, dryRun: dryRun, logger: logger}, nil
+}
+
+// generation get the n-th newest generation (from 0), false if there are fewer generations
+func (c kv) generation(n int) (string, bool, error) {
+	var t string
+	err := c.stmt(c.stmts.generation).QueryRow(n).Scan(&t)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	gotils.CheckNotFatal(err)
+	return t, err == nil, err
+}
+
+// oldestKept get the oldest generation kept by the policy at now, empty if it keeps everything
+func (r *Retention) oldestKept(tx *Tx, now time.Time) (string, error) {
+	oldest := ""
+	if r.Policy.KeepGenerations > 0 {
+		g, ok, err := tx.generation(r.Policy.KeepGenerations - 1)
+		if err != nil || !ok {
+			return "", err
+		}
+		oldest = g
+	}
+	if r.Policy.KeepFor > 0 {
+		g := r.Policy.Generation(now.Add(-r.Policy.KeepFor))
+		if oldest == "" || g < oldest {
+			oldest = g
+		}
+	}
+	return oldest, nil
+}
+
+// Run delete the generations older than the ones the policy keeps in a single
+// transaction, get the number of deleted keys
+func (r *Retention) Run() (int64, error) {
+	now := time.Now()
+
+	var deleted int64
+	var oldest string
+	block := func(tx *Tx) error {
+		deleted = 0
+		var err error
+		oldest, err = r.oldestKept(tx, now)
+		if err != nil || oldest == "" {
+			return err
+		}
+		deleted, err = tx.execCount(tx.stmts.deleteOlder, oldest)
+		return err
+	}
+
+	var err error
+	if r.Policy.DryRun {
+		_, err = r.dryRun(block)
+	} else {
+		err = r.update(block)
+	}
+
+	r.mutex.Lock()
+	r.stats.Runs++
+	r.stats.LastRun = now
+	if err != nil {
+		r.stats.Failures++
+	} else {
+		r.stats.Deleted += deleted
+		r.stats.LastDeleted = deleted
+		r.stats.LastGeneration = oldest
+	}
+	r.mutex.Unlock()
+
+	if err != nil {
+		r.logger.Println("STORE: Retention: error:", err)
+		return 0, err
+	}
+	if r.Policy.DryRun {
+		r.logger.Println("STORE: Retention: dry run: would delete:", deleted, "keys older than generation:", oldest, "time:", time.Since(now))
+	} else {
+		r.logger.Println("STORE: Retention: deleted:", deleted, "keys older than generation:", oldest, "time:", time.Since(now))
+	}
+	return deleted, nil
+}
+
+// RunEvery run the retention every interval until ctx is done, the failed runs are logged
+func (r *Retention) RunEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.Run()
+		}
+	}
+}
+
+// Stats get the counters of the runs
+func (r *Retention) Stats() RetentionStats {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.stats
+}
@@ -0,0 +1,181 @@
+package gokvstore_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/korovkin/gokvstore"
+
+	. "github.com/onsi/gomega"
+)
+
+type retentionStore interface {
+	AddValueKVT(k string, v string, t string) error
+	DeleteWhereTagLT(t string) (int64, error)
+	DeleteTagRange(begin string, end string) (int64, error)
+	CountPrefix(prefix string) (int64, error)
+	DryRun(block func(tx *gokvstore.Tx) error) ([]string, error)
+	Retention(policy gokvstore.RetentionPolicy) (*gokvstore.Retention, error)
+	CreateBucket(name string) (*gokvstore.Bucket, error)
+	TryLock(name string, ttl time.Duration) (*gokvstore.Lock, error)
+	Queue(name string, options gokvstore.QueueOptions) *gokvstore.Queue
+}
+
+func checkRetention(g *GomegaWithT, s retentionStore) {
+	for i := 1; i <= 5; i++ {
+		for _, k := range []string{"a", "b"} {
+			g.Expect(s.AddValueKVT(fmt.Sprintf("k%d%s", i, k), `{}`, fmt.Sprintf("g%02d", i))).To(BeNil())
+		}
+	}
+	g.Expect(s.AddValueKVT("untagged", `{}`, "")).To(BeNil())
+
+	// tag deletes, in a dry run
+	var lt, between, newer int64
+	deleted, err := s.DryRun(func(tx *gokvstore.Tx) error {
+		var err error
+		lt, err = tx.DeleteWhereTagLT("g02")
+		if err != nil {
+			return err
+		}
+		between, err = tx.DeleteTagRange("g02", "g04")
+		if err != nil {
+			return err
+		}
+		newer, err = tx.DeleteTagRange("g05", "")
+		return err
+	})
+	g.Expect(err).To(BeNil())
+	g.Expect([]int64{lt, between, newer}).To(Equal([]int64{3, 4, 2}))
+	g.Expect(deleted).To(Equal([]string{
+		"k1a", "k1b", "untagged",
+		"k2a", "k2b", "k3a", "k3b",
+		"k5a", "k5b"}))
+	g.Expect(s.CountPrefix("")).To(BeEquivalentTo(11))
+
+	// the keys of buckets, locks and queues are not generations
+	b, err := s.CreateBucket("b")
+	g.Expect(err).To(BeNil())
+	g.Expect(b.AddValueKVT("x", `{}`, "g01")).To(BeNil())
+	_, err = s.TryLock("job", time.Minute)
+	g.Expect(err).To(BeNil())
+	q := s.Queue("jobs", gokvstore.QueueOptions{})
+	for _, body := range []string{`{"n":1}`, `{"n":2}`} {
+		_, err = q.Enqueue(body, 0)
+		g.Expect(err).To(BeNil())
+	}
+	inFlight, err := q.Dequeue()
+	g.Expect(err).To(BeNil())
+
+	for _, policy := range []gokvstore.RetentionPolicy{
+		{},
+		{KeepGenerations: -1},
+		{KeepFor: time.Hour},
+	} {
+		_, err = s.Retention(policy)
+		g.Expect(err).To(Equal(gokvstore.ErrInvalidRetention))
+	}
+
+	r, err := s.Retention(gokvstore.RetentionPolicy{KeepGenerations: 3, DryRun: true})
+	g.Expect(err).To(BeNil())
+	g.Expect(r.Run()).To(BeEquivalentTo(4))
+	g.Expect(s.CountPrefix("k1")).To(BeEquivalentTo(2))
+
+	r.Policy.DryRun = false
+	g.Expect(r.Run()).To(BeEquivalentTo(4))
+	g.Expect(s.CountPrefix("k1")).To(BeEquivalentTo(0))
+	g.Expect(s.CountPrefix("k2")).To(BeEquivalentTo(0))
+	g.Expect(s.CountPrefix("k3")).To(BeEquivalentTo(2))
+	g.Expect(s.CountPrefix("untagged")).To(BeEquivalentTo(1))
+	g.Expect(b.GetValue("x")).NotTo(BeNil())
+	_, err = s.TryLock("job", time.Minute)
+	g.Expect(err).To(Equal(gokvstore.ErrLockHeld))
+	g.Expect(r.Run()).To(BeEquivalentTo(0))
+
+	stats := r.Stats()
+	g.Expect(stats.Runs).To(BeEquivalentTo(3))
+	g.Expect(stats.Failures).To(BeEquivalentTo(0))
+	g.Expect(stats.Deleted).To(BeEquivalentTo(8))
+	g.Expect(stats.LastDeleted).To(BeEquivalentTo(0))
+	g.Expect(stats.LastGeneration).To(Equal("g03"))
+
+	// the generations kept by count or by age
+	r, err = s.Retention(gokvstore.RetentionPolicy{
+		KeepGenerations: 1,
+		KeepFor:         time.Hour,
+		Generation: func(t time.Time) string {
+			g.Expect(time.Since(t)).To(BeNumerically("~", time.Hour, time.Minute))
+			return "g04"
+		},
+	})
+	g.Expect(err).To(BeNil())
+	g.Expect(r.Run()).To(BeEquivalentTo(2))
+	g.Expect(s.CountPrefix("k3")).To(BeEquivalentTo(0))
+	g.Expect(s.CountPrefix("k4")).To(BeEquivalentTo(2))
+
+	// fewer generations than kept
+	r, err = s.Retention(gokvstore.RetentionPolicy{KeepGenerations: 3})
+	g.Expect(err).To(BeNil())
+	g.Expect(r.Run()).To(BeEquivalentTo(0))
+	g.Expect(r.Stats().LastGeneration).To(Equal(""))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		r.RunEvery(ctx, 10*time.Millisecond)
+		close(done)
+	}()
+	g.Eventually(func() int64 { return r.Stats().Runs }).Should(BeNumerically(">=", 3))
+	cancel()
+	<-done
+
+	// the tag deletes keep the bucket, the lock and the queue
+	g.Expect(s.DeleteTagRange("0", ":")).To(BeEquivalentTo(0))
+	g.Expect(s.DeleteTagRange("g05", "")).To(BeEquivalentTo(2))
+	g.Expect(s.DeleteWhereTagLT("g05")).To(BeEquivalentTo(3))
+	g.Expect(s.CountPrefix("k")).To(BeEquivalentTo(0))
+	g.Expect(s.CountPrefix("untagged")).To(BeEquivalentTo(0))
+	g.Expect(b.GetValue("x")).NotTo(BeNil())
+	_, err = s.TryLock("job", time.Minute)
+	g.Expect(err).To(Equal(gokvstore.ErrLockHeld))
+	g.Expect(inFlight.Ack()).To(BeNil())
+	m, err := q.Dequeue()
+	g.Expect(err).To(BeNil())
+	g.Expect(m.Body).To(MatchJSON(`{"n":2}`))
+}
+
+func TestSqliteRetention(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	os.RemoveAll("kv_test_retention.db")
+	var logs bytes.Buffer
+	s, err := gokvstore.NewStoreSqliteWithOptions(gokvstore.SqliteOptions{
+		Filename: "kv_test_retention.db",
+		Logger:   log.New(&logs, "", 0),
+	})
+	g.Expect(err).To(BeNil())
+	defer s.CloseAndDelete()
+
+	checkRetention(g, s)
+	g.Expect(logs.String()).To(ContainSubstring("STORE: Retention: dry run: would delete: 4 keys older than generation: g03"))
+	g.Expect(logs.String()).To(ContainSubstring("STORE: Retention: deleted: 4 keys older than generation: g03"))
+}
+
+func TestPQRetention(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	s, err := gokvstore.NewStorePostgres(
+		"test_retention",
+		"host=localhost user=test password=test dbname=test sslmode=disable",
+		nil)
+	g.Expect(err).To(BeNil())
+	defer s.Close()
+
+	s.DeleteAll()
+	defer s.DeleteAll()
+	checkRetention(g, s)
+}
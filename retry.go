@@ -0,0 +1,146 @@
+package gokvstore
+
+import (
+	"database/sql"
+	"errors"
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"github.com/korovkin/gotils"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+)
+
+// RetryPolicy configures how operations that failed with a retryable error
+// (see IsRetryable) are retried, the zero value selects DefaultRetryPolicy
+type RetryPolicy struct {
+	// MaxAttempts the number of attempts including the first one, 1 disables retries
+	MaxAttempts int
+	// InitialBackoff the wait before the first retry
+	InitialBackoff time.Duration
+	// MaxBackoff the longest wait between attempts
+	MaxBackoff time.Duration
+	// Multiplier grows the wait after every attempt
+	Multiplier float64
+	// Jitter the fraction (0 to 1) of every wait that is randomized
+	Jitter float64
+}
+
+// DefaultRetryPolicy retries up to 5 times, waiting 10ms, 20ms, 40ms and 80ms (minus jitter)
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    5,
+	InitialBackoff: 10 * time.Millisecond,
+	MaxBackoff:     time.Second,
+	Multiplier:     2,
+	Jitter:         0.5,
+}
+
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.MaxAttempts == 0 {
+		return DefaultRetryPolicy
+	}
+	if p.Multiplier < 1 {
+		p.Multiplier = 1
+	}
+	if p.MaxBackoff < p.InitialBackoff {
+		p.MaxBackoff = p.InitialBackoff
+	}
+	return p
+}
+
+// RetryStats counts the retries of a store
+type RetryStats struct {
+	// Retries the number of attempts after the first one
+	Retries int64
+	// Recovered the number of operations that succeeded after a retry
+	Recovered int64
+	// Exhausted the number of operations that failed after their last attempt
+	Exhausted int64
+}
+
+// IsRetryable is err a transient error that is worth retrying:
+// sqlite busy or locked, postgres serialization failure (40001) or deadlock (40P01)
+func IsRetryable(err error) bool {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code == "40001" || pqErr.Code == "40P01"
+	}
+
+	return false
+}
+
+// retrier runs operations under a retry policy and counts the retries
+type retrier struct {
+	retries   int64
+	recovered int64
+	exhausted int64
+	policy    RetryPolicy
+	// writer the writer connection of a sqlite database, nil for postgres
+	writer *writer
+}
+
+func newRetrier(policy RetryPolicy) *retrier {
+	return &retrier{policy: policy.withDefaults()}
+}
+
+// do run op until it succeeds, fails with an error that isn't retryable
+// or runs out of attempts
+func (r *retrier) do(op func() error) error {
+	err := r.writer.check()
+	if err != nil {
+		return err
+	}
+
+	backoff := r.policy.InitialBackoff
+
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil {
+			if attempt > 1 {
+				atomic.AddInt64(&r.recovered, 1)
+			}
+			return nil
+		}
+
+		if !IsRetryable(err) {
+			return err
+		}
+
+		if attempt >= r.policy.MaxAttempts {
+			atomic.AddInt64(&r.exhausted, 1)
+			return err
+		}
+
+		atomic.AddInt64(&r.retries, 1)
+		time.Sleep(backoff - time.Duration(rand.Float64()*r.policy.Jitter*float64(backoff)))
+
+		backoff = time.Duration(float64(backoff) * r.policy.Multiplier)
+		if backoff > r.policy.MaxBackoff {
+			backoff = r.policy.MaxBackoff
+		}
+	}
+}
+
+// exec run a write statement that isn't part of a transaction
+func (r *retrier) exec(stmt *sql.Stmt, args ...interface{}) error {
+	err := r.do(func() error {
+		_, err := stmt.Exec(args...)
+		return err
+	})
+	gotils.CheckNotFatal(err)
+	return err
+}
+
+func (r *retrier) stats() RetryStats {
+	return RetryStats{
+		Retries:   atomic.LoadInt64(&r.retries),
+		Recovered: atomic.LoadInt64(&r.recovered),
+		Exhausted: atomic.LoadInt64(&r.exhausted),
+	}
+}
@@ -0,0 +1,183 @@
+package gokvstore_test
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/korovkin/gokvstore"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestIsRetryable(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	g.Expect(gokvstore.IsRetryable(sqlite3.Error{Code: sqlite3.ErrBusy})).To(BeTrue())
+	g.Expect(gokvstore.IsRetryable(sqlite3.Error{Code: sqlite3.ErrLocked})).To(BeTrue())
+	g.Expect(gokvstore.IsRetryable(sqlite3.Error{Code: sqlite3.ErrConstraint})).To(BeFalse())
+	g.Expect(gokvstore.IsRetryable(&pq.Error{Code: "40001"})).To(BeTrue())
+	g.Expect(gokvstore.IsRetryable(&pq.Error{Code: "40P01"})).To(BeTrue())
+	g.Expect(gokvstore.IsRetryable(&pq.Error{Code: "23505"})).To(BeFalse())
+	g.Expect(gokvstore.IsRetryable(fmt.Errorf("wrapped: %w", &pq.Error{Code: "40001"}))).To(BeTrue())
+	g.Expect(gokvstore.IsRetryable(errors.New("database is locked"))).To(BeFalse())
+	g.Expect(gokvstore.IsRetryable(nil)).To(BeFalse())
+}
+
+// lockSqlite hold the write lock of filename for d
+func lockSqlite(g *WithT, filename string, d time.Duration) (release chan struct{}) {
+	db, err := sql.Open("sqlite3", filename)
+	g.Expect(err).To(BeNil())
+	tx, err := db.Begin()
+	g.Expect(err).To(BeNil())
+	_, err = tx.Exec(`INSERT OR REPLACE INTO KV(K, V, T) VALUES('locker', '{}', '')`)
+	g.Expect(err).To(BeNil())
+
+	release = make(chan struct{})
+	go func() {
+		defer close(release)
+		time.Sleep(d)
+		tx.Commit()
+		db.Close()
+	}()
+	return release
+}
+
+func TestSqliteRetry(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	filename := "kv_test_retry.db"
+	os.RemoveAll(filename)
+
+	s, err := gokvstore.NewStoreSqliteWithOptions(gokvstore.SqliteOptions{
+		Filename:    filename,
+		BusyTimeout: time.Millisecond,
+		Retry: gokvstore.RetryPolicy{
+			MaxAttempts:    20,
+			InitialBackoff: 10 * time.Millisecond,
+			MaxBackoff:     50 * time.Millisecond,
+			Multiplier:     2,
+			Jitter:         0.5,
+		},
+	})
+	g.Expect(err).To(BeNil())
+	defer s.CloseAndDelete()
+
+	// a single write waits for the other writer
+	released := lockSqlite(g, filename, 100*time.Millisecond)
+	g.Expect(s.AddValueKVT("k1", "v1", "t")).To(BeNil())
+	<-released
+	g.Expect(*s.GetValue("k1")).To(Equal("v1"))
+
+	stats := s.RetryStats()
+	g.Expect(stats.Retries).To(BeNumerically(">", 0))
+	g.Expect(stats.Recovered).To(Equal(int64(1)))
+	g.Expect(stats.Exhausted).To(Equal(int64(0)))
+
+	// the transaction is replayed
+	released = lockSqlite(g, filename, 100*time.Millisecond)
+	runs := 0
+	err = s.Update(func(tx *gokvstore.Tx) error {
+		runs++
+		err := tx.AddValueKVT("k2", "v2", "t")
+		if err != nil {
+			return err
+		}
+		return tx.AddValueKVT("k3", "v3", "t")
+	})
+	g.Expect(err).To(BeNil())
+	<-released
+	g.Expect(runs).To(BeNumerically(">", 1))
+	g.Expect(*s.GetValue("k2")).To(Equal("v2"))
+	g.Expect(*s.GetValue("k3")).To(Equal("v3"))
+	g.Expect(s.RetryStats().Recovered).To(Equal(int64(2)))
+
+	// errors that are not retryable are returned right away
+	runs = 0
+	failure := errors.New("failure")
+	err = s.Update(func(tx *gokvstore.Tx) error {
+		runs++
+		return failure
+	})
+	g.Expect(err).To(Equal(failure))
+	g.Expect(runs).To(Equal(1))
+}
+
+func TestSqliteRetryExhausted(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	filename := "kv_test_retry_exhausted.db"
+	os.RemoveAll(filename)
+
+	s, err := gokvstore.NewStoreSqliteWithOptions(gokvstore.SqliteOptions{
+		Filename:    filename,
+		BusyTimeout: time.Millisecond,
+		Retry:       gokvstore.RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond},
+	})
+	g.Expect(err).To(BeNil())
+	defer s.CloseAndDelete()
+
+	released := lockSqlite(g, filename, 500*time.Millisecond)
+	err = s.AddValueKVT("k1", "v1", "t")
+	g.Expect(gokvstore.IsRetryable(err)).To(BeTrue())
+	<-released
+
+	stats := s.RetryStats()
+	g.Expect(stats.Retries).To(Equal(int64(2)))
+	g.Expect(stats.Recovered).To(Equal(int64(0)))
+	g.Expect(stats.Exhausted).To(Equal(int64(1)))
+}
+
+func TestPQRetry(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	s, err := gokvstore.NewStorePostgresWithOptions(gokvstore.PostgresOptions{
+		Name:       "test_retry",
+		Connection: "host=localhost user=test password=test dbname=test sslmode=disable",
+	})
+	g.Expect(err).To(BeNil())
+	defer s.Close()
+	defer s.DeleteAll()
+
+	// the two transactions lock k1 and k2 in opposite orders,
+	// postgres aborts one of them with a deadlock and it's replayed
+	start := sync.WaitGroup{}
+	start.Add(2)
+	write := func(first string, second string) error {
+		runs := 0
+		return s.Update(func(tx *gokvstore.Tx) error {
+			runs++
+			err := tx.AddValueKVT(first, `{"by": "`+first+`"}`, "t")
+			if err != nil {
+				return err
+			}
+			if runs == 1 {
+				start.Done()
+				start.Wait()
+			}
+			return tx.AddValueKVT(second, `{"by": "`+first+`"}`, "t")
+		})
+	}
+
+	wg := sync.WaitGroup{}
+	errs := make([]error, 2)
+	for i, keys := range [][]string{{"k1", "k2"}, {"k2", "k1"}} {
+		wg.Add(1)
+		go func(i int, keys []string) {
+			defer wg.Done()
+			errs[i] = write(keys[0], keys[1])
+		}(i, keys)
+	}
+	wg.Wait()
+
+	g.Expect(errs[0]).To(BeNil())
+	g.Expect(errs[1]).To(BeNil())
+	g.Expect(s.RetryStats().Recovered).To(Equal(int64(1)))
+	g.Expect(*s.GetValue("k1")).To(Equal(*s.GetValue("k2")))
+}
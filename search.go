@@ -0,0 +1,65 @@
+package gokvstore
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+
+	"github.com/korovkin/gotils"
+)
+
+// ErrSearchDisabled is returned by Search on a store without a full text index (see EnableSearch)
+var ErrSearchDisabled = errors.New("gokvstore: full text search is not enabled")
+
+// the full text index of a store indexes the words of the values:
+// the strings of the JSON values, the whole text of the other values.
+// Words are lower cased, they are not stemmed, the accents are kept.
+// A search matches the values with all the words of the query
+
+// SearchResult a key found by Search, higher ranks are better matches.
+// Ranks are comparable within the results of a search only
+type SearchResult struct {
+	Key  string
+	Rank float64
+}
+
+// searchWords the words of a search query, none for a blank query
+func searchWords(query string) []string {
+	return strings.Fields(query)
+}
+
+// search run the search statement stmt of a store, up to limit results, zero means no limit
+func search(stmt *sql.Stmt, match string, limit int) ([]SearchResult, error) {
+	if stmt == nil {
+		return nil, ErrSearchDisabled
+	}
+	if match == "" {
+		return []SearchResult{}, nil
+	}
+	if limit <= 0 {
+		limit = noLimit
+	}
+	res, err := stmt.Query(match, limit)
+	gotils.CheckNotFatal(err)
+	if err != nil {
+		return nil, err
+	}
+	return scanSearchResults(res)
+}
+
+// scanSearchResults read the (K, rank) rows of res
+func scanSearchResults(res *sql.Rows) ([]SearchResult, error) {
+	defer res.Close()
+
+	results := []SearchResult{}
+	for res.Next() {
+		r := SearchResult{}
+		err := res.Scan(&r.Key, &r.Rank)
+		gotils.CheckNotFatal(err)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, r)
+	}
+	return results, res.Err()
+}
@@ -0,0 +1,23 @@
+//go:build !sqlite_fts5
+
+package gokvstore_test
+
+import (
+	"testing"
+
+	"github.com/korovkin/gokvstore"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestSqliteSearchWithoutFTS5(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	s, err := gokvstore.NewStoreSqlite("kv_test_search", ":memory:")
+	g.Expect(err).To(BeNil())
+	defer s.Close()
+
+	err = s.EnableSearch()
+	g.Expect(err).NotTo(BeNil())
+	g.Expect(err.Error()).To(ContainSubstring("sqlite_fts5"))
+}
@@ -0,0 +1,41 @@
+//go:build sqlite_fts5
+
+package gokvstore_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/korovkin/gokvstore"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestSqliteSearch(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	os.RemoveAll("kv_test_search.db")
+	defer os.RemoveAll("kv_test_search.db")
+
+	s, err := gokvstore.NewStoreSqlite("kv_test_search", ".")
+	g.Expect(err).To(BeNil())
+	defer s.CloseAndDelete()
+
+	g.Expect(s.AddValueKVT("old", `{"title":"archived"}`, "")).To(BeNil())
+	// sqlite values don't have to be JSON, their whole text is indexed
+	g.Expect(s.AddValueKVT("text", "plain text, not json", "")).To(BeNil())
+	checkSearch(g, s)
+	g.Expect(searchKeys(g, s, "plain json", 0)).To(Equal([]string{"text"}))
+
+	// the index survives a VACUUM and a reopen with the declared search
+	_, err = s.Db.Exec(`VACUUM`)
+	g.Expect(err).To(BeNil())
+	s2, err := gokvstore.NewStoreSqliteWithOptions(gokvstore.SqliteOptions{
+		Filename: "kv_test_search.db",
+		Search:   true,
+	})
+	g.Expect(err).To(BeNil())
+	defer s2.Close()
+	g.Expect(searchKeys(g, s2, "archived", 0)).To(Equal([]string{"old"}))
+	g.Expect(searchKeys(g, s2, "fox", 0)).To(ConsistOf("a", "b", "c"))
+}
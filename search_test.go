@@ -0,0 +1,116 @@
+package gokvstore_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/korovkin/gokvstore"
+
+	. "github.com/onsi/gomega"
+)
+
+type searchStore interface {
+	EnableSearch() error
+	Search(query string, limit int) ([]gokvstore.SearchResult, error)
+	AddValueKVT(k string, v string, t string) error
+	DeleteValue(k string) (int64, error)
+	Patch(k string, patch string) (*string, error)
+}
+
+func searchKeys(g *GomegaWithT, s searchStore, query string, limit int) []string {
+	results, err := s.Search(query, limit)
+	g.Expect(err).To(BeNil())
+	keys := []string{}
+	for i, r := range results {
+		if i > 0 {
+			g.Expect(r.Rank).To(BeNumerically("<=", results[i-1].Rank))
+		}
+		keys = append(keys, r.Key)
+	}
+	return keys
+}
+
+// checkSearch expects a store without search and with the value of "old"
+func checkSearch(g *GomegaWithT, s searchStore) {
+	_, err := s.Search("quick", 0)
+	g.Expect(errors.Is(err, gokvstore.ErrSearchDisabled)).To(BeTrue())
+
+	g.Expect(s.EnableSearch()).To(BeNil())
+	g.Expect(s.EnableSearch()).To(BeNil())
+
+	// the values written before the index was created are indexed
+	g.Expect(searchKeys(g, s, "archived", 0)).To(Equal([]string{"old"}))
+
+	g.Expect(s.AddValueKVT("a", `{"title":"The quick brown fox","tags":["animals","Forest"]}`, "")).To(BeNil())
+	g.Expect(s.AddValueKVT("b", `{"title":"quick quick quick","body":{"text":"fox"}}`, "")).To(BeNil())
+	g.Expect(s.AddValueKVT("c", `{"title":"Lazy dog","n":42,"quick":true}`, "")).To(BeNil())
+	g.Expect(s.AddValueKVT("d", `{"title":"Café au lait"}`, "")).To(BeNil())
+
+	// all the words, case insensitive, only the strings of the values
+	g.Expect(searchKeys(g, s, "QUICK fox", 0)).To(ConsistOf("a", "b"))
+	g.Expect(searchKeys(g, s, "forest", 0)).To(Equal([]string{"a"}))
+	g.Expect(searchKeys(g, s, "fox dog", 0)).To(BeEmpty())
+	g.Expect(searchKeys(g, s, "42", 0)).To(BeEmpty())
+	g.Expect(searchKeys(g, s, "café", 0)).To(Equal([]string{"d"}))
+	g.Expect(searchKeys(g, s, "cafe", 0)).To(BeEmpty())
+	g.Expect(searchKeys(g, s, "  ", 0)).To(BeEmpty())
+	g.Expect(searchKeys(g, s, `fox" OR "dog`, 0)).To(BeEmpty())
+
+	// the best matches first
+	g.Expect(searchKeys(g, s, "quick", 0)).To(Equal([]string{"b", "a"}))
+	g.Expect(searchKeys(g, s, "quick", 1)).To(Equal([]string{"b"}))
+
+	// writes update the index
+	g.Expect(s.AddValueKVT("a", `{"title":"The slow brown fox"}`, "")).To(BeNil())
+	g.Expect(searchKeys(g, s, "quick", 0)).To(Equal([]string{"b"}))
+	g.Expect(searchKeys(g, s, "slow", 0)).To(Equal([]string{"a"}))
+
+	_, err = s.Patch("c", `{"title":"Lazy fox"}`)
+	g.Expect(err).To(BeNil())
+	g.Expect(searchKeys(g, s, "fox", 0)).To(ConsistOf("a", "b", "c"))
+
+	g.Expect(s.DeleteValue("b")).To(BeEquivalentTo(1))
+	g.Expect(searchKeys(g, s, "fox", 0)).To(ConsistOf("a", "c"))
+	g.Expect(s.AddValueKVT("b", `{"title":"fox again"}`, "")).To(BeNil())
+	g.Expect(searchKeys(g, s, "again", 0)).To(Equal([]string{"b"}))
+}
+
+func TestPQSearch(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	for _, valueType := range []string{"jsonb", "json"} {
+		s, err := gokvstore.NewStorePostgresWithValueType(
+			"test_search_"+valueType,
+			valueType,
+			"host=localhost user=test password=test dbname=test sslmode=disable",
+			nil)
+		g.Expect(err).To(BeNil())
+
+		_, err = s.Db.Exec(`DROP TABLE IF EXISTS kv_test_search_` + valueType)
+		g.Expect(err).To(BeNil())
+		s.Close()
+
+		s, err = gokvstore.NewStorePostgresWithValueType(
+			"test_search_"+valueType,
+			valueType,
+			"host=localhost user=test password=test dbname=test sslmode=disable",
+			nil)
+		g.Expect(err).To(BeNil())
+		g.Expect(s.AddValueKVT("old", `{"title":"archived"}`, "")).To(BeNil())
+		checkSearch(g, s)
+
+		// declared search
+		s2, err := gokvstore.NewStorePostgresWithOptions(gokvstore.PostgresOptions{
+			Name:       "test_search_" + valueType,
+			ValueType:  valueType,
+			Connection: "host=localhost user=test password=test dbname=test sslmode=disable",
+			Search:     true,
+		})
+		g.Expect(err).To(BeNil())
+		g.Expect(searchKeys(g, s2, "archived", 0)).To(Equal([]string{"old"}))
+		s2.Close()
+
+		s.DeleteAll()
+		s.Close()
+	}
+}
@@ -0,0 +1,113 @@
+package gokvstore
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/korovkin/gotils"
+)
+
+// Snapshot is a consistent read only view of a store: all its reads see the store
+// as it was when the snapshot was taken. It holds a transaction until Release
+// is called or the context of the snapshot is done
+type Snapshot struct {
+	kv
+	countAll *sql.Stmt
+}
+
+// newSnapshot begin a read transaction on db and pin its view with the query pin
+func newSnapshot(
+	ctx context.Context,
+	db *sql.DB,
+	options *sql.TxOptions,
+	pin string,
+	stmts *kvStmts,
+	countAll *sql.Stmt) (*Snapshot, error) {
+	tx, err := db.BeginTx(ctx, options)
+	gotils.CheckNotFatal(err)
+	if err != nil {
+		return nil, err
+	}
+
+	// the view is taken by the first read of the transaction
+	var n int
+	err = tx.QueryRowContext(ctx, pin).Scan(&n)
+	gotils.CheckNotFatal(err)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	return &Snapshot{kv: kv{stmts: stmts, tx: tx, readOnly: true}, countAll: countAll}, nil
+}
+
+// Release end the snapshot, releasing an already released snapshot is a no-op
+func (s *Snapshot) Release() error {
+	err := s.tx.Rollback()
+	if err == sql.ErrTxDone {
+		return nil
+	}
+	return err
+}
+
+// GetValue get the value for the given k, nil if k is not in the store
+func (s *Snapshot) GetValue(k string) (*string, error) {
+	return s.getValue(k)
+}
+
+// GetValueAsJSON get the value for the given k into o
+func (s *Snapshot) GetValueAsJSON(k string, o interface{}) error {
+	return s.getValueAsJSON(k, o)
+}
+
+// CountAll count the items in the store, and get the min and max keys
+func (s *Snapshot) CountAll() (int64, string, string, error) {
+	var count int64
+	var min, max sql.NullString
+	err := s.tx.Stmt(s.countAll).QueryRow().Scan(&count, &min, &max)
+	gotils.CheckNotFatal(err)
+	return count, min.String, max.String, err
+}
+
+// CountPrefix count the keys that start with prefix, but the keys of buckets, locks and queues
+func (s *Snapshot) CountPrefix(prefix string) (int64, error) {
+	return s.countRange(prefix, prefixEnd(prefix))
+}
+
+// CountRange count the keys with begin <= key < end, an empty end means no upper bound.
+// The keys of buckets, locks and queues are not counted
+func (s *Snapshot) CountRange(begin string, end string) (int64, error) {
+	return s.countRange(begin, end)
+}
+
+// IterateAll traverse all the items in the store in ASC order
+func (s *Snapshot) IterateAll(block func(k string, t string, v string, stop *bool)) error {
+	return s.iterateByKeyRange(false, "", "", noLimit, func(k *string, t *string, v *string, stop *bool) {
+		block(*k, *t, *v, stop)
+	})
+}
+
+// IterateByKeyRangeASC traverse the items with begin <= key < end in ASC order,
+// an empty end means no upper bound
+func (s *Snapshot) IterateByKeyRangeASC(
+	begin string,
+	end string,
+	limit int,
+	block func(k *string, t *string, v *string, stop *bool)) error {
+	return s.iterateByKeyRange(false, begin, end, limit, block)
+}
+
+// IterateByKeyRangeDESC traverse the items with begin <= key < end in DESC order,
+// an empty end means no upper bound
+func (s *Snapshot) IterateByKeyRangeDESC(
+	begin string,
+	end string,
+	limit int,
+	block func(k *string, t *string, v *string, stop *bool)) error {
+	return s.iterateByKeyRange(true, begin, end, limit, block)
+}
+
+// Bucket get a read only handle to the bucket name in the snapshot
+func (s *Snapshot) Bucket(name string) *Bucket {
+	return newBucket(s.kv, name)
+}
@@ -0,0 +1,141 @@
+package gokvstore_test
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/korovkin/gokvstore"
+
+	. "github.com/onsi/gomega"
+)
+
+// snapshotStore the snapshot API shared by StoreSqlite and StorePostgres
+type snapshotStore interface {
+	Snapshot(ctx context.Context) (*gokvstore.Snapshot, error)
+	AddValueKVT(k string, v string, t string) error
+	DeleteValue(k string) (int64, error)
+	GetValue(k string) *string
+	CreateBucket(name string) (*gokvstore.Bucket, error)
+}
+
+func snapshotKeys(g *GomegaWithT, snapshot *gokvstore.Snapshot) []string {
+	keys := []string{}
+	err := snapshot.IterateAll(func(k string, t string, v string, stop *bool) {
+		keys = append(keys, k)
+	})
+	g.Expect(err).To(BeNil())
+	return keys
+}
+
+func checkSnapshot(g *GomegaWithT, s snapshotStore) {
+	for _, k := range []string{"a", "b", "c"} {
+		g.Expect(s.AddValueKVT(k, `"`+k+`"`, "t")).To(BeNil())
+	}
+
+	ctx := context.Background()
+	snapshot, err := s.Snapshot(ctx)
+	g.Expect(err).To(BeNil())
+
+	// the writes go on, the snapshot doesn't see them
+	g.Expect(s.DeleteValue("a")).To(BeEquivalentTo(1))
+	g.Expect(s.AddValueKVT("b", `"changed"`, "t")).To(BeNil())
+	g.Expect(s.AddValueKVT("d", `"d"`, "t")).To(BeNil())
+	g.Expect(s.GetValue("a")).To(BeNil())
+
+	count, min, max, err := snapshot.CountAll()
+	g.Expect(err).To(BeNil())
+	g.Expect(count).To(Equal(int64(3)))
+	g.Expect(min).To(Equal("a"))
+	g.Expect(max).To(Equal("c"))
+
+	v, err := snapshot.GetValue("a")
+	g.Expect(err).To(BeNil())
+	g.Expect(*v).To(Equal(`"a"`))
+
+	var b string
+	g.Expect(snapshot.GetValueAsJSON("b", &b)).To(BeNil())
+	g.Expect(b).To(Equal("b"))
+
+	v, err = snapshot.GetValue("d")
+	g.Expect(err).To(BeNil())
+	g.Expect(v).To(BeNil())
+
+	g.Expect(snapshotKeys(g, snapshot)).To(Equal([]string{"a", "b", "c"}))
+
+	desc := []string{}
+	err = snapshot.IterateByKeyRangeDESC("b", "", 10, func(k *string, t *string, v *string, stop *bool) {
+		desc = append(desc, *k)
+	})
+	g.Expect(err).To(BeNil())
+	g.Expect(desc).To(Equal([]string{"c", "b"}))
+
+	// snapshots are read only
+	g.Expect(snapshot.Bucket("users").AddValueKV("k", `"v"`)).To(Equal(gokvstore.ErrReadOnly))
+
+	g.Expect(snapshot.Release()).To(BeNil())
+	g.Expect(snapshot.Release()).To(BeNil())
+	_, err = snapshot.GetValue("a")
+	g.Expect(err).To(Equal(sql.ErrTxDone))
+
+	// a new snapshot sees the writes
+	snapshot, err = s.Snapshot(ctx)
+	g.Expect(err).To(BeNil())
+	g.Expect(snapshotKeys(g, snapshot)).To(Equal([]string{"b", "c", "d"}))
+	g.Expect(snapshot.Release()).To(BeNil())
+
+	// buckets
+	users, err := s.CreateBucket("users")
+	g.Expect(err).To(BeNil())
+	g.Expect(users.AddValueKV("u1", `"u1"`)).To(BeNil())
+
+	snapshot, err = s.Snapshot(ctx)
+	g.Expect(err).To(BeNil())
+	g.Expect(users.DeleteValue("u1")).To(BeEquivalentTo(1))
+	v, err = snapshot.Bucket("users").GetValue("u1")
+	g.Expect(err).To(BeNil())
+	g.Expect(*v).To(Equal(`"u1"`))
+	g.Expect(snapshot.Release()).To(BeNil())
+
+	// released by the context
+	ctx, cancel := context.WithCancel(ctx)
+	snapshot, err = s.Snapshot(ctx)
+	g.Expect(err).To(BeNil())
+	cancel()
+	g.Eventually(func() error {
+		_, err := snapshot.GetValue("b")
+		return err
+	}, time.Second).ShouldNot(BeNil())
+	g.Expect(snapshot.Release()).To(BeNil())
+}
+
+func TestSqliteSnapshot(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	os.RemoveAll("kv_test_snapshot.db")
+	defer os.RemoveAll("kv_test_snapshot.db")
+
+	s, err := gokvstore.NewStoreSqlite("kv_test_snapshot", ".")
+	g.Expect(err).To(BeNil())
+	defer s.CloseAndDelete()
+
+	checkSnapshot(g, s)
+}
+
+func TestPQSnapshot(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	s, err := gokvstore.NewStorePostgres(
+		"test_snapshot",
+		"host=localhost user=test password=test dbname=test sslmode=disable",
+		nil)
+	g.Expect(err).To(BeNil())
+	defer s.Close()
+
+	s.DeleteAll()
+	defer s.DeleteAll()
+
+	checkSnapshot(g, s)
+}
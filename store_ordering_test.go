@@ -0,0 +1,122 @@
+package gokvstore_test
+
+import (
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/korovkin/gokvstore"
+
+	. "github.com/onsi/gomega"
+)
+
+// orderingKeys mixes case, digits, punctuation and non-ASCII keys.
+// byte-wise (binary) ordering is the expected ordering on every backend.
+var orderingKeys = []string{
+	"b", "B", "a", "A", "Z", "z",
+	"10", "9", "007", "0007",
+	"a b", "a-b", "a_b", "a.b", "~",
+	"e", "é", "E", "É", "ß", "ss",
+	"日本", "中文", "😀",
+}
+
+// maxKey is greater than or equal to any valid UTF-8 key
+const maxKey = "\U0010FFFF"
+
+func expectedOrdering(desc bool) []string {
+	expected := append([]string{}, orderingKeys...)
+	sort.Strings(expected)
+	if desc {
+		sort.Sort(sort.Reverse(sort.StringSlice(expected)))
+	}
+	return expected
+}
+
+func checkKeyOrdering(
+	g *GomegaWithT,
+	add func(k string, v string) error,
+	iterateASC func(keyPrefix string, limit int, block func(k *string, t *string, v *string, stop *bool)) error,
+	iterateDESC func(keyPrefix string, limit int, block func(k *string, t *string, v *string, stop *bool)) error,
+	countAll func() (int64, string, string)) {
+
+	for _, k := range orderingKeys {
+		err := add(k, `"`+k+`"`)
+		g.Expect(err).To(BeNil())
+	}
+
+	list := []string{}
+	err := iterateASC(
+		"",
+		1000,
+		func(k *string, t *string, v *string, stop *bool) {
+			list = append(list, *k)
+		})
+	g.Expect(err).To(BeNil())
+	g.Expect(list).To(Equal(expectedOrdering(false)))
+
+	list = []string{}
+	err = iterateDESC(
+		maxKey,
+		1000,
+		func(k *string, t *string, v *string, stop *bool) {
+			list = append(list, *k)
+		})
+	g.Expect(err).To(BeNil())
+	g.Expect(list).To(Equal(expectedOrdering(true)))
+
+	// "a" sorts after "Z" and "A" in binary ordering
+	list = []string{}
+	err = iterateASC(
+		"a",
+		3,
+		func(k *string, t *string, v *string, stop *bool) {
+			list = append(list, *k)
+		})
+	g.Expect(err).To(BeNil())
+	g.Expect(list).To(Equal([]string{"a", "a b", "a-b"}))
+
+	count, min, max := countAll()
+	g.Expect(count).To(Equal(int64(len(orderingKeys))))
+	g.Expect(min).To(Equal(expectedOrdering(false)[0]))
+	g.Expect(max).To(Equal(expectedOrdering(true)[0]))
+}
+
+func TestSqliteKeyOrdering(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	os.RemoveAll("kv_test_ordering.db")
+	defer os.RemoveAll("kv_test_ordering.db")
+
+	s, err := gokvstore.NewStoreSqlite("kv_test_ordering", ".")
+	g.Expect(err).To(BeNil())
+	defer s.Close()
+
+	checkKeyOrdering(
+		g,
+		s.AddValueKV,
+		s.IterateByKeyPrefixASC,
+		s.IterateByKeyPrefixDESC,
+		s.CountAll)
+}
+
+func TestPQKeyOrdering(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	s, err := gokvstore.NewStorePostgresWithValueType(
+		"test_ordering",
+		"jsonb",
+		"host=localhost user=test password=test dbname=test sslmode=disable",
+		nil)
+	g.Expect(err).To(BeNil())
+	defer s.Close()
+
+	s.DeleteAll()
+	defer s.DeleteAll()
+
+	checkKeyOrdering(
+		g,
+		s.AddValueKV,
+		s.IterateByKeyPrefixASCEQ,
+		s.IterateByKeyPrefixDESCEQ,
+		s.CountAll)
+}
@@ -1,33 +1,64 @@
 package gokvstore
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
-	"log"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/korovkin/gotils"
-
-	// importing the pq module
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 // StorePostgres is a 'key value' store based on Postgres DB table
 type StorePostgres struct {
 	Db                   *sql.DB
 	Name                 string
+	TableName            string
 	InsertStmt           *sql.Stmt
+	InsertNewStmt        *sql.Stmt
 	GetStmt              *sql.Stmt
 	IterateStmt          *sql.Stmt
 	IterateAllStmt       *sql.Stmt
 	IterateByPrefixASCEQ *sql.Stmt
 	IterateByPrefixDSCEQ *sql.Stmt
+	IterateByRangeASC    *sql.Stmt
+	IterateByRangeDSC    *sql.Stmt
 	DeleteStmt           *sql.Stmt
 	DeleteStmtTag        *sql.Stmt
 	DeleteStmtTagLT      *sql.Stmt
+	DeleteTagRangeStmt   *sql.Stmt
 	DeleteAllStmt        *sql.Stmt
+	DeleteRangeStmt      *sql.Stmt
+	CountRangeStmt       *sql.Stmt
 	CountAllStmt         *sql.Stmt
+	IncrStmt             *sql.Stmt
+	SumRangeStmt         *sql.Stmt
+	LockStmt             *sql.Stmt
+	RenewLockStmt        *sql.Stmt
+	UnlockStmt           *sql.Stmt
+	EnqueueStmt          *sql.Stmt
+	DequeueStmt          *sql.Stmt
+	NackStmt             *sql.Stmt
+	AckStmt              *sql.Stmt
+	GenerationStmt       *sql.Stmt
+	DeleteOlderStmt      *sql.Stmt
+	KeysRangeStmt        *sql.Stmt
+	KeysTagStmt          *sql.Stmt
+	KeysTagLTStmt        *sql.Stmt
+	KeysTagRangeStmt     *sql.Stmt
+	KeysAllStmt          *sql.Stmt
+	quotedTable          string
+	schema               string
+	valueType            string
+	indexes              *indexes
+	retry                *retrier
+	logger               Logger
 }
 
 // NewStorePostgres allocates a new instance and connected to the store
@@ -37,61 +68,82 @@ func NewStorePostgres(name string, connection string, db *sql.DB) (*StorePostgre
 
 // NewStorePostgresWithValueType allocates a new instance and connected to the store
 func NewStorePostgresWithValueType(name string, valueType string, connection string, db *sql.DB) (*StorePostgres, error) {
+	return NewStorePostgresWithOptions(PostgresOptions{
+		Name:       name,
+		ValueType:  valueType,
+		Connection: connection,
+		Db:         db,
+	})
+}
+
+// NewStorePostgresWithOptions allocates a new instance configured by options and connected to the store
+func NewStorePostgresWithOptions(options PostgresOptions) (*StorePostgres, error) {
 	var err error
 	now := time.Now()
-	tableName := "kv_" + name
+	options = options.withDefaults()
+	err = options.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	// tableName identifies the table in the schema versions, quotedTable in the queries
+	name := options.Name
+	tableName := options.TableName
+	quotedTable := pq.QuoteIdentifier(options.TableName)
+	if options.Schema != "" {
+		tableName = options.Schema + "." + tableName
+		quotedTable = pq.QuoteIdentifier(options.Schema) + "." + quotedTable
+	}
 	defer func() {
-		log.Println("NewStorePostgres: table:", tableName, "dt:", time.Since(now))
+		options.Logger.Println("NewStorePostgres: table:", tableName, "dt:", time.Since(now))
 	}()
 	store := StorePostgres{}
 	store.Name = name
+	store.TableName = tableName
+	store.quotedTable = quotedTable
+	store.schema = options.Schema
+	store.valueType = options.ValueType
+	store.indexes = newIndexes()
+	store.retry = newRetrier(options.Retry)
+	store.logger = options.Logger
 
+	db := options.Db
 	if db == nil {
-		db, err = sql.Open("postgres", connection)
+		db, err = sql.Open("postgres", options.connection())
 		gotils.CheckFatal(err)
 	}
+	configurePool(db, options.MaxOpenConns, options.MaxIdleConns, options.ConnMaxLifetime)
 
 	store.Db = db
 
-	_, err = store.Db.Exec(fmt.Sprintf(
-		`CREATE TABLE IF NOT EXISTS %s 
-			(K text primary key, V %s, T text);`,
-		tableName,
-		valueType,
-	))
-	gotils.CheckFatal(err)
-
-	_, err = store.Db.Exec(
-		fmt.Sprintf(
-			`CREATE INDEX IF NOT EXISTS KV_K_%s 
-				ON %s (K, T);`,
-			name,
-			tableName,
-		))
-	gotils.CheckFatal(err)
+	err = migrate(store.Db, tableName, postgresMigrations(quotedTable, options), store.logger)
+	gotils.CheckNotFatal(err)
+	if err != nil {
+		return nil, err
+	}
 
-	_, err = store.Db.Exec(
+	store.InsertStmt, err = store.Db.Prepare(
 		fmt.Sprintf(
-			`CREATE INDEX IF NOT EXISTS KV_T_%s 
-			ON %s (T, K);`,
-			name,
-			tableName,
+			`INSERT INTO %s (K, V, T)
+				VALUES($1, $2, $3) 
+				ON CONFLICT (K) DO UPDATE SET V=$2, T=$3`,
+			quotedTable,
 		))
 	gotils.CheckFatal(err)
 
-	store.InsertStmt, err = store.Db.Prepare(
+	store.InsertNewStmt, err = store.Db.Prepare(
 		fmt.Sprintf(
 			`INSERT INTO %s (K, V, T)
 				VALUES($1, $2, $3) 
-				ON CONFLICT (K) DO UPDATE SET V=$2, T=$3`,
-			tableName,
+				ON CONFLICT (K) DO NOTHING`,
+			quotedTable,
 		))
 	gotils.CheckFatal(err)
 
 	store.GetStmt, err = store.Db.Prepare(
 		fmt.Sprintf(
 			`SELECT K, V, T FROM %s WHERE K=$1`,
-			tableName,
+			quotedTable,
 		))
 	gotils.CheckFatal(err)
 
@@ -99,10 +151,10 @@ func NewStorePostgresWithValueType(name string, valueType string, connection str
 		fmt.Sprintf(
 			`SELECT K, V, T 
 				FROM %s 
-				WHERE K<=$1 
-				ORDER BY K DESC 
+				WHERE K<=$1 COLLATE "C" 
+				ORDER BY K COLLATE "C" DESC 
 				LIMIT $2`,
-			tableName,
+			quotedTable,
 		))
 	gotils.CheckFatal(err)
 
@@ -110,8 +162,8 @@ func NewStorePostgresWithValueType(name string, valueType string, connection str
 		fmt.Sprintf(
 			`SELECT K, V, T 
 				FROM %s 
-				ORDER BY K`,
-			tableName,
+				ORDER BY K COLLATE "C"`,
+			quotedTable,
 		))
 	gotils.CheckFatal(err)
 
@@ -119,10 +171,10 @@ func NewStorePostgresWithValueType(name string, valueType string, connection str
 		fmt.Sprintf(
 			`SELECT K, V, T 
 				FROM %s 
-				WHERE K >= $1 
-				ORDER BY K ASC 
+				WHERE K >= $1 COLLATE "C" 
+				ORDER BY K COLLATE "C" ASC 
 				LIMIT $2`,
-			tableName,
+			quotedTable,
 		))
 	gotils.CheckFatal(err)
 
@@ -130,10 +182,34 @@ func NewStorePostgresWithValueType(name string, valueType string, connection str
 		fmt.Sprintf(
 			`SELECT K, V, T 
 				FROM %s
-				WHERE K <= $1
-				ORDER BY K DESC
+				WHERE K <= $1 COLLATE "C"
+				ORDER BY K COLLATE "C" DESC
 				LIMIT $2`,
-			tableName,
+			quotedTable,
+		))
+	gotils.CheckFatal(err)
+
+	store.IterateByRangeASC, err = store.Db.Prepare(
+		fmt.Sprintf(
+			`SELECT K, V, T 
+				FROM %s
+				WHERE K >= $1 COLLATE "C"
+				AND ($2 = '' OR K < $2 COLLATE "C")
+				ORDER BY K COLLATE "C" ASC
+				LIMIT $3`,
+			quotedTable,
+		))
+	gotils.CheckFatal(err)
+
+	store.IterateByRangeDSC, err = store.Db.Prepare(
+		fmt.Sprintf(
+			`SELECT K, V, T 
+				FROM %s
+				WHERE K >= $1 COLLATE "C"
+				AND ($2 = '' OR K < $2 COLLATE "C")
+				ORDER BY K COLLATE "C" DESC
+				LIMIT $3`,
+			quotedTable,
 		))
 	gotils.CheckFatal(err)
 
@@ -141,7 +217,7 @@ func NewStorePostgresWithValueType(name string, valueType string, connection str
 		fmt.Sprintf(
 			`DELETE FROM %s
 				WHERE K=$1`,
-			tableName,
+			quotedTable,
 		))
 	gotils.CheckFatal(err)
 
@@ -149,22 +225,53 @@ func NewStorePostgresWithValueType(name string, valueType string, connection str
 		fmt.Sprintf(
 			`DELETE FROM %s
 				WHERE T=$1`,
-			tableName,
+			quotedTable,
 		))
 	gotils.CheckFatal(err)
 
 	store.DeleteStmtTagLT, err = store.Db.Prepare(
 		fmt.Sprintf(
 			`DELETE FROM %s 
-				WHERE T<$1`,
-			tableName,
+				WHERE T < $1 COLLATE "C" 
+				AND left(K, 1) <> chr(1)`,
+			quotedTable,
+		))
+	gotils.CheckFatal(err)
+
+	store.DeleteTagRangeStmt, err = store.Db.Prepare(
+		fmt.Sprintf(
+			`DELETE FROM %s 
+				WHERE T >= $1 COLLATE "C" 
+				AND ($2 = '' OR T < $2 COLLATE "C") 
+				AND left(K, 1) <> chr(1)`,
+			quotedTable,
 		))
 	gotils.CheckFatal(err)
 
 	store.DeleteAllStmt, err = store.Db.Prepare(
 		fmt.Sprintf(
 			`DELETE FROM %s WHERE True`,
-			tableName,
+			quotedTable,
+		))
+	gotils.CheckFatal(err)
+
+	store.DeleteRangeStmt, err = store.Db.Prepare(
+		fmt.Sprintf(
+			`DELETE FROM %s
+				WHERE K >= $1 COLLATE "C"
+				AND ($2 = '' OR K < $2 COLLATE "C")
+				AND ($3::boolean OR left(K, 1) <> chr(1))`,
+			quotedTable,
+		))
+	gotils.CheckFatal(err)
+
+	store.CountRangeStmt, err = store.Db.Prepare(
+		fmt.Sprintf(
+			`SELECT COUNT(*) FROM %s
+				WHERE K >= $1 COLLATE "C"
+				AND ($2 = '' OR K < $2 COLLATE "C")
+				AND left(K, 1) <> chr(1)`,
+			quotedTable,
 		))
 	gotils.CheckFatal(err)
 
@@ -172,72 +279,497 @@ func NewStorePostgresWithValueType(name string, valueType string, connection str
 		fmt.Sprintf(
 			`SELECT 
 					COUNT(K)
-					, MIN(K)
-					, MAX(K) 
+					, MIN(K COLLATE "C")
+					, MAX(K COLLATE "C") 
 				FROM %s`,
-			tableName,
+			quotedTable,
+		))
+	gotils.CheckFatal(err)
+
+	// counters are JSON numbers or, in text columns, plain decimals
+	number := func(v string) string {
+		if options.ValueType == "text" {
+			return v
+		}
+		return "(" + v + " #>> '{}')"
+	}
+	value := map[string]string{
+		"jsonb": "to_jsonb(%s)",
+		"json":  "to_json(%s)",
+		"text":  "(%s)::text",
+	}[options.ValueType]
+	// a JSON string of digits is not a counter
+	isNumber := map[string]string{
+		"jsonb": "jsonb_typeof(kv.V) = 'number' AND ",
+		"json":  "json_typeof(kv.V) = 'number' AND ",
+		"text":  "",
+	}[options.ValueType]
+
+	store.IncrStmt, err = store.Db.Prepare(
+		fmt.Sprintf(
+			`INSERT INTO %[1]s AS kv (K, V, T)
+				VALUES($1, %[2]s, '') 
+				ON CONFLICT (K) DO UPDATE 
+				SET V = %[3]s 
+				WHERE %[6]s%[4]s ~ '^-?[0-9]+$'
+				RETURNING %[5]s::bigint`,
+			quotedTable,
+			fmt.Sprintf(value, "$2::bigint"),
+			fmt.Sprintf(value, number("kv.V")+"::bigint + $2::bigint"),
+			number("kv.V"),
+			number("kv.V"),
+			isNumber,
+		))
+	gotils.CheckFatal(err)
+
+	store.SumRangeStmt, err = store.Db.Prepare(
+		fmt.Sprintf(
+			`SELECT COALESCE(SUM(%s::bigint), 0)::bigint 
+				FROM %s 
+				WHERE K >= $1 COLLATE "C" 
+				AND K < $2 COLLATE "C"`,
+			number("V"),
+			quotedTable,
+		))
+	gotils.CheckFatal(err)
+
+	// locks expire with the db clock, in unix nanoseconds padded to compare as text
+	dbNow := `((extract(epoch from clock_timestamp()) * 1000000)::bigint * 1000)`
+	store.LockStmt, err = store.Db.Prepare(
+		fmt.Sprintf(
+			`INSERT INTO %[1]s AS kv (K, V, T)
+				VALUES($1, $2, lpad((%[2]s + $3::bigint)::text, 20, '0')) 
+				ON CONFLICT (K) DO UPDATE 
+				SET V = EXCLUDED.V, T = EXCLUDED.T 
+				WHERE kv.T COLLATE "C" < lpad(%[2]s::text, 20, '0')
+				RETURNING T`,
+			quotedTable,
+			dbNow,
+		))
+	gotils.CheckFatal(err)
+
+	store.RenewLockStmt, err = store.Db.Prepare(
+		fmt.Sprintf(
+			`UPDATE %[1]s 
+				SET T = lpad((%[2]s + $3::bigint)::text, 20, '0') 
+				WHERE K = $1 
+				AND V::text = $2 
+				AND T COLLATE "C" >= lpad(%[2]s::text, 20, '0') 
+				RETURNING T`,
+			quotedTable,
+			dbNow,
+		))
+	gotils.CheckFatal(err)
+
+	store.UnlockStmt, err = store.Db.Prepare(
+		fmt.Sprintf(
+			`DELETE FROM %s 
+				WHERE K = $1 
+				AND V::text = $2`,
+			quotedTable,
+		))
+	gotils.CheckFatal(err)
+
+	// the tag of a message is its receipt: when it's visible and its deliveries
+	store.EnqueueStmt, err = store.Db.Prepare(
+		fmt.Sprintf(
+			`INSERT INTO %[1]s (K, V, T) 
+				VALUES($1, $2, lpad((%[2]s + $3::bigint)::text, 20, '0') || '.0')`,
+			quotedTable,
+			dbNow,
+		))
+	gotils.CheckFatal(err)
+
+	// concurrent consumers skip the messages locked by each other
+	store.DequeueStmt, err = store.Db.Prepare(
+		fmt.Sprintf(
+			`UPDATE %[1]s 
+				SET T = lpad((%[2]s + $3::bigint)::text, 20, '0') || '.' || (substr(T, 22)::int + 1) 
+				WHERE K = (
+					SELECT K 
+					FROM %[1]s 
+					WHERE K >= $1 COLLATE "C" 
+					AND K < $2 COLLATE "C" 
+					AND substr(T, 1, 20) COLLATE "C" <= lpad(%[2]s::text, 20, '0') 
+					ORDER BY T COLLATE "C", K COLLATE "C" 
+					LIMIT 1 
+					FOR UPDATE SKIP LOCKED) 
+				RETURNING K, V, T`,
+			quotedTable,
+			dbNow,
+		))
+	gotils.CheckFatal(err)
+
+	store.NackStmt, err = store.Db.Prepare(
+		fmt.Sprintf(
+			`UPDATE %[1]s 
+				SET T = lpad((%[2]s + $3::bigint)::text, 20, '0') || '.' || substr(T, 22) 
+				WHERE K = $1 
+				AND T = $2 
+				RETURNING T`,
+			quotedTable,
+			dbNow,
+		))
+	gotils.CheckFatal(err)
+
+	store.AckStmt, err = store.Db.Prepare(
+		fmt.Sprintf(
+			`DELETE FROM %s 
+				WHERE K = $1 
+				AND T = $2`,
+			quotedTable,
+		))
+	gotils.CheckFatal(err)
+
+	// generations are the tags of the keys outside of buckets, locks and queues
+	store.GenerationStmt, err = store.Db.Prepare(
+		fmt.Sprintf(
+			`SELECT DISTINCT T COLLATE "C" 
+				FROM %s 
+				WHERE T <> '' 
+				AND left(K, 1) <> chr(1) 
+				ORDER BY 1 DESC 
+				LIMIT 1 OFFSET $1`,
+			quotedTable,
+		))
+	gotils.CheckFatal(err)
+
+	store.DeleteOlderStmt, err = store.Db.Prepare(
+		fmt.Sprintf(
+			`DELETE FROM %s 
+				WHERE T <> '' 
+				AND T < $1 COLLATE "C" 
+				AND left(K, 1) <> chr(1)`,
+			quotedTable,
+		))
+	gotils.CheckFatal(err)
+
+	// the keys of the deletes of a dry run
+	store.KeysRangeStmt, err = store.Db.Prepare(
+		fmt.Sprintf(
+			`SELECT K FROM %s
+				WHERE K >= $1 COLLATE "C"
+				AND ($2 = '' OR K < $2 COLLATE "C")
+				AND ($3::boolean OR left(K, 1) <> chr(1))
+				ORDER BY K COLLATE "C" ASC`,
+			quotedTable,
+		))
+	gotils.CheckFatal(err)
+
+	store.KeysTagStmt, err = store.Db.Prepare(
+		fmt.Sprintf(
+			`SELECT K FROM %s
+				WHERE T=$1
+				ORDER BY K COLLATE "C" ASC`,
+			quotedTable,
+		))
+	gotils.CheckFatal(err)
+
+	store.KeysTagLTStmt, err = store.Db.Prepare(
+		fmt.Sprintf(
+			`SELECT K FROM %s 
+				WHERE T < $1 COLLATE "C" 
+				AND left(K, 1) <> chr(1)
+				ORDER BY K COLLATE "C" ASC`,
+			quotedTable,
 		))
 	gotils.CheckFatal(err)
 
+	store.KeysTagRangeStmt, err = store.Db.Prepare(
+		fmt.Sprintf(
+			`SELECT K FROM %s 
+				WHERE T >= $1 COLLATE "C" 
+				AND ($2 = '' OR T < $2 COLLATE "C") 
+				AND left(K, 1) <> chr(1)
+				ORDER BY K COLLATE "C" ASC`,
+			quotedTable,
+		))
+	gotils.CheckFatal(err)
+
+	store.KeysAllStmt, err = store.Db.Prepare(
+		fmt.Sprintf(
+			`SELECT K FROM %s
+				ORDER BY K COLLATE "C" ASC`,
+			quotedTable,
+		))
+	gotils.CheckFatal(err)
+
+	for _, index := range options.Indexes {
+		err = store.CreateIndex(index)
+		if err != nil {
+			store.Close()
+			return nil, err
+		}
+	}
+
+	if options.Search {
+		err = store.EnableSearch()
+		if err != nil {
+			store.Close()
+			return nil, err
+		}
+	}
+
 	return &store, err
 }
 
+// postgresMigrations the schema versions of a postgres store table,
+// tableName is quoted and schema qualified
+func postgresMigrations(tableName string, options PostgresOptions) []migration {
+	// index names are unqualified, they live in the schema of their table
+	keyIndex := postgresIndexPrefix + options.Name
+	tagIndex := "kv_t_" + options.Name
+
+	qualify := func(name string) string {
+		if options.Schema == "" {
+			return pq.QuoteIdentifier(name)
+		}
+		return pq.QuoteIdentifier(options.Schema) + "." + pq.QuoteIdentifier(name)
+	}
+
+	// tables created before the names were quoted had their names folded to lower case,
+	// give them (and their indexes) their quoted names
+	adoptLegacyTable := func(tx *sql.Tx) error {
+		legacyTable := strings.ToLower(options.TableName)
+		if legacyTable == options.TableName ||
+			!postgresPlainIdentifier(options.TableName) ||
+			(options.Schema != "" && !(postgresPlainIdentifier(options.Schema) &&
+				strings.ToLower(options.Schema) == options.Schema)) {
+			return nil
+		}
+
+		var exists, legacyExists bool
+		err := tx.QueryRow(
+			`SELECT to_regclass($1) IS NOT NULL, to_regclass($2) IS NOT NULL`,
+			tableName,
+			qualify(legacyTable),
+		).Scan(&exists, &legacyExists)
+		if err != nil || exists || !legacyExists {
+			return err
+		}
+
+		_, err = tx.Exec(fmt.Sprintf(
+			`ALTER TABLE %s RENAME TO %s;`,
+			qualify(legacyTable),
+			pq.QuoteIdentifier(options.TableName),
+		))
+		if err != nil || !postgresPlainIdentifier(options.Name) {
+			return err
+		}
+
+		for _, index := range []string{keyIndex, tagIndex} {
+			if strings.ToLower(index) == index {
+				continue
+			}
+			_, err = tx.Exec(fmt.Sprintf(
+				`ALTER INDEX IF EXISTS %s RENAME TO %s;`,
+				qualify(strings.ToLower(index)),
+				pq.QuoteIdentifier(index),
+			))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	return []migration{
+		{
+			version:     1,
+			description: "create the table",
+			up: func(tx *sql.Tx) error {
+				if options.Schema != "" {
+					_, err := tx.Exec(fmt.Sprintf(
+						`CREATE SCHEMA IF NOT EXISTS %s;`,
+						pq.QuoteIdentifier(options.Schema),
+					))
+					if err != nil {
+						return err
+					}
+				}
+
+				err := adoptLegacyTable(tx)
+				if err != nil {
+					return err
+				}
+
+				_, err = tx.Exec(fmt.Sprintf(
+					`CREATE TABLE IF NOT EXISTS %s 
+						(K text COLLATE "C" primary key, V %s, T text COLLATE "C");`,
+					tableName,
+					options.ValueType,
+				))
+				if err != nil {
+					return err
+				}
+
+				_, err = tx.Exec(
+					fmt.Sprintf(
+						`CREATE INDEX IF NOT EXISTS %s 
+							ON %s (K, T);`,
+						pq.QuoteIdentifier(keyIndex),
+						tableName,
+					))
+				if err != nil || options.NoTagIndex {
+					return err
+				}
+
+				_, err = tx.Exec(
+					fmt.Sprintf(
+						`CREATE INDEX IF NOT EXISTS %s 
+						ON %s (T, K);`,
+						pq.QuoteIdentifier(tagIndex),
+						tableName,
+					))
+				return err
+			},
+		},
+		{
+			version:     2,
+			description: "binary key collation for tables created with the default collation",
+			up: func(tx *sql.Tx) error {
+				_, err := tx.Exec(fmt.Sprintf(
+					`ALTER TABLE %s 
+						ALTER COLUMN K TYPE text COLLATE "C";`,
+					tableName,
+				))
+				return err
+			},
+		},
+		{
+			version:     3,
+			description: "quoted names for tables created with unquoted mixed case names",
+			up:          adoptLegacyTable,
+		},
+		{
+			// the tag deletes compare the tags with COLLATE "C",
+			// the (T, K) index serves them only in the same collation
+			version:     4,
+			description: "binary tag collation for tables created with the default collation",
+			up: func(tx *sql.Tx) error {
+				_, err := tx.Exec(fmt.Sprintf(
+					`ALTER TABLE %s 
+						ALTER COLUMN T TYPE text COLLATE "C";`,
+					tableName,
+				))
+				return err
+			},
+		},
+	}
+}
+
+// postgresPlainIdentifier can name be used without quotes (up to case folding)
+func postgresPlainIdentifier(name string) bool {
+	return postgresPlainIdentifierRegexp.MatchString(name)
+}
+
+var postgresPlainIdentifierRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_$]*$`)
+
+// SchemaVersion get the schema version of the store table
+func (s *StorePostgres) SchemaVersion() (int, error) {
+	return schemaVersion(s.Db, s.TableName)
+}
+
 // Close the connection to the store
 func (s *StorePostgres) Close() {
 	s.InsertStmt.Close()
+	s.InsertNewStmt.Close()
 	s.GetStmt.Close()
 	s.IterateStmt.Close()
 	s.IterateByPrefixASCEQ.Close()
 	s.IterateByPrefixDSCEQ.Close()
+	s.IterateByRangeASC.Close()
+	s.IterateByRangeDSC.Close()
 	s.DeleteStmt.Close()
 	s.DeleteStmtTag.Close()
 	s.DeleteStmtTagLT.Close()
+	s.DeleteTagRangeStmt.Close()
 	s.DeleteAllStmt.Close()
+	s.DeleteRangeStmt.Close()
+	s.CountRangeStmt.Close()
 	s.CountAllStmt.Close()
+	s.IncrStmt.Close()
+	s.SumRangeStmt.Close()
+	s.LockStmt.Close()
+	s.RenewLockStmt.Close()
+	s.UnlockStmt.Close()
+	s.EnqueueStmt.Close()
+	s.DequeueStmt.Close()
+	s.NackStmt.Close()
+	s.AckStmt.Close()
+	s.GenerationStmt.Close()
+	s.DeleteOlderStmt.Close()
+	s.KeysRangeStmt.Close()
+	s.KeysTagStmt.Close()
+	s.KeysTagLTStmt.Close()
+	s.KeysTagRangeStmt.Close()
+	s.KeysAllStmt.Close()
+	s.indexes.close()
 	s.Db.Close()
 	s.Db = nil
 }
 
 // AddValueKVT add a (K,V,T) entry to the store
 func (s *StorePostgres) AddValueKVT(k string, v string, t string) error {
-	_, err := s.InsertStmt.Exec(k, v, t)
-	gotils.CheckNotFatal(err)
-	return err
+	return s.retry.exec(s.InsertStmt, k, v, t)
 }
 
 // AddValueKV add a (K, V) entry to the store
 func (s *StorePostgres) AddValueKV(k string, v string) error {
-	_, err := s.InsertStmt.Exec(k, v, "")
-	gotils.CheckNotFatal(err)
-	return err
+	return s.retry.exec(s.InsertStmt, k, v, "")
 }
 
-// DeleteValue deletes the given k from the store
-func (s *StorePostgres) DeleteValue(k string) error {
-	_, err := s.DeleteStmt.Exec(k)
-	gotils.CheckNotFatal(err)
-	return err
+// DeleteValue deletes the given k from the store, get the number of deleted keys (0 or 1)
+func (s *StorePostgres) DeleteValue(k string) (int64, error) {
+	return s.kv().deleteValue(k)
 }
 
-// DeleteAllWithTag delete all entries from the store with with the given tag t
-func (s *StorePostgres) DeleteAllWithTag(t string) error {
-	_, err := s.DeleteStmtTag.Exec(t)
-	gotils.CheckNotFatal(err)
-	return err
+// DeleteAllWithTag delete all entries from the store with with the given tag t,
+// get the number of deleted keys
+func (s *StorePostgres) DeleteAllWithTag(t string) (int64, error) {
+	return s.kv().execCount(s.DeleteStmtTag, t)
 }
 
-// DeleteWhereTagLT delete all entries with tag less than t
-func (s *StorePostgres) DeleteWhereTagLT(t string) error {
-	_, err := s.DeleteStmtTagLT.Exec(t)
-	gotils.CheckNotFatal(err)
-	return err
+// DeleteWhereTagLT delete all entries with tag less than t (byte by byte),
+// the keys of buckets, locks and queues are kept. Get the number of deleted keys
+func (s *StorePostgres) DeleteWhereTagLT(t string) (int64, error) {
+	return s.kv().execCount(s.DeleteStmtTagLT, t)
 }
 
-// DeleteAll delete all items from the store
-func (s *StorePostgres) DeleteAll() error {
-	_, err := s.DeleteAllStmt.Exec()
-	gotils.CheckNotFatal(err)
-	return err
+// DeleteTagRange delete all entries with begin <= tag < end (byte by byte),
+// an empty end means no upper bound. The keys of buckets, locks and queues are kept.
+// Get the number of deleted keys
+func (s *StorePostgres) DeleteTagRange(begin string, end string) (int64, error) {
+	return s.kv().execCount(s.DeleteTagRangeStmt, begin, end)
+}
+
+// DeleteAll delete all items from the store, get the number of deleted keys
+func (s *StorePostgres) DeleteAll() (int64, error) {
+	return s.kv().execCount(s.DeleteAllStmt)
+}
+
+// DeletePrefix delete the keys that start with prefix in a single statement,
+// the keys of buckets, locks and queues are kept. Get the number of deleted keys
+func (s *StorePostgres) DeletePrefix(prefix string) (int64, error) {
+	return s.kv().deleteRange(prefix, prefixEnd(prefix))
+}
+
+// DeleteRange delete the keys with begin <= key < end in a single statement,
+// an empty end means no upper bound. The keys of buckets, locks and queues are kept.
+// Get the number of deleted keys
+func (s *StorePostgres) DeleteRange(begin string, end string) (int64, error) {
+	return s.kv().deleteRange(begin, end)
+}
+
+// CountPrefix count the keys that start with prefix, but the keys of buckets, locks and queues
+func (s *StorePostgres) CountPrefix(prefix string) (int64, error) {
+	return s.kv().countRange(prefix, prefixEnd(prefix))
+}
+
+// CountRange count the keys with begin <= key < end, an empty end means no upper bound.
+// The keys of buckets, locks and queues are not counted
+func (s *StorePostgres) CountRange(begin string, end string) (int64, error) {
+	return s.kv().countRange(begin, end)
 }
 
 // AddValueAsJSON store o under (k, t)
@@ -246,9 +778,7 @@ func (s *StorePostgres) AddValueAsJSON(k string, t string, o interface{}) error
 	gotils.CheckNotFatal(err)
 
 	if err == nil {
-		_, err = s.InsertStmt.Exec(k, b, t)
-		gotils.CheckNotFatal(err)
-		return err
+		return s.retry.exec(s.InsertStmt, k, b, t)
 	}
 
 	return err
@@ -377,6 +907,152 @@ func (s *StorePostgres) IterateByKeyPrefixDESCEQ(
 	return err
 }
 
+// IterateByKeyRangeASC traverse the stored items with begin <= key < end (ascending),
+// an empty end means no upper bound
+func (s *StorePostgres) IterateByKeyRangeASC(
+	begin string,
+	end string,
+	limit int,
+	block func(k *string, t *string, v *string, stop *bool)) error {
+	return s.iterateByKeyRange(s.IterateByRangeASC, begin, end, limit, block)
+}
+
+// IterateByKeyRangeDESC traverse the stored items with begin <= key < end (descending),
+// an empty end means no upper bound
+func (s *StorePostgres) IterateByKeyRangeDESC(
+	begin string,
+	end string,
+	limit int,
+	block func(k *string, t *string, v *string, stop *bool)) error {
+	return s.iterateByKeyRange(s.IterateByRangeDSC, begin, end, limit, block)
+}
+
+// GetFields get the JSON object with the fields paths of the value of k, extracted by
+// the database: {"name": "ann", "address.city": "Paris"}. Missing fields are null.
+// nil if k is not in the store
+func (s *StorePostgres) GetFields(k string, paths ...string) (*string, error) {
+	d, err := s.queryDialect()
+	if err != nil {
+		return nil, err
+	}
+	fields, err := projectFields(paths, d)
+	if err != nil {
+		return nil, err
+	}
+
+	var v string
+	err = s.Db.QueryRow(
+		fmt.Sprintf(
+			`SELECT %s FROM %s WHERE K = $1`,
+			fields,
+			s.quotedTable,
+		),
+		k,
+	).Scan(&v)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	gotils.CheckNotFatal(err)
+	if err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// IterateFieldsByKeyRangeASC traverse the items with begin <= key < end in ASC order,
+// v is the JSON object with the fields paths of the value (see GetFields)
+func (s *StorePostgres) IterateFieldsByKeyRangeASC(
+	begin string,
+	end string,
+	limit int,
+	paths []string,
+	block func(k *string, t *string, v *string, stop *bool)) error {
+	return s.iterateFieldsByKeyRange("ASC", begin, end, limit, paths, block)
+}
+
+// IterateFieldsByKeyRangeDESC traverse the items with begin <= key < end in DESC order,
+// v is the JSON object with the fields paths of the value (see GetFields)
+func (s *StorePostgres) IterateFieldsByKeyRangeDESC(
+	begin string,
+	end string,
+	limit int,
+	paths []string,
+	block func(k *string, t *string, v *string, stop *bool)) error {
+	return s.iterateFieldsByKeyRange("DESC", begin, end, limit, paths, block)
+}
+
+func (s *StorePostgres) iterateFieldsByKeyRange(
+	direction string,
+	begin string,
+	end string,
+	limit int,
+	paths []string,
+	block func(k *string, t *string, v *string, stop *bool)) error {
+	d, err := s.queryDialect()
+	if err != nil {
+		return err
+	}
+	fields, err := projectFields(paths, d)
+	if err != nil {
+		return err
+	}
+
+	stmt, err := s.Db.Prepare(
+		fmt.Sprintf(
+			`SELECT K, %s, T 
+				FROM %s
+				WHERE K >= $1 COLLATE "C"
+				AND ($2 = '' OR K < $2 COLLATE "C")
+				ORDER BY K COLLATE "C" %s
+				LIMIT $3`,
+			fields,
+			s.quotedTable,
+			direction,
+		))
+	gotils.CheckNotFatal(err)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	return s.iterateByKeyRange(stmt, begin, end, limit, block)
+}
+
+func (s *StorePostgres) iterateByKeyRange(
+	stmt *sql.Stmt,
+	begin string,
+	end string,
+	limit int,
+	block func(k *string, t *string, v *string, stop *bool)) error {
+	var err error
+	var res *sql.Rows
+
+	res, err = stmt.Query(begin, end, limit)
+	gotils.CheckNotFatal(err)
+
+	if err != nil {
+		return err
+	}
+
+	defer res.Close()
+	stop := false
+	for res.Next() && false == stop {
+		var k string
+		var v string
+		var t string
+		err = res.Scan(&k, &v, &t)
+		gotils.CheckNotFatal(err)
+
+		if err != nil {
+			break
+		}
+
+		block(&k, &t, &v, &stop)
+	}
+
+	return err
+}
+
 // IterateAll traverse all the stored items
 func (s *StorePostgres) IterateAll(
 	o interface{},
@@ -434,3 +1110,616 @@ func (s *StorePostgres) GetValue(k string) *string {
 	}
 	return nil
 }
+
+func (s *StorePostgres) kv() kv {
+	return kv{stmts: &kvStmts{
+		insert:          s.InsertStmt,
+		insertNew:       s.InsertNewStmt,
+		get:             s.GetStmt,
+		delete:          s.DeleteStmt,
+		deleteRange:     s.DeleteRangeStmt,
+		deleteTag:       s.DeleteStmtTag,
+		deleteTagLT:     s.DeleteStmtTagLT,
+		deleteTagRange:  s.DeleteTagRangeStmt,
+		deleteAll:       s.DeleteAllStmt,
+		countRange:      s.CountRangeStmt,
+		iterateRangeASC: s.IterateByRangeASC,
+		iterateRangeDSC: s.IterateByRangeDSC,
+		incr:            s.IncrStmt,
+		sumRange:        s.SumRangeStmt,
+		lockAcquire:     s.LockStmt,
+		lockRenew:       s.RenewLockStmt,
+		lockRelease:     s.UnlockStmt,
+		queueEnqueue:    s.EnqueueStmt,
+		queueDequeue:    s.DequeueStmt,
+		queueNack:       s.NackStmt,
+		queueAck:        s.AckStmt,
+		generation:      s.GenerationStmt,
+		deleteOlder:     s.DeleteOlderStmt,
+		keysRange:       s.KeysRangeStmt,
+		keysTag:         s.KeysTagStmt,
+		keysTagLT:       s.KeysTagLTStmt,
+		keysTagRange:    s.KeysTagRangeStmt,
+		keysAll:         s.KeysAllStmt,
+	}, retry: s.retry}
+}
+
+// Update run block under a new transaction, the transaction is committed
+// if block returns nil and rolled back otherwise.
+// block is run again when the transaction fails with a serialization failure
+// or a deadlock (see Retry)
+func (s *StorePostgres) Update(block func(tx *Tx) error) error {
+	return update(s.Db, s.kv().stmts, s.retry, block)
+}
+
+// DryRun run block like Update but always roll back its transaction: the deletes
+// of block get the number of keys they would delete, nothing is deleted.
+// Get the keys the deletes of tx would delete, in the order of the deletes
+func (s *StorePostgres) DryRun(block func(tx *Tx) error) ([]string, error) {
+	return dryRun(s.Db, s.kv().stmts, s.retry, block)
+}
+
+// RetryStats get the retry counters of the store
+func (s *StorePostgres) RetryStats() RetryStats {
+	return s.retry.stats()
+}
+
+// InTx get a handle to the transaction tx for this store, tx must be
+// a transaction on another store sharing the same db
+func (s *StorePostgres) InTx(tx *Tx) (*Tx, error) {
+	return tx.in(s.Db, s.kv().stmts)
+}
+
+// Bucket get a handle to the bucket name
+func (s *StorePostgres) Bucket(name string) *Bucket {
+	return newBucket(s.kv(), name)
+}
+
+// CreateBucket register the bucket name, creating an existing bucket is a no-op
+func (s *StorePostgres) CreateBucket(name string) (*Bucket, error) {
+	return createBucket(s.kv(), name)
+}
+
+// DropBucket delete all the data of the bucket name and unregister it
+func (s *StorePostgres) DropBucket(name string) error {
+	return s.Update(func(tx *Tx) error {
+		return tx.DropBucket(name)
+	})
+}
+
+// BulkLoad stream all the entries of it into a staging table with COPY and merge them
+// into the store (replacing existing keys, the last duplicate wins) in a single transaction,
+// progress (when not nil) is called with the number of entries streamed so far.
+// Nothing is written if it fails or ctx is done
+func (s *StorePostgres) BulkLoad(
+	ctx context.Context,
+	it EntryIterator,
+	progress func(loaded int64)) (int64, error) {
+	tx, err := s.Db.BeginTx(ctx, nil)
+	gotils.CheckNotFatal(err)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	loaded, err := s.bulkLoad(ctx, tx, it, progress)
+	// a load committed before ctx is done is reported as loaded
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	gotils.CheckNotFatal(err)
+	if err != nil {
+		return 0, err
+	}
+	return loaded, nil
+}
+
+func (s *StorePostgres) bulkLoad(
+	ctx context.Context,
+	tx *sql.Tx,
+	it EntryIterator,
+	progress func(loaded int64)) (int64, error) {
+	// seq orders the duplicates
+	_, err := tx.ExecContext(ctx,
+		`CREATE TEMP TABLE gokvstore_bulk 
+			(seq bigserial, K text, V text, T text) 
+			ON COMMIT DROP`)
+	if err != nil {
+		return 0, err
+	}
+
+	stmt, err := tx.PrepareContext(ctx, pq.CopyIn("gokvstore_bulk", "k", "v", "t"))
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	loaded, err := loadEntries(ctx, it, progress, func(e Entry) error {
+		_, err := stmt.Exec(e.Key, e.Value, e.Tag)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// flush the COPY
+	_, err = stmt.Exec()
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.ExecContext(ctx, fmt.Sprintf(
+		`INSERT INTO %s (K, V, T)
+			SELECT DISTINCT ON (K) K, CAST(V AS %s), T 
+			FROM gokvstore_bulk 
+			ORDER BY K, seq DESC
+			ON CONFLICT (K) DO UPDATE SET V = EXCLUDED.V, T = EXCLUDED.T`,
+		s.quotedTable,
+		s.valueType,
+	))
+	return loaded, err
+}
+
+// Patch atomically apply a JSON patch (RFC 6902) or a JSON merge patch (RFC 7386) to the
+// value of k, get the new value, nil if k is not in the store (see ErrPatchFailed)
+func (s *StorePostgres) Patch(k string, patch string) (*string, error) {
+	doc := "V"
+	if s.valueType != "jsonb" {
+		doc = "V::jsonb"
+	}
+
+	args := []interface{}{k}
+	expression, conditions, err := compilePatch(patch, doc, postgresQuery{}, &args)
+	if err != nil {
+		return nil, err
+	}
+	conditions = append([]string{"K = $1"}, conditions...)
+
+	query := fmt.Sprintf(
+		`UPDATE %s 
+			SET V = (%s)::%s 
+			WHERE %s 
+			RETURNING V`,
+		s.quotedTable,
+		expression,
+		s.valueType,
+		strings.Join(conditions, " AND "),
+	)
+
+	var v string
+	err = s.retry.do(func() error {
+		return s.Db.QueryRow(query, args...).Scan(&v)
+	})
+	if err == sql.ErrNoRows {
+		if s.GetValue(k) == nil {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("%w: %q", ErrPatchFailed, k)
+	}
+	gotils.CheckNotFatal(err)
+	if err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// Incr atomically add delta to the counter k (a missing k counts from 0), get the new value
+func (s *StorePostgres) Incr(k string, delta int64) (int64, error) {
+	return s.kv().incr(k, delta)
+}
+
+// Decr atomically subtract delta from the counter k (a missing k counts from 0), get the new value
+func (s *StorePostgres) Decr(k string, delta int64) (int64, error) {
+	return s.kv().incr(k, -delta)
+}
+
+// ShardedCounter get the counter k spread over shards rows
+func (s *StorePostgres) ShardedCounter(k string, shards int) *ShardedCounter {
+	return newShardedCounter(s.kv(), k, shards)
+}
+
+// Lock take the lock name for ttl, waiting for it until ctx is done.
+// The holder should Renew it before it expires and Unlock it when done
+func (s *StorePostgres) Lock(ctx context.Context, name string, ttl time.Duration) (*Lock, error) {
+	return lock(ctx, s.kv(), name, ttl)
+}
+
+// TryLock take the lock name for ttl, fails with ErrLockHeld if it's held by another owner
+func (s *StorePostgres) TryLock(name string, ttl time.Duration) (*Lock, error) {
+	return tryLock(s.kv(), name, ttl)
+}
+
+// Queue get a handle to the work queue name, the zero fields of options are taken from DefaultQueueOptions
+func (s *StorePostgres) Queue(name string, options QueueOptions) *Queue {
+	return newQueue(s.kv(), s.Update, name, options)
+}
+
+// Retention get a retention of the generations (the tags) of the store, see RetentionPolicy
+func (s *StorePostgres) Retention(policy RetentionPolicy) (*Retention, error) {
+	return newRetention(s.Update, s.DryRun, s.logger, policy)
+}
+
+// indexName the name of the secondary index name, it's unqualified
+// (indexes live in the schema of their table), and qualified
+func (s *StorePostgres) indexName(name string) (string, string, error) {
+	index := "kv_i_" + s.Name + "_" + name
+	err := validatePostgresIdentifier("index", index, postgresMaxIdentifier)
+	if err != nil {
+		return "", "", err
+	}
+	if s.schema == "" {
+		return pq.QuoteIdentifier(index), pq.QuoteIdentifier(index), nil
+	}
+	return pq.QuoteIdentifier(index), pq.QuoteIdentifier(s.schema) + "." + pq.QuoteIdentifier(index), nil
+}
+
+// CreateIndex create the secondary index on a JSON field of the values if it's missing.
+// Creating a unique index fails if two keys already have the same field
+func (s *StorePostgres) CreateIndex(index Index) error {
+	err := index.validate()
+	if err != nil {
+		return err
+	}
+	if s.valueType == "text" {
+		return fmt.Errorf("%w: indexes need json or jsonb values", ErrInvalidValueType)
+	}
+	name, _, err := s.indexName(index.Name)
+	if err != nil {
+		return err
+	}
+
+	unique := ""
+	if index.Unique {
+		unique = "UNIQUE"
+	}
+	expression := fmt.Sprintf(`(V #>> '{%s}')`, strings.Replace(index.Path, ".", ",", -1))
+	_, err = s.Db.Exec(fmt.Sprintf(
+		`CREATE %s INDEX IF NOT EXISTS %s 
+			ON %s (%s)`,
+		unique,
+		name,
+		s.quotedTable,
+		expression,
+	))
+	gotils.CheckNotFatal(err)
+	if err != nil {
+		return err
+	}
+
+	stmt, err := s.Db.Prepare(fmt.Sprintf(
+		`SELECT K, V, T 
+			FROM %s 
+			WHERE %s = $1 
+			AND left(K, 1) <> chr(1) 
+			ORDER BY K COLLATE "C"`,
+		s.quotedTable,
+		expression,
+	))
+	gotils.CheckNotFatal(err)
+	if err != nil {
+		return err
+	}
+	s.indexes.add(index.Name, stmt)
+	return nil
+}
+
+// DropIndex drop the secondary index name
+func (s *StorePostgres) DropIndex(name string) error {
+	err := Index{Name: name, Path: name}.validate()
+	if err != nil {
+		return err
+	}
+	_, qualified, err := s.indexName(name)
+	if err != nil {
+		return err
+	}
+
+	s.indexes.remove(name)
+	_, err = s.Db.Exec(fmt.Sprintf(`DROP INDEX IF EXISTS %s`, qualified))
+	gotils.CheckNotFatal(err)
+	return err
+}
+
+// FindBy get the entries whose field of the index name is value, in key order.
+// The keys of buckets, locks and queues are skipped
+func (s *StorePostgres) FindBy(name string, value string) ([]Entry, error) {
+	return s.indexes.findBy(name, value)
+}
+
+// EnableSearch create the full text index of the values if it's missing:
+// a generated tsvector column of the values (the strings of json and jsonb values)
+// and its GIN index. Adding the column rewrites the table
+func (s *StorePostgres) EnableSearch() error {
+	index := "kv_f_" + s.Name
+	err := validatePostgresIdentifier("index", index, postgresMaxIdentifier)
+	if err != nil {
+		return err
+	}
+
+	for _, statement := range []string{
+		fmt.Sprintf(
+			`ALTER TABLE %s 
+				ADD COLUMN IF NOT EXISTS fts tsvector 
+				GENERATED ALWAYS AS (to_tsvector('simple', V)) STORED`,
+			s.quotedTable,
+		),
+		fmt.Sprintf(
+			`CREATE INDEX IF NOT EXISTS %s 
+				ON %s USING GIN (fts)`,
+			pq.QuoteIdentifier(index),
+			s.quotedTable,
+		),
+	} {
+		_, err = s.Db.Exec(statement)
+		gotils.CheckNotFatal(err)
+		if err != nil {
+			return err
+		}
+	}
+
+	stmt, err := s.Db.Prepare(fmt.Sprintf(
+		`SELECT K, ts_rank(fts, q) 
+			FROM %s, plainto_tsquery('simple', $1) q 
+			WHERE fts @@ q 
+			ORDER BY 2 DESC, K COLLATE "C" 
+			LIMIT $2`,
+		s.quotedTable,
+	))
+	gotils.CheckNotFatal(err)
+	if err != nil {
+		return err
+	}
+	s.indexes.setSearch(stmt)
+	return nil
+}
+
+// Search get up to limit keys whose values have all the words of query,
+// the best matches first. Zero means no limit
+func (s *StorePostgres) Search(query string, limit int) ([]SearchResult, error) {
+	return search(s.indexes.searchStmt(), strings.Join(searchWords(query), " "), limit)
+}
+
+// postgresQuery compiles queries to the jsonb operators, doc is the value as jsonb
+type postgresQuery struct {
+	doc string
+}
+
+func (d postgresQuery) path(path []string) string {
+	return fmt.Sprintf(`(%s #> '{%s}')`, d.doc, strings.Join(path, ","))
+}
+
+func (postgresQuery) param(args *[]interface{}, v interface{}) string {
+	*args = append(*args, v)
+	return fmt.Sprintf("$%d", len(*args))
+}
+
+func (d postgresQuery) exists(path []string) string {
+	return d.path(path) + ` IS NOT NULL`
+}
+
+func (d postgresQuery) compare(path []string, op string, s jsonScalar, args *[]interface{}) string {
+	p := d.path(path)
+	switch s.kind {
+	case "number":
+		// the cast fails on the other types
+		return fmt.Sprintf(
+			`CASE WHEN jsonb_typeof(%[1]s) = 'number' THEN (%[1]s #>> '{}')::numeric %[2]s %[3]s::numeric ELSE false END`,
+			p,
+			op,
+			d.param(args, s.text),
+		)
+	case "string":
+		return fmt.Sprintf(
+			`(jsonb_typeof(%[1]s) = 'string' AND (%[1]s #>> '{}') COLLATE "C" %[2]s %[3]s)`,
+			p,
+			op,
+			d.param(args, s.text),
+		)
+	}
+	return fmt.Sprintf(`%s = '%s'::jsonb`, p, s.json)
+}
+
+func (d postgresQuery) contains(path []string, s jsonScalar, args *[]interface{}) string {
+	p := d.path(path)
+	return fmt.Sprintf(
+		`(jsonb_typeof(%[1]s) = 'array' AND %[1]s @> %[2]s::jsonb)`,
+		p,
+		d.param(args, "["+s.json+"]"),
+	)
+}
+
+func (d postgresQuery) orderBy(path []string) []string {
+	p := d.path(path)
+	return []string{
+		fmt.Sprintf(`CASE jsonb_typeof(%s) WHEN 'number' THEN 0 WHEN 'string' THEN 1 ELSE 2 END`, p),
+		fmt.Sprintf(`CASE WHEN jsonb_typeof(%[1]s) = 'number' THEN (%[1]s #>> '{}')::numeric END`, p),
+		fmt.Sprintf(`CASE WHEN jsonb_typeof(%[1]s) = 'string' THEN (%[1]s #>> '{}') END COLLATE "C"`, p),
+	}
+}
+
+func (d postgresQuery) project(names []string, paths [][]string) string {
+	members := []string{}
+	for i, name := range names {
+		members = append(members, fmt.Sprintf(`%s, %s`, sqlQuote(name), d.path(paths[i])))
+	}
+	return fmt.Sprintf(`jsonb_build_object(%s)::text`, strings.Join(members, ", "))
+}
+
+func (postgresQuery) at(doc string) queryDialect {
+	return postgresQuery{doc: doc}
+}
+
+func (postgresQuery) isObject(doc string, path []string) string {
+	return fmt.Sprintf(`jsonb_typeof(%s #> '{%s}') = 'object'`, doc, strings.Join(path, ","))
+}
+
+func (postgresQuery) set(doc string, path []string, value string) string {
+	return fmt.Sprintf(`jsonb_set(%s, '{%s}', %s::jsonb)`, doc, strings.Join(path, ","), sqlQuote(value))
+}
+
+func (postgresQuery) remove(doc string, path []string) string {
+	return fmt.Sprintf(`(%s #- '{%s}')`, doc, strings.Join(path, ","))
+}
+
+// mergePatch builds the patched doc member by member, the members of
+// an object patch are independent: each one patches the member of doc
+func (d postgresQuery) mergePatch(doc string, patch interface{}) string {
+	members, ok := patch.(map[string]interface{})
+	if !ok {
+		b, _ := json.Marshal(patch)
+		return sqlQuote(string(b)) + "::jsonb"
+	}
+
+	keys := []string{}
+	for k := range members {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	patched := fmt.Sprintf(`CASE WHEN jsonb_typeof(%[1]s) = 'object' THEN %[1]s ELSE '{}'::jsonb END`, doc)
+	removed := []string{}
+	values := map[string]interface{}{}
+	for _, k := range keys {
+		switch v := members[k].(type) {
+		case nil:
+			removed = append(removed, sqlQuote(k))
+		case map[string]interface{}:
+		default:
+			values[k] = v
+		}
+	}
+	if len(removed) > 0 {
+		patched = fmt.Sprintf(`(%s - ARRAY[%s]::text[])`, patched, strings.Join(removed, ", "))
+	}
+	if len(values) > 0 {
+		b, _ := json.Marshal(values)
+		patched = fmt.Sprintf(`(%s || %s::jsonb)`, patched, sqlQuote(string(b)))
+	}
+	for _, k := range keys {
+		if member, ok := members[k].(map[string]interface{}); ok {
+			patched = fmt.Sprintf(
+				`jsonb_set(%s, ARRAY[%s], %s)`,
+				patched,
+				sqlQuote(k),
+				d.mergePatch(fmt.Sprintf(`(%s -> %s)`, doc, sqlQuote(k)), member),
+			)
+		}
+	}
+	return patched
+}
+
+// queryDialect the query dialect of the values of the store
+func (s *StorePostgres) queryDialect() (postgresQuery, error) {
+	switch s.valueType {
+	case "jsonb":
+		return postgresQuery{doc: "V"}, nil
+	case "json":
+		return postgresQuery{doc: "V::jsonb"}, nil
+	}
+	return postgresQuery{}, fmt.Errorf("%w: queries need json or jsonb values", ErrInvalidValueType)
+}
+
+// Find get the entries whose JSON values match q, in the order of q and then in key order.
+// The keys of buckets, locks and queues never match
+func (s *StorePostgres) Find(q *Query) ([]Entry, error) {
+	d, err := s.queryDialect()
+	if err != nil {
+		return nil, err
+	}
+
+	args := []interface{}{}
+	where, order, err := compileQuery(q, d, &args)
+	if err != nil {
+		return nil, err
+	}
+	value := "V"
+	if q.fields != nil {
+		value, err = projectFields(q.fields, d)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if order != "" {
+		order += ", "
+	}
+
+	res, err := s.Db.Query(
+		fmt.Sprintf(
+			`SELECT K, %s, T 
+				FROM %s 
+				WHERE (%s) 
+				AND left(K, 1) <> chr(1) 
+				ORDER BY %sK COLLATE "C" 
+				LIMIT %d`,
+			value,
+			s.quotedTable,
+			where,
+			order,
+			q.sqlLimit(),
+		),
+		args...)
+	gotils.CheckNotFatal(err)
+	if err != nil {
+		return nil, err
+	}
+	return scanEntries(res)
+}
+
+// Snapshot take a consistent read only view of the store (a REPEATABLE READ
+// read only transaction), release it with Release or by ending ctx
+func (s *StorePostgres) Snapshot(ctx context.Context) (*Snapshot, error) {
+	return newSnapshot(
+		ctx,
+		s.Db,
+		&sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true},
+		`SELECT 1`,
+		s.kv().stmts,
+		s.CountAllStmt,
+	)
+}
+
+// Export write all the entries of the store to w as JSON Lines in key order,
+// from a consistent snapshot of the store
+func (s *StorePostgres) Export(w io.Writer) (int64, error) {
+	tx, err := s.Db.BeginTx(context.Background(), &sql.TxOptions{
+		Isolation: sql.LevelRepeatableRead,
+		ReadOnly:  true,
+	})
+	gotils.CheckNotFatal(err)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	return exportEntries(kv{stmts: s.kv().stmts, tx: tx}, w)
+}
+
+// Import write all the entries of an export read from r in a single transaction,
+// mode decides what happens to the keys already in the store.
+// Returns the number of entries written, nothing is written if it fails.
+// The entries postgres can't store byte for byte (values that are not JSON in json and
+// jsonb stores, JSON normalized by jsonb, NUL and invalid UTF-8) are stored as close as
+// they can be and kept as imported: Export writes them as imported until they change.
+// The keys with NUL or invalid UTF-8 are only kept for Export
+func (s *StorePostgres) Import(r io.Reader, mode ImportMode) (int64, error) {
+	var imported int64
+	// r can't be read twice, the transaction is not retried
+	err := updateOnce(s.Db, s.kv().stmts, nil, func(tx *Tx) error {
+		var err error
+		imported, err = importEntries(tx.kv, r, mode, s.valueType)
+		return err
+	})
+	gotils.CheckNotFatal(err)
+	if err != nil {
+		return 0, err
+	}
+	return imported, nil
+}
+
+// ListBuckets list the names of all the registered buckets in ASC order
+func (s *StorePostgres) ListBuckets() ([]string, error) {
+	return listBuckets(s.kv())
+}
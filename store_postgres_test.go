@@ -4,6 +4,7 @@ import (
 	"testing"
 
 	"github.com/korovkin/gokvstore"
+	"github.com/korovkin/gokvstore/tuple"
 
 	. "github.com/onsi/gomega"
 )
@@ -90,3 +91,67 @@ func TestPQ(t *testing.T) {
 	g.Expect(err).To(BeNil())
 	g.Expect(list).To(BeEquivalentTo([]string{"kkk", "333"}))
 }
+
+func TestPQKeyRange(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	s, err := gokvstore.NewStorePostgresWithValueType(
+		"test_range",
+		"jsonb",
+		"host=localhost user=test password=test dbname=test sslmode=disable",
+		nil)
+	g.Expect(err).To(BeNil())
+	defer s.Close()
+
+	s.DeleteAll()
+	defer s.DeleteAll()
+
+	for _, e := range []tuple.Tuple{
+		{"user", 1, "order", 10},
+		{"user", 2, "order", 9},
+		{"user", 2, "order", 10},
+		{"user", 2, "order", 100},
+		{"user", 3, "order", 1},
+	} {
+		k, err := e.Pack()
+		g.Expect(err).To(BeNil())
+		err = s.AddValueKV(k, "{}")
+		g.Expect(err).To(BeNil())
+	}
+
+	begin, end, err := tuple.Tuple{"user", 2}.Range()
+	g.Expect(err).To(BeNil())
+
+	list := []tuple.Tuple{}
+	err = s.IterateByKeyRangeASC(
+		begin,
+		end,
+		1000,
+		func(k *string, t *string, v *string, stop *bool) {
+			e, err := tuple.Unpack(*k)
+			g.Expect(err).To(BeNil())
+			list = append(list, e)
+		})
+	g.Expect(err).To(BeNil())
+	g.Expect(list).To(Equal([]tuple.Tuple{
+		{"user", int64(2), "order", int64(9)},
+		{"user", int64(2), "order", int64(10)},
+		{"user", int64(2), "order", int64(100)},
+	}))
+
+	list = []tuple.Tuple{}
+	err = s.IterateByKeyRangeDESC(
+		begin,
+		end,
+		2,
+		func(k *string, t *string, v *string, stop *bool) {
+			e, err := tuple.Unpack(*k)
+			g.Expect(err).To(BeNil())
+			list = append(list, e)
+		})
+	g.Expect(err).To(BeNil())
+	g.Expect(list).To(Equal([]tuple.Tuple{
+		{"user", int64(2), "order", int64(100)},
+		{"user", int64(2), "order", int64(10)},
+	}))
+}
@@ -1,10 +1,14 @@
 package gokvstore
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
-	"log"
+	"fmt"
+	"io"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/korovkin/gotils"
 
@@ -12,211 +16,957 @@ import (
 	_ "github.com/mattn/go-sqlite3"
 )
 
-// StoreSqlite sqlite based key value store
+// StoreSqlite sqlite based key value store, safe for concurrent use.
+// All the writes go through Db, a single connection, and the reads
+// go through a pool of read only connections
 type StoreSqlite struct {
 	Db                 *sql.DB   `json:"-"`
 	InsertStmt         *sql.Stmt `json:"-"`
+	InsertNewStmt      *sql.Stmt `json:"-"`
 	GetStmt            *sql.Stmt `json:"-"`
 	IterateStmt        *sql.Stmt `json:"-"`
 	IterateAllStmt     *sql.Stmt `json:"-"`
 	IterateByPrefixASC *sql.Stmt `json:"-"`
 	IterateByPrefixDSC *sql.Stmt `json:"-"`
+	IterateByRangeASC  *sql.Stmt `json:"-"`
+	IterateByRangeDSC  *sql.Stmt `json:"-"`
 	DeleteStmt         *sql.Stmt `json:"-"`
 	DeleteAllStmt      *sql.Stmt `json:"-"`
+	DeleteRangeStmt    *sql.Stmt `json:"-"`
+	CountRangeStmt     *sql.Stmt `json:"-"`
 	DeleteStmtTag      *sql.Stmt `json:"-"`
+	DeleteStmtTagLT    *sql.Stmt `json:"-"`
+	DeleteTagRangeStmt *sql.Stmt `json:"-"`
 	CountAllStmt       *sql.Stmt `json:"-"`
+	IncrStmt           *sql.Stmt `json:"-"`
+	SumRangeStmt       *sql.Stmt `json:"-"`
+	LockStmt           *sql.Stmt `json:"-"`
+	RenewLockStmt      *sql.Stmt `json:"-"`
+	UnlockStmt         *sql.Stmt `json:"-"`
+	EnqueueStmt        *sql.Stmt `json:"-"`
+	DequeueStmt        *sql.Stmt `json:"-"`
+	NackStmt           *sql.Stmt `json:"-"`
+	AckStmt            *sql.Stmt `json:"-"`
+	GenerationStmt     *sql.Stmt `json:"-"`
+	DeleteOlderStmt    *sql.Stmt `json:"-"`
+	KeysRangeStmt      *sql.Stmt `json:"-"`
+	KeysTagStmt        *sql.Stmt `json:"-"`
+	KeysTagLTStmt      *sql.Stmt `json:"-"`
+	KeysTagRangeStmt   *sql.Stmt `json:"-"`
+	KeysAllStmt        *sql.Stmt `json:"-"`
 	Filename           string    `json:"filename"`
-	currentTransaction *sql.Tx
+	TableName          string    `json:"table"`
+	ownsDb             bool
+	readDb             *sql.DB
+	stmts              *kvStmts
+	txStmts            *kvStmts
+	indexes            *indexes
+	stopCheckpoints    chan struct{}
+	retry              *retrier
+	options            SqliteOptions
+	logger             Logger
 }
 
 // NewStoreSqlite allocate a new instance of StoreSqlite
 // will create a sqlite file name 'tableName' in 'folder'
 func NewStoreSqlite(tableName string, folder string) (*StoreSqlite, error) {
-	var err error
-	store := StoreSqlite{}
-
 	if folder == "" {
 		folder = "."
 	}
 
-	if folder == ":memory:" {
-		store.Filename = folder
-	} else {
-		store.Filename = folder + "/" + tableName + ".db"
+	filename := folder
+	if folder != ":memory:" {
+		filename = folder + "/" + tableName + ".db"
+	}
+
+	return NewStoreSqliteWithOptions(SqliteOptions{Filename: filename})
+}
+
+// NewStoreSqliteWithOptions allocate a new instance of StoreSqlite configured by options
+func NewStoreSqliteWithOptions(options SqliteOptions) (*StoreSqlite, error) {
+	var err error
+	options = options.withDefaults()
+	store := StoreSqlite{
+		Filename: options.Filename,
+		ownsDb:   true,
+		retry:    newRetrier(options.Retry),
+		options:  options,
+		logger:   options.Logger,
+	}
+
+	store.Db, err = sql.Open("sqlite3", options.dsn())
+	if err != nil {
+		return nil, err
+	}
+	store.Db.SetMaxOpenConns(1)
+	store.retry.writer = &writer{}
+
+	// every connection to an in memory db is a different db
+	store.readDb = store.Db
+	if !isSqliteMemory(options.Filename) {
+		// the writer already set up the journal
+		err = store.Db.Ping()
+		if err != nil {
+			store.Db.Close()
+			return nil, err
+		}
+
+		store.readDb, err = sql.Open("sqlite3", options.readerDsn())
+		if err != nil {
+			store.Db.Close()
+			return nil, err
+		}
+		configurePool(store.readDb, options.MaxOpenConns, options.MaxIdleConns, 0)
 	}
 
-	store.Db, err = sql.Open("sqlite3", store.Filename)
+	err = store.prepare(options.TableName)
 	if err != nil {
+		if store.readDb != store.Db {
+			store.readDb.Close()
+		}
+		store.Db.Close()
 		return nil, err
 	}
 
-	_, err = store.Db.Exec(
-		`PRAGMA busy_timeout = 50000;`)
-	gotils.CheckFatal(err)
+	for _, index := range options.Indexes {
+		err = store.CreateIndex(index)
+		if err != nil {
+			store.Close()
+			return nil, err
+		}
+	}
 
-	_, err = store.Db.Exec(
-		`PRAGMA journal_mode = OFF;`)
-	gotils.CheckFatal(err)
+	if options.Search {
+		err = store.EnableSearch()
+		if err != nil {
+			store.Close()
+			return nil, err
+		}
+	}
 
-	_, err = store.Db.Exec(
-		`CREATE TABLE IF NOT EXISTS KV 
-			(K string primary key, V string, T string);`)
-	gotils.CheckFatal(err)
+	if options.CheckpointInterval > 0 {
+		store.stopCheckpoints = make(chan struct{})
+		go store.checkpoints(options.CheckpointInterval, store.stopCheckpoints)
+	}
+	return &store, nil
+}
 
-	_, err = store.Db.Exec(
-		`CREATE INDEX IF NOT EXISTS KV_K 
-			ON KV (K);`)
-	gotils.CheckFatal(err)
+// isSqliteMemory is filename an in memory db
+func isSqliteMemory(filename string) bool {
+	return strings.HasPrefix(filename, ":memory:") || strings.Contains(filename, "mode=memory")
+}
 
-	_, err = store.Db.Exec(
-		`CREATE INDEX IF NOT EXISTS KV_T 
-			ON KV (T);`)
-	gotils.CheckFatal(err)
+// checkpoints checkpoint the WAL every interval until stop is closed
+func (s *StoreSqlite) checkpoints(interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			err := s.Checkpoint("PASSIVE")
+			gotils.CheckNotFatal(err)
+		}
+	}
+}
 
-	store.InsertStmt, err = store.Db.Prepare(
-		`INSERT OR REPLACE 
-			INTO KV(K, V, T) 
-			VALUES(?, ?, ?)`)
-	gotils.CheckFatal(err)
+// Checkpoint copy the content of the WAL into the db file,
+// mode is one of PASSIVE, FULL, RESTART or TRUNCATE
+func (s *StoreSqlite) Checkpoint(mode string) error {
+	switch strings.ToUpper(mode) {
+	case "PASSIVE", "FULL", "RESTART", "TRUNCATE":
+	default:
+		return fmt.Errorf("gokvstore: invalid checkpoint mode %q", mode)
+	}
 
-	store.GetStmt, err = store.Db.Prepare(
-		`SELECT K, V, T 
-			FROM KV 
-			WHERE K=?`)
-	gotils.CheckFatal(err)
-
-	store.IterateStmt, err = store.Db.Prepare(
-		`SELECT K, V 
-			FROM KV 
-			WHERE K<=? 
-			ORDER BY K DESC 
-			LIMIT ?`)
-	gotils.CheckFatal(err)
-
-	store.IterateAllStmt, err = store.Db.Prepare(
+	err := s.inUpdate()
+	if err != nil {
+		return err
+	}
+
+	var busy, logFrames, checkpointed int
+	err = s.Db.QueryRow(
+		fmt.Sprintf(`PRAGMA wal_checkpoint(%s);`, strings.ToUpper(mode)),
+	).Scan(&busy, &logFrames, &checkpointed)
+	if err != nil {
+		return err
+	}
+	if busy != 0 && !strings.EqualFold(mode, "PASSIVE") {
+		return fmt.Errorf("gokvstore: checkpoint %s: db is busy", mode)
+	}
+	return nil
+}
+
+// Table open the table kv_'name' in the same sqlite database as s,
+// the stores share the connection pool and can share transactions (see InTx)
+func (s *StoreSqlite) Table(name string) (*StoreSqlite, error) {
+	store := StoreSqlite{
+		Db:       s.Db,
+		Filename: s.Filename,
+		readDb:   s.readDb,
+		retry:    s.retry,
+		options:  s.options,
+		logger:   s.logger,
+	}
+
+	err := store.prepare("kv_" + name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &store, nil
+}
+
+// sqliteQuoteIdentifier quote a table or an index name
+func sqliteQuoteIdentifier(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
+
+// sqliteMigrations the schema versions of a sqlite store table
+func sqliteMigrations(table string, options SqliteOptions) []migration {
+	tableName := sqliteQuoteIdentifier(table)
+
+	createIndexes := func(tx *sql.Tx) error {
+		_, err := tx.Exec(fmt.Sprintf(
+			`CREATE INDEX IF NOT EXISTS %s 
+				ON %s (K);`,
+			sqliteQuoteIdentifier(table+"_K"),
+			tableName,
+		))
+		if err != nil || options.NoTagIndex {
+			return err
+		}
+
+		_, err = tx.Exec(fmt.Sprintf(
+			`CREATE INDEX IF NOT EXISTS %s 
+				ON %s (T);`,
+			sqliteQuoteIdentifier(table+"_T"),
+			tableName,
+		))
+		return err
+	}
+
+	return []migration{
+		{
+			version:     1,
+			description: "create the table",
+			up: func(tx *sql.Tx) error {
+				_, err := tx.Exec(fmt.Sprintf(
+					`CREATE TABLE IF NOT EXISTS %s 
+						(K text primary key, V text, T text);`,
+					tableName,
+				))
+				if err != nil {
+					return err
+				}
+				return createIndexes(tx)
+			},
+		},
+		{
+			version:     2,
+			description: "text affinity for tables created with K string",
+			up: func(tx *sql.Tx) error {
+				var kType string
+				err := tx.QueryRow(
+					`SELECT type 
+						FROM pragma_table_info($1) 
+						WHERE name = 'K'`,
+					table,
+				).Scan(&kType)
+				if err != nil {
+					return err
+				}
+				if strings.EqualFold(kType, "text") {
+					return nil
+				}
+
+				tmpName := sqliteQuoteIdentifier(table + "_migrate")
+				for _, q := range []string{
+					`CREATE TABLE %[2]s 
+						(K text primary key, V text, T text);`,
+					`INSERT INTO %[2]s (K, V, T) 
+						SELECT CAST(K AS TEXT), CAST(V AS TEXT), CAST(T AS TEXT) 
+						FROM %[1]s;`,
+					`DROP TABLE %[1]s;`,
+					`ALTER TABLE %[2]s RENAME TO %[1]s;`,
+				} {
+					_, err = tx.Exec(fmt.Sprintf(q, tableName, tmpName))
+					if err != nil {
+						return err
+					}
+				}
+				return createIndexes(tx)
+			},
+		},
+	}
+}
+
+// SchemaVersion get the schema version of the store table
+func (s *StoreSqlite) SchemaVersion() (int, error) {
+	err := s.inUpdate()
+	if err != nil {
+		return 0, err
+	}
+
+	return schemaVersion(s.Db, s.TableName)
+}
+
+// prepare migrate the table to the current schema version and prepare all the statements
+func (s *StoreSqlite) prepare(table string) error {
+	var err error
+	s.TableName = table
+	tableName := sqliteQuoteIdentifier(table)
+	s.indexes = newIndexes()
+
+	err = migrate(s.Db, table, sqliteMigrations(table, s.options), s.logger)
+	if err != nil {
+		return err
+	}
+
+	s.InsertStmt, err = s.Db.Prepare(
+		fmt.Sprintf(
+			`INSERT 
+				INTO %s(K, V, T) 
+				VALUES(?, ?, ?) 
+				ON CONFLICT (K) DO UPDATE 
+				SET V = excluded.V, T = excluded.T`,
+			tableName,
+		))
+	if err != nil {
+		return err
+	}
+
+	s.InsertNewStmt, err = s.Db.Prepare(
+		fmt.Sprintf(
+			`INSERT 
+				INTO %s(K, V, T) 
+				VALUES(?, ?, ?) 
+				ON CONFLICT (K) DO NOTHING`,
+			tableName,
+		))
+	if err != nil {
+		return err
+	}
+
+	getQuery := fmt.Sprintf(
 		`SELECT K, V, T 
-			FROM KV 
-			ORDER BY K`)
-	gotils.CheckFatal(err)
+			FROM %s 
+			WHERE K=?`,
+		tableName,
+	)
+	s.GetStmt, err = s.readDb.Prepare(getQuery)
+	if err != nil {
+		return err
+	}
+
+	s.IterateStmt, err = s.readDb.Prepare(
+		fmt.Sprintf(
+			`SELECT K, V 
+				FROM %s 
+				WHERE K<=? 
+				ORDER BY K COLLATE BINARY DESC 
+				LIMIT ?`,
+			tableName,
+		))
+	if err != nil {
+		return err
+	}
+
+	s.IterateAllStmt, err = s.readDb.Prepare(
+		fmt.Sprintf(
+			`SELECT K, V, T 
+				FROM %s 
+				ORDER BY K COLLATE BINARY`,
+			tableName,
+		))
+	if err != nil {
+		return err
+	}
+
+	s.IterateByPrefixASC, err = s.readDb.Prepare(
+		fmt.Sprintf(
+			`SELECT K, V, T 
+				FROM %s
+				WHERE K >= $1 COLLATE BINARY
+				ORDER BY K COLLATE BINARY ASC
+				LIMIT $2`,
+			tableName,
+		))
+	if err != nil {
+		return err
+	}
+
+	s.IterateByPrefixDSC, err = s.readDb.Prepare(
+		fmt.Sprintf(
+			`SELECT K, V, T 
+				FROM %s
+				WHERE K <= $1 COLLATE BINARY
+				ORDER BY K COLLATE BINARY DESC
+				LIMIT $2`,
+			tableName,
+		))
+	if err != nil {
+		return err
+	}
 
-	store.IterateByPrefixASC, err = store.Db.Prepare(
+	iterateRangeASCQuery := fmt.Sprintf(
 		`SELECT K, V, T 
-			FROM KV
-			WHERE K >= $1
-			ORDER BY K ASC
-			LIMIT $2
-			COLLATE NOCASE`)
-	gotils.CheckFatal(err)
-
-	store.IterateByPrefixDSC, err = store.Db.Prepare(
+			FROM %s
+			WHERE K >= $1 COLLATE BINARY
+			AND ($2 = '' OR K < $2 COLLATE BINARY)
+			ORDER BY K COLLATE BINARY ASC
+			LIMIT $3`,
+		tableName,
+	)
+	s.IterateByRangeASC, err = s.readDb.Prepare(iterateRangeASCQuery)
+	if err != nil {
+		return err
+	}
+
+	iterateRangeDSCQuery := fmt.Sprintf(
 		`SELECT K, V, T 
-			FROM KV
-			WHERE K <= $1
-			ORDER BY K DESC
-			LIMIT $2
-			COLLATE NOCASE`)
-	gotils.CheckFatal(err)
-
-	store.DeleteStmt, err = store.Db.Prepare(
-		`DELETE 
-			FROM KV 
-			WHERE K=?`)
-	gotils.CheckFatal(err)
-
-	store.DeleteAllStmt, err = store.Db.Prepare(
-		`DELETE 
-			FROM KV 
-			WHERE 1`)
-	gotils.CheckFatal(err)
-
-	store.DeleteStmtTag, err = store.Db.Prepare(
-		`DELETE 
-			FROM KV 
-			WHERE T=$1`)
-	gotils.CheckFatal(err)
-
-	store.CountAllStmt, err = store.Db.Prepare(
-		`SELECT 
-			COUNT(K), 
-			MIN(K), 
-			MAX(K) 
-		FROM KV`)
-	gotils.CheckFatal(err)
-
-	return &store, err
-}
-
-// Close close all the statements and the sqlite db
+			FROM %s
+			WHERE K >= $1 COLLATE BINARY
+			AND ($2 = '' OR K < $2 COLLATE BINARY)
+			ORDER BY K COLLATE BINARY DESC
+			LIMIT $3`,
+		tableName,
+	)
+	s.IterateByRangeDSC, err = s.readDb.Prepare(iterateRangeDSCQuery)
+	if err != nil {
+		return err
+	}
+
+	s.DeleteStmt, err = s.Db.Prepare(
+		fmt.Sprintf(
+			`DELETE 
+				FROM %s 
+				WHERE K=?`,
+			tableName,
+		))
+	if err != nil {
+		return err
+	}
+
+	s.DeleteAllStmt, err = s.Db.Prepare(
+		fmt.Sprintf(
+			`DELETE 
+				FROM %s 
+				WHERE 1`,
+			tableName,
+		))
+	if err != nil {
+		return err
+	}
+
+	s.DeleteRangeStmt, err = s.Db.Prepare(
+		fmt.Sprintf(
+			`DELETE 
+				FROM %s 
+				WHERE K >= $1 COLLATE BINARY
+				AND ($2 = '' OR K < $2 COLLATE BINARY)
+				AND ($3 OR substr(K, 1, 1) <> char(1))`,
+			tableName,
+		))
+	if err != nil {
+		return err
+	}
+
+	s.DeleteStmtTag, err = s.Db.Prepare(
+		fmt.Sprintf(
+			`DELETE 
+				FROM %s 
+				WHERE T=$1`,
+			tableName,
+		))
+	if err != nil {
+		return err
+	}
+
+	s.DeleteStmtTagLT, err = s.Db.Prepare(
+		fmt.Sprintf(
+			`DELETE 
+				FROM %s 
+				WHERE T < $1 COLLATE BINARY 
+				AND substr(K, 1, 1) <> char(1)`,
+			tableName,
+		))
+	if err != nil {
+		return err
+	}
+
+	s.DeleteTagRangeStmt, err = s.Db.Prepare(
+		fmt.Sprintf(
+			`DELETE 
+				FROM %s 
+				WHERE T >= $1 COLLATE BINARY 
+				AND ($2 = '' OR T < $2 COLLATE BINARY) 
+				AND substr(K, 1, 1) <> char(1)`,
+			tableName,
+		))
+	if err != nil {
+		return err
+	}
+
+	s.CountAllStmt, err = s.readDb.Prepare(
+		fmt.Sprintf(
+			`SELECT 
+				COUNT(K), 
+				MIN(K COLLATE BINARY), 
+				MAX(K COLLATE BINARY) 
+			FROM %s`,
+			tableName,
+		))
+	if err != nil {
+		return err
+	}
+
+	s.IncrStmt, err = s.Db.Prepare(
+		fmt.Sprintf(
+			`INSERT 
+				INTO %s(K, V, T) 
+				VALUES($1, $2, '') 
+				ON CONFLICT (K) DO UPDATE 
+				SET V = CAST(V AS INTEGER) + $2 
+				WHERE CAST(CAST(V AS INTEGER) AS TEXT) = V 
+				RETURNING CAST(V AS INTEGER)`,
+			tableName,
+		))
+	if err != nil {
+		return err
+	}
+
+	countRangeQuery := fmt.Sprintf(
+		`SELECT COUNT(*) 
+			FROM %s 
+			WHERE K >= $1 COLLATE BINARY 
+			AND ($2 = '' OR K < $2 COLLATE BINARY)
+			AND substr(K, 1, 1) <> char(1)`,
+		tableName,
+	)
+	s.CountRangeStmt, err = s.readDb.Prepare(countRangeQuery)
+	if err != nil {
+		return err
+	}
+
+	sumRangeQuery := fmt.Sprintf(
+		`SELECT COALESCE(SUM(CAST(V AS INTEGER)), 0) 
+			FROM %s 
+			WHERE K >= $1 COLLATE BINARY 
+			AND K < $2 COLLATE BINARY`,
+		tableName,
+	)
+	s.SumRangeStmt, err = s.readDb.Prepare(sumRangeQuery)
+	if err != nil {
+		return err
+	}
+
+	// locks expire with the db clock, in unix nanoseconds padded to compare as text
+	dbNow := `(CAST(ROUND((julianday('now') - 2440587.5) * 86400000.0) AS INTEGER) * 1000000)`
+	s.LockStmt, err = s.Db.Prepare(
+		fmt.Sprintf(
+			`INSERT 
+				INTO %[1]s(K, V, T) 
+				VALUES(?1, ?2, printf('%%020d', %[2]s + ?3)) 
+				ON CONFLICT (K) DO UPDATE 
+				SET V = excluded.V, T = excluded.T 
+				WHERE T < printf('%%020d', %[2]s) 
+				RETURNING T`,
+			tableName,
+			dbNow,
+		))
+	if err != nil {
+		return err
+	}
+
+	s.RenewLockStmt, err = s.Db.Prepare(
+		fmt.Sprintf(
+			`UPDATE %[1]s 
+				SET T = printf('%%020d', %[2]s + ?3) 
+				WHERE K = ?1 
+				AND V = ?2 
+				AND T >= printf('%%020d', %[2]s) 
+				RETURNING T`,
+			tableName,
+			dbNow,
+		))
+	if err != nil {
+		return err
+	}
+
+	s.UnlockStmt, err = s.Db.Prepare(
+		fmt.Sprintf(
+			`DELETE 
+				FROM %s 
+				WHERE K = ?1 
+				AND V = ?2`,
+			tableName,
+		))
+	if err != nil {
+		return err
+	}
+
+	// the tag of a message is its receipt: when it's visible and its deliveries
+	s.EnqueueStmt, err = s.Db.Prepare(
+		fmt.Sprintf(
+			`INSERT 
+				INTO %[1]s(K, V, T) 
+				VALUES(?1, ?2, printf('%%020d.0', %[2]s + ?3))`,
+			tableName,
+			dbNow,
+		))
+	if err != nil {
+		return err
+	}
+
+	s.DequeueStmt, err = s.Db.Prepare(
+		fmt.Sprintf(
+			`UPDATE %[1]s 
+				SET T = printf('%%020d.%%d', %[2]s + ?3, CAST(substr(T, 22) AS INTEGER) + 1) 
+				WHERE K = (
+					SELECT K 
+					FROM %[1]s 
+					WHERE K >= ?1 COLLATE BINARY 
+					AND K < ?2 COLLATE BINARY 
+					AND substr(T, 1, 20) <= printf('%%020d', %[2]s) 
+					ORDER BY T, K 
+					LIMIT 1) 
+				RETURNING K, V, T`,
+			tableName,
+			dbNow,
+		))
+	if err != nil {
+		return err
+	}
+
+	s.NackStmt, err = s.Db.Prepare(
+		fmt.Sprintf(
+			`UPDATE %[1]s 
+				SET T = printf('%%020d.%%s', %[2]s + ?3, substr(T, 22)) 
+				WHERE K = ?1 
+				AND T = ?2 
+				RETURNING T`,
+			tableName,
+			dbNow,
+		))
+	if err != nil {
+		return err
+	}
+
+	s.AckStmt, err = s.Db.Prepare(
+		fmt.Sprintf(
+			`DELETE 
+				FROM %s 
+				WHERE K = ?1 
+				AND T = ?2`,
+			tableName,
+		))
+	if err != nil {
+		return err
+	}
+
+	// generations are the tags of the keys outside of buckets, locks and queues
+	s.GenerationStmt, err = s.Db.Prepare(
+		fmt.Sprintf(
+			`SELECT DISTINCT T 
+				FROM %s 
+				WHERE T <> '' 
+				AND substr(K, 1, 1) <> char(1) 
+				ORDER BY T COLLATE BINARY DESC 
+				LIMIT 1 OFFSET $1`,
+			tableName,
+		))
+	if err != nil {
+		return err
+	}
+
+	s.DeleteOlderStmt, err = s.Db.Prepare(
+		fmt.Sprintf(
+			`DELETE 
+				FROM %s 
+				WHERE T <> '' 
+				AND T < $1 COLLATE BINARY 
+				AND substr(K, 1, 1) <> char(1)`,
+			tableName,
+		))
+	if err != nil {
+		return err
+	}
+
+	// the keys of the deletes of a dry run, run on the writer by the transaction
+	s.KeysRangeStmt, err = s.Db.Prepare(
+		fmt.Sprintf(
+			`SELECT K 
+				FROM %s 
+				WHERE K >= $1 COLLATE BINARY
+				AND ($2 = '' OR K < $2 COLLATE BINARY)
+				AND ($3 OR substr(K, 1, 1) <> char(1)) 
+				ORDER BY K COLLATE BINARY ASC`,
+			tableName,
+		))
+	if err != nil {
+		return err
+	}
+
+	s.KeysTagStmt, err = s.Db.Prepare(
+		fmt.Sprintf(
+			`SELECT K 
+				FROM %s 
+				WHERE T=$1 
+				ORDER BY K COLLATE BINARY ASC`,
+			tableName,
+		))
+	if err != nil {
+		return err
+	}
+
+	s.KeysTagLTStmt, err = s.Db.Prepare(
+		fmt.Sprintf(
+			`SELECT K 
+				FROM %s 
+				WHERE T < $1 COLLATE BINARY 
+				AND substr(K, 1, 1) <> char(1) 
+				ORDER BY K COLLATE BINARY ASC`,
+			tableName,
+		))
+	if err != nil {
+		return err
+	}
+
+	s.KeysTagRangeStmt, err = s.Db.Prepare(
+		fmt.Sprintf(
+			`SELECT K 
+				FROM %s 
+				WHERE T >= $1 COLLATE BINARY 
+				AND ($2 = '' OR T < $2 COLLATE BINARY) 
+				AND substr(K, 1, 1) <> char(1) 
+				ORDER BY K COLLATE BINARY ASC`,
+			tableName,
+		))
+	if err != nil {
+		return err
+	}
+
+	s.KeysAllStmt, err = s.Db.Prepare(
+		fmt.Sprintf(
+			`SELECT K 
+				FROM %s 
+				ORDER BY K COLLATE BINARY ASC`,
+			tableName,
+		))
+	if err != nil {
+		return err
+	}
+
+	// transactions run on the writer, they need their own copies of the reads
+	s.stmts = &kvStmts{
+		insert:          s.InsertStmt,
+		insertNew:       s.InsertNewStmt,
+		get:             s.GetStmt,
+		delete:          s.DeleteStmt,
+		deleteRange:     s.DeleteRangeStmt,
+		deleteTag:       s.DeleteStmtTag,
+		deleteTagLT:     s.DeleteStmtTagLT,
+		deleteTagRange:  s.DeleteTagRangeStmt,
+		deleteAll:       s.DeleteAllStmt,
+		countRange:      s.CountRangeStmt,
+		iterateRangeASC: s.IterateByRangeASC,
+		iterateRangeDSC: s.IterateByRangeDSC,
+		incr:            s.IncrStmt,
+		sumRange:        s.SumRangeStmt,
+		lockAcquire:     s.LockStmt,
+		lockRenew:       s.RenewLockStmt,
+		lockRelease:     s.UnlockStmt,
+		queueEnqueue:    s.EnqueueStmt,
+		queueDequeue:    s.DequeueStmt,
+		queueNack:       s.NackStmt,
+		queueAck:        s.AckStmt,
+		generation:      s.GenerationStmt,
+		deleteOlder:     s.DeleteOlderStmt,
+		keysRange:       s.KeysRangeStmt,
+		keysTag:         s.KeysTagStmt,
+		keysTagLT:       s.KeysTagLTStmt,
+		keysTagRange:    s.KeysTagRangeStmt,
+		keysAll:         s.KeysAllStmt,
+	}
+	s.txStmts = s.stmts
+	if s.readDb != s.Db {
+		s.txStmts = &kvStmts{
+			insert:         s.InsertStmt,
+			insertNew:      s.InsertNewStmt,
+			delete:         s.DeleteStmt,
+			deleteRange:    s.DeleteRangeStmt,
+			deleteTag:      s.DeleteStmtTag,
+			deleteTagLT:    s.DeleteStmtTagLT,
+			deleteTagRange: s.DeleteTagRangeStmt,
+			deleteAll:      s.DeleteAllStmt,
+			incr:           s.IncrStmt,
+			lockAcquire:    s.LockStmt,
+			lockRenew:      s.RenewLockStmt,
+			lockRelease:    s.UnlockStmt,
+			queueEnqueue:   s.EnqueueStmt,
+			queueDequeue:   s.DequeueStmt,
+			queueNack:      s.NackStmt,
+			queueAck:       s.AckStmt,
+			generation:     s.GenerationStmt,
+			deleteOlder:    s.DeleteOlderStmt,
+			keysRange:      s.KeysRangeStmt,
+			keysTag:        s.KeysTagStmt,
+			keysTagLT:      s.KeysTagLTStmt,
+			keysTagRange:   s.KeysTagRangeStmt,
+			keysAll:        s.KeysAllStmt,
+		}
+		for _, q := range []struct {
+			stmt  **sql.Stmt
+			query string
+		}{
+			{&s.txStmts.get, getQuery},
+			{&s.txStmts.iterateRangeASC, iterateRangeASCQuery},
+			{&s.txStmts.iterateRangeDSC, iterateRangeDSCQuery},
+			{&s.txStmts.countRange, countRangeQuery},
+			{&s.txStmts.sumRange, sumRangeQuery},
+		} {
+			*q.stmt, err = s.Db.Prepare(q.query)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Close close all the statements and the sqlite db,
+// stores opened with Table only close their statements
 func (s *StoreSqlite) Close() {
 	s.InsertStmt.Close()
+	s.InsertNewStmt.Close()
 	s.GetStmt.Close()
 	s.IterateStmt.Close()
 	s.DeleteStmt.Close()
 	s.DeleteStmtTag.Close()
+	s.DeleteStmtTagLT.Close()
+	s.DeleteTagRangeStmt.Close()
 	s.DeleteAllStmt.Close()
+	s.DeleteRangeStmt.Close()
+	s.CountRangeStmt.Close()
 	s.CountAllStmt.Close()
 	s.IterateByPrefixASC.Close()
 	s.IterateByPrefixDSC.Close()
+	s.IterateByRangeASC.Close()
+	s.IterateByRangeDSC.Close()
 	s.IterateAllStmt.Close()
-	s.Db.Close()
+	s.IncrStmt.Close()
+	s.SumRangeStmt.Close()
+	s.LockStmt.Close()
+	s.RenewLockStmt.Close()
+	s.UnlockStmt.Close()
+	s.EnqueueStmt.Close()
+	s.DequeueStmt.Close()
+	s.NackStmt.Close()
+	s.AckStmt.Close()
+	s.GenerationStmt.Close()
+	s.DeleteOlderStmt.Close()
+	s.KeysRangeStmt.Close()
+	s.KeysTagStmt.Close()
+	s.KeysTagLTStmt.Close()
+	s.KeysTagRangeStmt.Close()
+	s.KeysAllStmt.Close()
+	s.indexes.close()
+	if s.txStmts != s.stmts {
+		s.txStmts.get.Close()
+		s.txStmts.iterateRangeASC.Close()
+		s.txStmts.iterateRangeDSC.Close()
+		s.txStmts.countRange.Close()
+		s.txStmts.sumRange.Close()
+	}
+	if s.stopCheckpoints != nil {
+		close(s.stopCheckpoints)
+		s.stopCheckpoints = nil
+	}
+	if s.ownsDb {
+		if s.readDb != s.Db {
+			s.readDb.Close()
+		}
+		s.Db.Close()
+	}
 	s.Db = nil
+	s.readDb = nil
 }
 
-// CloseAndDelete deletes the sqlite DB from the file system
+// CloseAndDelete deletes the sqlite DB (and its WAL files) from the file system
 func (s *StoreSqlite) CloseAndDelete() {
 	s.Close()
-	log.Println("STORE: Remove:", s.Filename)
+	s.logger.Println("STORE: Remove:", s.Filename)
 
 	os.RemoveAll(s.Filename)
+	os.RemoveAll(s.Filename + "-wal")
+	os.RemoveAll(s.Filename + "-shm")
+	os.RemoveAll(s.Filename + "-journal")
 }
 
 // AddValueKVT add (k,v,t) to the store
 func (s *StoreSqlite) AddValueKVT(k string, v string, t string) error {
-	if s.currentTransaction != nil {
-		stmt := s.currentTransaction.Stmt(s.InsertStmt)
-		_, err := stmt.Exec(k, v, "")
-		gotils.CheckNotFatal(err)
-		return err
-	}
-
-	_, err := s.InsertStmt.Exec(k, v, t)
-	gotils.CheckNotFatal(err)
-	return err
+	return s.retry.exec(s.InsertStmt, k, v, t)
 }
 
 // AddValueKV add (k,v) to the store
 func (s *StoreSqlite) AddValueKV(k string, v string) error {
-	if s.currentTransaction != nil {
-		stmt := s.currentTransaction.Stmt(s.InsertStmt)
-		_, err := stmt.Exec(k, v, "")
-		gotils.CheckNotFatal(err)
-		return err
-	}
+	return s.retry.exec(s.InsertStmt, k, v, "")
+}
 
-	_, err := s.InsertStmt.Exec(k, v, "")
-	gotils.CheckNotFatal(err)
-	return err
+// DeleteValue delete k from the store, get the number of deleted keys (0 or 1)
+func (s *StoreSqlite) DeleteValue(k string) (int64, error) {
+	return s.kv().deleteValue(k)
 }
 
-// DeleteValue delete k from the store
-func (s *StoreSqlite) DeleteValue(k string) error {
-	_, err := s.DeleteStmt.Exec(k)
-	gotils.CheckNotFatal(err)
-	return err
+// DeleteAllWithTag delete all value with tag t from the store, get the number of deleted keys
+func (s *StoreSqlite) DeleteAllWithTag(t string) (int64, error) {
+	return s.kv().execCount(s.DeleteStmtTag, t)
 }
 
-// DeleteAllWithTag delete all value with tag t from the store
-func (s *StoreSqlite) DeleteAllWithTag(t string) error {
-	_, err := s.DeleteStmtTag.Exec(t)
-	gotils.CheckNotFatal(err)
-	return err
+// DeleteWhereTagLT delete all the keys with a tag less than t (byte by byte),
+// the keys of buckets, locks and queues are kept. Get the number of deleted keys
+func (s *StoreSqlite) DeleteWhereTagLT(t string) (int64, error) {
+	return s.kv().execCount(s.DeleteStmtTagLT, t)
 }
 
-// DeleteAll delete all the data in the store
-func (s *StoreSqlite) DeleteAll() error {
-	_, err := s.DeleteAllStmt.Exec()
-	gotils.CheckNotFatal(err)
-	return err
+// DeleteTagRange delete all the keys with begin <= tag < end (byte by byte),
+// an empty end means no upper bound. The keys of buckets, locks and queues are kept.
+// Get the number of deleted keys
+func (s *StoreSqlite) DeleteTagRange(begin string, end string) (int64, error) {
+	return s.kv().execCount(s.DeleteTagRangeStmt, begin, end)
+}
+
+// DeleteAll delete all the data in the store, get the number of deleted keys
+func (s *StoreSqlite) DeleteAll() (int64, error) {
+	return s.kv().execCount(s.DeleteAllStmt)
+}
+
+// DeletePrefix delete the keys that start with prefix in a single statement,
+// the keys of buckets, locks and queues are kept. Get the number of deleted keys
+func (s *StoreSqlite) DeletePrefix(prefix string) (int64, error) {
+	return s.kv().deleteRange(prefix, prefixEnd(prefix))
+}
+
+// DeleteRange delete the keys with begin <= key < end in a single statement,
+// an empty end means no upper bound. The keys of buckets, locks and queues are kept.
+// Get the number of deleted keys
+func (s *StoreSqlite) DeleteRange(begin string, end string) (int64, error) {
+	return s.kv().deleteRange(begin, end)
+}
+
+// CountPrefix count the keys that start with prefix, but the keys of buckets, locks and queues
+func (s *StoreSqlite) CountPrefix(prefix string) (int64, error) {
+	return s.kv().countRange(prefix, prefixEnd(prefix))
+}
+
+// CountRange count the keys with begin <= key < end, an empty end means no upper bound.
+// The keys of buckets, locks and queues are not counted
+func (s *StoreSqlite) CountRange(begin string, end string) (int64, error) {
+	return s.kv().countRange(begin, end)
 }
 
 // AddValueAsJSON add (k, t, json(o)) to the store
@@ -228,6 +978,12 @@ func (s *StoreSqlite) AddValueAsJSON(k string, t string, o interface{}) error {
 
 // CountAll count number of items in the store
 func (s *StoreSqlite) CountAll() (int64, string, string) {
+	err := s.inUpdate()
+	gotils.CheckNotFatal(err)
+	if err != nil {
+		return -1, "", ""
+	}
+
 	res, err := s.CountAllStmt.Query()
 	gotils.CheckNotFatal(err)
 
@@ -251,36 +1007,27 @@ func (s *StoreSqlite) CountAll() (int64, string, string) {
 
 }
 
-// Transaction run the given block under a sqlite transaction
-func (s *StoreSqlite) Transaction(block func()) error {
-	var err error
+// Transaction run the given block under a sqlite transaction,
+// block must use tx (see Update)
+//
+// Deprecated: use Update, which rolls back when block returns an error
+func (s *StoreSqlite) Transaction(block func(tx *Tx)) error {
+	return s.Update(func(tx *Tx) error {
+		block(tx)
+		return nil
+	})
+}
 
-	if s.currentTransaction != nil {
-		log.Fatalln("NO CONCURRENT TRANSACTIONS")
-	}
-	transaction, err := s.Db.Begin()
+// IterateAll traverse all the items in the store
+func (s *StoreSqlite) IterateAll(
+	o interface{},
+	block func(k string, t string, v string, stop *bool)) {
+	err := s.inUpdate()
 	gotils.CheckNotFatal(err)
-
-	s.currentTransaction = transaction
-
 	if err != nil {
-		return err
+		return
 	}
 
-	block()
-
-	err = transaction.Commit()
-	gotils.CheckNotFatal(err)
-	s.currentTransaction = nil
-
-	return err
-}
-
-// IterateAll traverse all the items in the store
-func (s *StoreSqlite) IterateAll(
-	o interface{},
-	block func(k string, t string, v string, stop *bool)) {
-	var err error
 	var res *sql.Rows
 	res, err = s.IterateAllStmt.Query()
 	gotils.CheckNotFatal(err)
@@ -314,6 +1061,12 @@ func (s *StoreSqlite) IterateAll(
 
 // GetValue get the value for the given k
 func (s *StoreSqlite) GetValue(k string) *string {
+	err := s.inUpdate()
+	gotils.CheckNotFatal(err)
+	if err != nil {
+		return nil
+	}
+
 	res, err := s.GetStmt.Query(k)
 	gotils.CheckNotFatal(err)
 	if err != nil {
@@ -336,6 +1089,11 @@ func (s *StoreSqlite) GetValue(k string) *string {
 
 // GetValueAsJSON get the value for the given k into o
 func (s *StoreSqlite) GetValueAsJSON(k string, o interface{}) error {
+	err := s.inUpdate()
+	if err != nil {
+		return err
+	}
+
 	res, err := s.GetStmt.Query(k)
 	gotils.CheckNotFatal(err)
 	if err != nil {
@@ -369,9 +1127,12 @@ func (s *StoreSqlite) IterateByKeyPrefixASC(
 	keyPrefix string,
 	limit int,
 	block func(k *string, t *string, v *string, stop *bool)) error {
-	var err error
-	var res *sql.Rows
+	err := s.inUpdate()
+	if err != nil {
+		return err
+	}
 
+	var res *sql.Rows
 	res, err = s.IterateByPrefixASC.Query(keyPrefix, limit)
 	gotils.CheckNotFatal(err)
 
@@ -403,9 +1164,12 @@ func (s *StoreSqlite) IterateByKeyPrefixDESC(
 	keyPrefix string,
 	limit int,
 	block func(k *string, t *string, v *string, stop *bool)) error {
-	var err error
-	var res *sql.Rows
+	err := s.inUpdate()
+	if err != nil {
+		return err
+	}
 
+	var res *sql.Rows
 	res, err = s.IterateByPrefixDSC.Query(keyPrefix, limit)
 	gotils.CheckNotFatal(err)
 
@@ -432,6 +1196,722 @@ func (s *StoreSqlite) IterateByKeyPrefixDESC(
 	return err
 }
 
+// IterateByKeyRangeASC traverse the items with begin <= key < end in ASC order,
+// an empty end means no upper bound
+func (s *StoreSqlite) IterateByKeyRangeASC(
+	begin string,
+	end string,
+	limit int,
+	block func(k *string, t *string, v *string, stop *bool)) error {
+	return s.iterateByKeyRange(s.IterateByRangeASC, begin, end, limit, block)
+}
+
+// IterateByKeyRangeDESC traverse the items with begin <= key < end in DESC order,
+// an empty end means no upper bound
+func (s *StoreSqlite) IterateByKeyRangeDESC(
+	begin string,
+	end string,
+	limit int,
+	block func(k *string, t *string, v *string, stop *bool)) error {
+	return s.iterateByKeyRange(s.IterateByRangeDSC, begin, end, limit, block)
+}
+
+// GetFields get the JSON object with the fields paths of the value of k, extracted by
+// the database: {"name": "ann", "address.city": "Paris"}. Missing fields are null,
+// the fields of a value that is not JSON are null. nil if k is not in the store
+func (s *StoreSqlite) GetFields(k string, paths ...string) (*string, error) {
+	err := s.inUpdate()
+	if err != nil {
+		return nil, err
+	}
+	fields, err := projectFields(paths, sqliteQuery{doc: "V"})
+	if err != nil {
+		return nil, err
+	}
+
+	var v string
+	err = s.readDb.QueryRow(
+		fmt.Sprintf(
+			`SELECT %s FROM %s WHERE K = $1`,
+			fields,
+			sqliteQuoteIdentifier(s.TableName),
+		),
+		k,
+	).Scan(&v)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	gotils.CheckNotFatal(err)
+	if err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// IterateFieldsByKeyRangeASC traverse the items with begin <= key < end in ASC order,
+// v is the JSON object with the fields paths of the value (see GetFields)
+func (s *StoreSqlite) IterateFieldsByKeyRangeASC(
+	begin string,
+	end string,
+	limit int,
+	paths []string,
+	block func(k *string, t *string, v *string, stop *bool)) error {
+	return s.iterateFieldsByKeyRange("ASC", begin, end, limit, paths, block)
+}
+
+// IterateFieldsByKeyRangeDESC traverse the items with begin <= key < end in DESC order,
+// v is the JSON object with the fields paths of the value (see GetFields)
+func (s *StoreSqlite) IterateFieldsByKeyRangeDESC(
+	begin string,
+	end string,
+	limit int,
+	paths []string,
+	block func(k *string, t *string, v *string, stop *bool)) error {
+	return s.iterateFieldsByKeyRange("DESC", begin, end, limit, paths, block)
+}
+
+func (s *StoreSqlite) iterateFieldsByKeyRange(
+	direction string,
+	begin string,
+	end string,
+	limit int,
+	paths []string,
+	block func(k *string, t *string, v *string, stop *bool)) error {
+	err := s.inUpdate()
+	if err != nil {
+		return err
+	}
+	fields, err := projectFields(paths, sqliteQuery{doc: "V"})
+	if err != nil {
+		return err
+	}
+
+	stmt, err := s.readDb.Prepare(
+		fmt.Sprintf(
+			`SELECT K, %s, T 
+				FROM %s
+				WHERE K >= $1 COLLATE BINARY
+				AND ($2 = '' OR K < $2 COLLATE BINARY)
+				ORDER BY K COLLATE BINARY %s
+				LIMIT $3`,
+			fields,
+			sqliteQuoteIdentifier(s.TableName),
+			direction,
+		))
+	gotils.CheckNotFatal(err)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	return s.iterateByKeyRange(stmt, begin, end, limit, block)
+}
+
+func (s *StoreSqlite) iterateByKeyRange(
+	stmt *sql.Stmt,
+	begin string,
+	end string,
+	limit int,
+	block func(k *string, t *string, v *string, stop *bool)) error {
+	err := s.inUpdate()
+	if err != nil {
+		return err
+	}
+
+	var res *sql.Rows
+	res, err = stmt.Query(begin, end, limit)
+	gotils.CheckNotFatal(err)
+
+	if err != nil {
+		return err
+	}
+
+	defer res.Close()
+	stop := false
+	for res.Next() && false == stop {
+		var k string
+		var v string
+		var t string
+		err = res.Scan(&k, &v, &t)
+		gotils.CheckNotFatal(err)
+
+		if err != nil {
+			break
+		}
+
+		block(&k, &t, &v, &stop)
+	}
+
+	return err
+}
+
+// inUpdate get ErrInUpdate for a call made by the block of an Update of the database,
+// it would wait for the writer connection held by the block
+func (s *StoreSqlite) inUpdate() error {
+	return s.retry.writer.check()
+}
+
+func (s *StoreSqlite) kv() kv {
+	return kv{stmts: s.stmts, retry: s.retry}
+}
+
+// Update run block under a new transaction, the transaction is committed
+// if block returns nil and rolled back otherwise.
+// Writes are serialized: block must use tx, the calls to the stores of the database
+// made by block fail with ErrInUpdate (they would wait for block).
+// block is run again when the transaction fails with a retryable error (see Retry)
+func (s *StoreSqlite) Update(block func(tx *Tx) error) error {
+	return update(s.Db, s.txStmts, s.retry, block)
+}
+
+// DryRun run block like Update but always roll back its transaction: the deletes
+// of block get the number of keys they would delete, nothing is deleted.
+// Get the keys the deletes of tx would delete, in the order of the deletes
+func (s *StoreSqlite) DryRun(block func(tx *Tx) error) ([]string, error) {
+	return dryRun(s.Db, s.txStmts, s.retry, block)
+}
+
+// RetryStats get the retry counters of the store (and of its tables)
+func (s *StoreSqlite) RetryStats() RetryStats {
+	return s.retry.stats()
+}
+
+// InTx get a handle to the transaction tx for this store, tx must be
+// a transaction on another table of the same sqlite database
+func (s *StoreSqlite) InTx(tx *Tx) (*Tx, error) {
+	return tx.in(s.Db, s.txStmts)
+}
+
+// Bucket get a handle to the bucket name
+func (s *StoreSqlite) Bucket(name string) *Bucket {
+	return newBucket(s.kv(), name)
+}
+
+// CreateBucket register the bucket name, creating an existing bucket is a no-op
+func (s *StoreSqlite) CreateBucket(name string) (*Bucket, error) {
+	return createBucket(s.kv(), name)
+}
+
+// DropBucket delete all the data of the bucket name and unregister it
+func (s *StoreSqlite) DropBucket(name string) error {
+	return s.Update(func(tx *Tx) error {
+		return tx.DropBucket(name)
+	})
+}
+
+// ListBuckets list the names of all the registered buckets in ASC order
+func (s *StoreSqlite) ListBuckets() ([]string, error) {
+	return listBuckets(s.kv())
+}
+
+// BulkLoad write all the entries of it (replacing existing keys) in a single transaction
+// reusing the insert statement, progress (when not nil) is called with the number
+// of entries written so far. Nothing is written if it fails or ctx is done
+func (s *StoreSqlite) BulkLoad(
+	ctx context.Context,
+	it EntryIterator,
+	progress func(loaded int64)) (int64, error) {
+	err := s.inUpdate()
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := s.Db.BeginTx(ctx, nil)
+	gotils.CheckNotFatal(err)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	stmt := tx.Stmt(s.InsertStmt)
+	defer stmt.Close()
+
+	loaded, err := loadEntries(ctx, it, progress, func(e Entry) error {
+		_, err := stmt.Exec(e.Key, e.Value, e.Tag)
+		return err
+	})
+	// a load committed before ctx is done is reported as loaded
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	gotils.CheckNotFatal(err)
+	if err != nil {
+		return 0, err
+	}
+	return loaded, nil
+}
+
+// Patch atomically apply a JSON patch (RFC 6902) or a JSON merge patch (RFC 7386) to the
+// value of k, get the new value, nil if k is not in the store (see ErrPatchFailed)
+func (s *StoreSqlite) Patch(k string, patch string) (*string, error) {
+	args := []interface{}{k}
+	expression, conditions, err := compilePatch(patch, "V", sqliteQuery{}, &args)
+	if err != nil {
+		return nil, err
+	}
+	conditions = append([]string{"1 = 1"}, conditions...)
+
+	// the JSON functions fail on the values that are not JSON
+	query := fmt.Sprintf(
+		`UPDATE %s 
+			SET V = %s 
+			WHERE K = ? 
+			AND CASE WHEN json_valid(V) THEN (%s) ELSE 0 END 
+			RETURNING V`,
+		sqliteQuoteIdentifier(s.TableName),
+		expression,
+		strings.Join(conditions, " AND "),
+	)
+
+	var v string
+	err = s.retry.do(func() error {
+		return s.Db.QueryRow(query, args...).Scan(&v)
+	})
+	if err == sql.ErrNoRows {
+		if s.GetValue(k) == nil {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("%w: %q", ErrPatchFailed, k)
+	}
+	gotils.CheckNotFatal(err)
+	if err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// Incr atomically add delta to the counter k (a missing k counts from 0), get the new value
+func (s *StoreSqlite) Incr(k string, delta int64) (int64, error) {
+	return s.kv().incr(k, delta)
+}
+
+// Decr atomically subtract delta from the counter k (a missing k counts from 0), get the new value
+func (s *StoreSqlite) Decr(k string, delta int64) (int64, error) {
+	return s.kv().incr(k, -delta)
+}
+
+// ShardedCounter get the counter k spread over shards rows
+func (s *StoreSqlite) ShardedCounter(k string, shards int) *ShardedCounter {
+	return newShardedCounter(s.kv(), k, shards)
+}
+
+// Lock take the lock name for ttl, waiting for it until ctx is done.
+// The holder should Renew it before it expires and Unlock it when done
+func (s *StoreSqlite) Lock(ctx context.Context, name string, ttl time.Duration) (*Lock, error) {
+	return lock(ctx, s.kv(), name, ttl)
+}
+
+// TryLock take the lock name for ttl, fails with ErrLockHeld if it's held by another owner
+func (s *StoreSqlite) TryLock(name string, ttl time.Duration) (*Lock, error) {
+	return tryLock(s.kv(), name, ttl)
+}
+
+// Queue get a handle to the work queue name, the zero fields of options are taken from DefaultQueueOptions
+func (s *StoreSqlite) Queue(name string, options QueueOptions) *Queue {
+	return newQueue(s.kv(), s.Update, name, options)
+}
+
+// Retention get a retention of the generations (the tags) of the store, see RetentionPolicy
+func (s *StoreSqlite) Retention(policy RetentionPolicy) (*Retention, error) {
+	return newRetention(s.Update, s.DryRun, s.logger, policy)
+}
+
+// sqliteIndexExpression the text of the field path of the values,
+// as the text of the field in postgres (V #>> path)
+func sqliteIndexExpression(path string) string {
+	return fmt.Sprintf(
+		`(CASE WHEN json_valid(V) THEN 
+			CASE json_type(V, '$.%[1]s') 
+				WHEN 'true' THEN 'true' 
+				WHEN 'false' THEN 'false' 
+				ELSE CAST(json_extract(V, '$.%[1]s') AS TEXT) 
+			END 
+		END)`,
+		path,
+	)
+}
+
+// CreateIndex create the secondary index on a JSON field of the values if it's missing.
+// Creating a unique index fails if two keys already have the same field
+func (s *StoreSqlite) CreateIndex(index Index) error {
+	err := s.inUpdate()
+	if err != nil {
+		return err
+	}
+	err = index.validate()
+	if err != nil {
+		return err
+	}
+
+	unique := ""
+	if index.Unique {
+		unique = "UNIQUE"
+	}
+	expression := sqliteIndexExpression(index.Path)
+	_, err = s.Db.Exec(fmt.Sprintf(
+		`CREATE %s INDEX IF NOT EXISTS %s 
+			ON %s %s`,
+		unique,
+		sqliteQuoteIdentifier(s.TableName+"_i_"+index.Name),
+		sqliteQuoteIdentifier(s.TableName),
+		expression,
+	))
+	gotils.CheckNotFatal(err)
+	if err != nil {
+		return err
+	}
+
+	stmt, err := s.readDb.Prepare(fmt.Sprintf(
+		`SELECT K, V, T 
+			FROM %s 
+			WHERE %s = ? 
+			AND substr(K, 1, 1) <> char(1) 
+			ORDER BY K`,
+		sqliteQuoteIdentifier(s.TableName),
+		expression,
+	))
+	gotils.CheckNotFatal(err)
+	if err != nil {
+		return err
+	}
+	s.indexes.add(index.Name, stmt)
+	return nil
+}
+
+// DropIndex drop the secondary index name
+func (s *StoreSqlite) DropIndex(name string) error {
+	err := s.inUpdate()
+	if err != nil {
+		return err
+	}
+	err = Index{Name: name, Path: name}.validate()
+	if err != nil {
+		return err
+	}
+
+	s.indexes.remove(name)
+	_, err = s.Db.Exec(fmt.Sprintf(
+		`DROP INDEX IF EXISTS %s`,
+		sqliteQuoteIdentifier(s.TableName+"_i_"+name),
+	))
+	gotils.CheckNotFatal(err)
+	return err
+}
+
+// FindBy get the entries whose field of the index name is value, in key order.
+// The keys of buckets, locks and queues are skipped
+func (s *StoreSqlite) FindBy(name string, value string) ([]Entry, error) {
+	err := s.inUpdate()
+	if err != nil {
+		return nil, err
+	}
+
+	return s.indexes.findBy(name, value)
+}
+
+// sqliteSearchBody the text indexed for a value: the strings of a JSON value, the whole text of the others
+func sqliteSearchBody(v string) string {
+	return fmt.Sprintf(
+		`(CASE WHEN json_valid(%[1]s) THEN 
+			(SELECT group_concat(value, ' ') FROM json_tree(%[1]s) WHERE type = 'text') 
+			ELSE %[1]s 
+		END)`,
+		v,
+	)
+}
+
+// EnableSearch create the full text index of the values if it's missing,
+// it's kept up to date by triggers. The existing values are indexed in a
+// single transaction. It needs sqlite built with fts5 (the sqlite_fts5 build tag)
+func (s *StoreSqlite) EnableSearch() error {
+	table := sqliteQuoteIdentifier(s.TableName)
+	fts := sqliteQuoteIdentifier(s.TableName + "_fts")
+	// the ids of the keys in the full text index, the rowids of the table change on VACUUM
+	ids := sqliteQuoteIdentifier(s.TableName + "_fts_ids")
+
+	err := s.retry.do(func() error {
+		tx, err := s.Db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		n := 0
+		err = tx.QueryRow(
+			`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?`,
+			s.TableName+"_fts",
+		).Scan(&n)
+		if err != nil || n > 0 {
+			return err
+		}
+
+		for _, statement := range []string{
+			fmt.Sprintf(`CREATE VIRTUAL TABLE %s USING fts5(body, tokenize = 'unicode61 remove_diacritics 0')`, fts),
+			fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (id INTEGER PRIMARY KEY, K text NOT NULL UNIQUE)`, ids),
+			fmt.Sprintf(`DELETE FROM %s`, ids),
+			fmt.Sprintf(`INSERT INTO %s (K) SELECT K FROM %s`, ids, table),
+			fmt.Sprintf(
+				`INSERT INTO %s (rowid, body) 
+					SELECT i.id, %s FROM %s t JOIN %s i ON i.K = t.K`,
+				fts, sqliteSearchBody("t.V"), table, ids,
+			),
+			fmt.Sprintf(
+				`CREATE TRIGGER IF NOT EXISTS %s AFTER INSERT ON %s BEGIN 
+					INSERT INTO %s (K) VALUES (new.K); 
+					INSERT INTO %s (rowid, body) VALUES ((SELECT id FROM %s WHERE K = new.K), %s); 
+				END`,
+				sqliteQuoteIdentifier(s.TableName+"_fts_ai"), table, ids, fts, ids, sqliteSearchBody("new.V"),
+			),
+			fmt.Sprintf(
+				`CREATE TRIGGER IF NOT EXISTS %s AFTER UPDATE OF V ON %s BEGIN 
+					UPDATE %s SET body = %s WHERE rowid = (SELECT id FROM %s WHERE K = old.K); 
+				END`,
+				sqliteQuoteIdentifier(s.TableName+"_fts_au"), table, fts, sqliteSearchBody("new.V"), ids,
+			),
+			fmt.Sprintf(
+				`CREATE TRIGGER IF NOT EXISTS %s AFTER DELETE ON %s BEGIN 
+					DELETE FROM %s WHERE rowid = (SELECT id FROM %s WHERE K = old.K); 
+					DELETE FROM %s WHERE K = old.K; 
+				END`,
+				sqliteQuoteIdentifier(s.TableName+"_fts_ad"), table, fts, ids, ids,
+			),
+		} {
+			_, err = tx.Exec(statement)
+			if err != nil {
+				return err
+			}
+		}
+		return tx.Commit()
+	})
+	if err != nil && strings.Contains(err.Error(), "no such module: fts5") {
+		err = fmt.Errorf("gokvstore: full text search needs sqlite with fts5, build with -tags sqlite_fts5: %w", err)
+	}
+	gotils.CheckNotFatal(err)
+	if err != nil {
+		return err
+	}
+
+	stmt, err := s.readDb.Prepare(fmt.Sprintf(
+		`SELECT i.K, -bm25(%[1]s) 
+			FROM %[1]s JOIN %[2]s i ON i.id = %[1]s.rowid 
+			WHERE %[1]s MATCH ? 
+			ORDER BY bm25(%[1]s), i.K 
+			LIMIT ?`,
+		fts,
+		ids,
+	))
+	gotils.CheckNotFatal(err)
+	if err != nil {
+		return err
+	}
+	s.indexes.setSearch(stmt)
+	return nil
+}
+
+// Search get up to limit keys whose values have all the words of query,
+// the best matches first. Zero means no limit
+func (s *StoreSqlite) Search(query string, limit int) ([]SearchResult, error) {
+	err := s.inUpdate()
+	if err != nil {
+		return nil, err
+	}
+
+	words := searchWords(query)
+	// every word is a string of the fts5 query syntax
+	for i, word := range words {
+		words[i] = `"` + strings.Replace(word, `"`, `""`, -1) + `"`
+	}
+	return search(s.indexes.searchStmt(), strings.Join(words, " "), limit)
+}
+
+// sqliteQuery compiles queries to the JSON1 functions, doc is the JSON value
+type sqliteQuery struct {
+	doc string
+}
+
+func (sqliteQuery) path(path []string) string {
+	if len(path) == 0 {
+		return "'$'"
+	}
+	return "'$." + strings.Join(path, ".") + "'"
+}
+
+func (d sqliteQuery) exists(path []string) string {
+	return fmt.Sprintf(`json_type(%s, %s) IS NOT NULL`, d.doc, d.path(path))
+}
+
+// match the JSON value of type t and SQL value v is s
+func (sqliteQuery) match(t string, v string, op string, s jsonScalar, args *[]interface{}) string {
+	switch s.kind {
+	case "number":
+		*args = append(*args, s.number())
+		return fmt.Sprintf(`(%s IN ('integer', 'real') AND %s %s ?)`, t, v, op)
+	case "string":
+		*args = append(*args, s.text)
+		return fmt.Sprintf(`(%s = 'text' AND %s %s ?)`, t, v, op)
+	case "boolean":
+		return fmt.Sprintf(`%s = '%s'`, t, s.text)
+	}
+	return fmt.Sprintf(`%s = 'null'`, t)
+}
+
+func (d sqliteQuery) compare(path []string, op string, s jsonScalar, args *[]interface{}) string {
+	p := d.path(path)
+	return d.match("json_type("+d.doc+", "+p+")", "json_extract("+d.doc+", "+p+")", op, s, args)
+}
+
+func (d sqliteQuery) contains(path []string, s jsonScalar, args *[]interface{}) string {
+	p := d.path(path)
+	return fmt.Sprintf(
+		`(json_type(%[1]s, %[2]s) = 'array' AND EXISTS (SELECT 1 FROM json_each(%[1]s, %[2]s) AS e WHERE %[3]s))`,
+		d.doc,
+		p,
+		d.match("e.type", "e.value", "=", s, args),
+	)
+}
+
+func (d sqliteQuery) orderBy(path []string) []string {
+	p := d.path(path)
+	return []string{
+		fmt.Sprintf(`CASE json_type(%s, %s) WHEN 'integer' THEN 0 WHEN 'real' THEN 0 WHEN 'text' THEN 1 ELSE 2 END`, d.doc, p),
+		fmt.Sprintf(`CASE WHEN json_type(%[2]s, %[1]s) IN ('integer', 'real') THEN json_extract(%[2]s, %[1]s) END`, p, d.doc),
+		fmt.Sprintf(`CASE WHEN json_type(%[2]s, %[1]s) = 'text' THEN json_extract(%[2]s, %[1]s) END`, p, d.doc),
+	}
+}
+
+func (d sqliteQuery) project(names []string, paths [][]string) string {
+	members := []string{}
+	for i, name := range names {
+		members = append(members, fmt.Sprintf(`%s, json(%s -> %s)`, sqlQuote(name), d.doc, d.path(paths[i])))
+	}
+	return fmt.Sprintf(
+		`CASE WHEN json_valid(%s) THEN json_object(%s) ELSE 'null' END`,
+		d.doc,
+		strings.Join(members, ", "),
+	)
+}
+
+func (sqliteQuery) at(doc string) queryDialect {
+	return sqliteQuery{doc: doc}
+}
+
+func (d sqliteQuery) isObject(doc string, path []string) string {
+	return fmt.Sprintf(`json_type(%s, %s) = 'object'`, doc, d.path(path))
+}
+
+func (d sqliteQuery) set(doc string, path []string, value string) string {
+	return fmt.Sprintf(`json_set(%s, %s, json(%s))`, doc, d.path(path), sqlQuote(value))
+}
+
+func (d sqliteQuery) remove(doc string, path []string) string {
+	return fmt.Sprintf(`json_remove(%s, %s)`, doc, d.path(path))
+}
+
+func (sqliteQuery) mergePatch(doc string, patch interface{}) string {
+	b, _ := json.Marshal(patch)
+	return fmt.Sprintf(`json_patch(%s, %s)`, doc, sqlQuote(string(b)))
+}
+
+// Find get the entries whose JSON values match q, in the order of q and then in key order.
+// Values that are not JSON and the keys of buckets, locks and queues never match
+func (s *StoreSqlite) Find(q *Query) ([]Entry, error) {
+	err := s.inUpdate()
+	if err != nil {
+		return nil, err
+	}
+
+	args := []interface{}{}
+	d := sqliteQuery{doc: "V"}
+	where, order, err := compileQuery(q, d, &args)
+	if err != nil {
+		return nil, err
+	}
+	value := "V"
+	if q.fields != nil {
+		value, err = projectFields(q.fields, d)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if order != "" {
+		order += ", "
+	}
+
+	// the JSON functions fail on the values that are not JSON
+	res, err := s.readDb.Query(
+		fmt.Sprintf(
+			`SELECT K, %s, T 
+				FROM %s 
+				WHERE CASE WHEN json_valid(V) THEN (%s) ELSE 0 END 
+				AND substr(K, 1, 1) <> char(1) 
+				ORDER BY %sK 
+				LIMIT %d`,
+			value,
+			sqliteQuoteIdentifier(s.TableName),
+			where,
+			order,
+			q.sqlLimit(),
+		),
+		args...)
+	gotils.CheckNotFatal(err)
+	if err != nil {
+		return nil, err
+	}
+	return scanEntries(res)
+}
+
+// Snapshot take a consistent read only view of the store (a read transaction),
+// release it with Release or by ending ctx. In WAL mode the writes go on, but the WAL
+// can't be checkpointed past the snapshot. On an in memory db it blocks the writes
+func (s *StoreSqlite) Snapshot(ctx context.Context) (*Snapshot, error) {
+	err := s.inUpdate()
+	if err != nil {
+		return nil, err
+	}
+
+	// a deferred transaction takes its view on the first read of the db
+	return newSnapshot(ctx, s.readDb, nil, `SELECT COUNT(*) FROM sqlite_master`, s.stmts, s.CountAllStmt)
+}
+
+// Export write all the entries of the store to w as JSON Lines in key order,
+// from a consistent snapshot of the store
+func (s *StoreSqlite) Export(w io.Writer) (int64, error) {
+	err := s.inUpdate()
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := s.readDb.Begin()
+	gotils.CheckNotFatal(err)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	return exportEntries(kv{stmts: s.stmts, tx: tx}, w)
+}
+
+// Import write all the entries of an export read from r in a single transaction,
+// mode decides what happens to the keys already in the store.
+// Returns the number of entries written, nothing is written if it fails
+func (s *StoreSqlite) Import(r io.Reader, mode ImportMode) (int64, error) {
+	var imported int64
+	// r can't be read twice, the transaction is not retried
+	err := updateOnce(s.Db, s.txStmts, s.retry.writer, func(tx *Tx) error {
+		var err error
+		imported, err = importEntries(tx.kv, r, mode, "")
+		return err
+	})
+	gotils.CheckNotFatal(err)
+	if err != nil {
+		return 0, err
+	}
+	return imported, nil
+}
+
 // Commit execute "COMMIT;" on the sqlite store
 func (s *StoreSqlite) Commit() {
 	s.Db.Exec("COMMIT;")
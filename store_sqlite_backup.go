@@ -0,0 +1,174 @@
+package gokvstore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/korovkin/gotils"
+	"github.com/mattn/go-sqlite3"
+)
+
+// ErrInvalidBackup is returned by Restore for a file that is not a sound backup of the store
+var ErrInvalidBackup = errors.New("gokvstore: not a valid backup of the store")
+
+// Backup write a consistent copy of the whole sqlite db to destPath (replacing it).
+// The copy is made with VACUUM INTO from a read transaction, in WAL mode
+// the writes go on while it runs. Nothing is written to destPath if it fails or ctx is done
+func (s *StoreSqlite) Backup(ctx context.Context, destPath string) error {
+	now := time.Now()
+
+	// every connection to an in memory db is a different db
+	db := s.Db
+	if s.readDb != s.Db {
+		var err error
+		db, err = sql.Open("sqlite3", s.options.backupDsn())
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+	}
+
+	tmpPath := destPath + ".tmp"
+	os.Remove(tmpPath)
+	_, err := db.ExecContext(ctx, `VACUUM INTO $1`, tmpPath)
+	if err == nil {
+		err = syncFile(tmpPath)
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, destPath)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	s.logger.Println("STORE: Backup:", s.Filename, "to:", destPath, "dt:", time.Since(now))
+	return nil
+}
+
+// syncFile flush the content of the file at path to the disk
+func syncFile(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// BackupEvery back the store up every interval until ctx is done,
+// destPath names the backup taken at now
+func (s *StoreSqlite) BackupEvery(ctx context.Context, interval time.Duration, destPath func(now time.Time) string) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			err := s.Backup(ctx, destPath(now))
+			if err != nil && ctx.Err() == nil {
+				s.logger.Println("STORE: Backup: error:", err)
+			}
+		}
+	}
+}
+
+// Restore replace the content of the whole sqlite db with the backup at srcPath.
+// The backup is checked first and copied in a single write transaction:
+// readers see either the old or the restored content, the writes wait for it.
+// Stores opened with Table share the restored db
+func (s *StoreSqlite) Restore(srcPath string) error {
+	now := time.Now()
+	ctx := context.Background()
+
+	// opening a missing file would create an empty db
+	_, err := os.Stat(srcPath)
+	if err != nil {
+		return err
+	}
+
+	src, err := sql.Open("sqlite3", withQuery(srcPath, "_query_only=true"))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	err = checkBackup(src, s.TableName)
+	if err != nil {
+		return err
+	}
+
+	srcConn, err := src.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer srcConn.Close()
+
+	dstConn, err := s.Db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer dstConn.Close()
+
+	err = dstConn.Raw(func(dst interface{}) error {
+		return srcConn.Raw(func(src interface{}) error {
+			backup, err := dst.(*sqlite3.SQLiteConn).Backup("main", src.(*sqlite3.SQLiteConn), "main")
+			if err != nil {
+				return err
+			}
+			_, err = backup.Step(-1)
+			if finishErr := backup.Finish(); err == nil {
+				err = finishErr
+			}
+			return err
+		})
+	})
+	gotils.CheckNotFatal(err)
+	if err != nil {
+		return err
+	}
+	dstConn.Close()
+
+	// the backup may be from an older version of the library
+	err = migrate(s.Db, s.TableName, sqliteMigrations(s.TableName, s.options), s.logger)
+	if err != nil {
+		return err
+	}
+
+	s.logger.Println("STORE: Restore:", s.Filename, "from:", srcPath, "dt:", time.Since(now))
+	return nil
+}
+
+// checkBackup check that db is a sound sqlite db with the store table
+func checkBackup(db *sql.DB, table string) error {
+	var result string
+	err := db.QueryRow(`PRAGMA quick_check`).Scan(&result)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidBackup, err)
+	}
+	if result != "ok" {
+		return fmt.Errorf("%w: %s", ErrInvalidBackup, result)
+	}
+
+	var tables int
+	err = db.QueryRow(
+		`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = $1`,
+		table,
+	).Scan(&tables)
+	if err != nil {
+		return err
+	}
+	if tables == 0 {
+		return fmt.Errorf("%w: no table %s", ErrInvalidBackup, table)
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package gokvstore_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/korovkin/gokvstore"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestSqliteBackup(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	dir, err := os.MkdirTemp("", "gokvstore_backup")
+	g.Expect(err).To(BeNil())
+	defer os.RemoveAll(dir)
+
+	s, err := gokvstore.NewStoreSqlite("kv_test_backup", dir)
+	g.Expect(err).To(BeNil())
+	defer s.Close()
+
+	for i := 0; i < 1000; i++ {
+		g.Expect(s.AddValueKVT(fmt.Sprintf("k%04d", i), "1", "t")).To(BeNil())
+	}
+
+	// writes go on during the backup
+	stop := make(chan struct{})
+	started := make(chan struct{})
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	writes := 0
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			g.Expect(s.AddValueKVT(fmt.Sprintf("w%06d", writes), "2", "t")).To(BeNil())
+			writes++
+			if writes == 1 {
+				close(started)
+			}
+		}
+	}()
+	<-started
+
+	backupPath := filepath.Join(dir, "backup.db")
+	g.Expect(s.Backup(context.Background(), backupPath)).To(BeNil())
+	close(stop)
+	wg.Wait()
+	g.Expect(writes).To(BeNumerically(">", 0))
+
+	// the backup is a store
+	b, err := gokvstore.NewStoreSqliteWithOptions(gokvstore.SqliteOptions{Filename: backupPath})
+	g.Expect(err).To(BeNil())
+	count, min, _ := b.CountAll()
+	b.Close()
+	g.Expect(count).To(BeNumerically(">=", 1000))
+	g.Expect(min).To(Equal("k0000"))
+	backupCount := count
+
+	// a done ctx doesn't touch the destination
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = s.Backup(ctx, filepath.Join(dir, "canceled.db"))
+	g.Expect(err).ToNot(BeNil())
+	_, err = os.Stat(filepath.Join(dir, "canceled.db"))
+	g.Expect(os.IsNotExist(err)).To(BeTrue())
+
+	// restore
+	g.Expect(s.DeleteValue("k0000")).To(BeEquivalentTo(1))
+	g.Expect(s.AddValueKVT("after", "3", "t")).To(BeNil())
+	g.Expect(s.Restore(backupPath)).To(BeNil())
+
+	count, min, _ = s.CountAll()
+	g.Expect(count).To(Equal(backupCount))
+	g.Expect(min).To(Equal("k0000"))
+	g.Expect(s.GetValue("after")).To(BeNil())
+	g.Expect(s.AddValueKVT("after", "3", "t")).To(BeNil())
+	g.Expect(*s.GetValue("after")).To(Equal("3"))
+
+	// a broken backup is refused and the store is untouched
+	brokenPath := filepath.Join(dir, "broken.db")
+	g.Expect(os.WriteFile(brokenPath, []byte("not a sqlite db, not a sqlite db, not a sqlite db"), 0644)).To(BeNil())
+	err = s.Restore(brokenPath)
+	g.Expect(errors.Is(err, gokvstore.ErrInvalidBackup)).To(BeTrue())
+
+	otherPath := filepath.Join(dir, "other.db")
+	other, err := gokvstore.NewStoreSqliteWithOptions(gokvstore.SqliteOptions{Filename: otherPath, TableName: "other"})
+	g.Expect(err).To(BeNil())
+	other.Close()
+	err = s.Restore(otherPath)
+	g.Expect(errors.Is(err, gokvstore.ErrInvalidBackup)).To(BeTrue())
+
+	err = s.Restore(filepath.Join(dir, "missing.db"))
+	g.Expect(os.IsNotExist(err)).To(BeTrue())
+	_, err = os.Stat(filepath.Join(dir, "missing.db"))
+	g.Expect(os.IsNotExist(err)).To(BeTrue())
+
+	count, _, _ = s.CountAll()
+	g.Expect(count).To(Equal(backupCount + 1))
+}
+
+func TestSqliteBackupEvery(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	dir, err := os.MkdirTemp("", "gokvstore_backup")
+	g.Expect(err).To(BeNil())
+	defer os.RemoveAll(dir)
+
+	s, err := gokvstore.NewStoreSqlite("kv_test_backup_every", dir)
+	g.Expect(err).To(BeNil())
+	defer s.Close()
+	g.Expect(s.AddValueKVT("k", "v", "t")).To(BeNil())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	backups := 0
+	s.BackupEvery(ctx, 20*time.Millisecond, func(now time.Time) string {
+		backups++
+		return filepath.Join(dir, fmt.Sprintf("backup_%d.db", backups%2))
+	})
+
+	g.Expect(backups).To(BeNumerically(">=", 2))
+	for _, name := range []string{"backup_0.db", "backup_1.db"} {
+		_, err = os.Stat(filepath.Join(dir, name))
+		g.Expect(err).To(BeNil())
+	}
+}
@@ -1,10 +1,20 @@
 package gokvstore_test
 
 import (
+	"bufio"
+	"errors"
+	"fmt"
 	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/korovkin/gokvstore"
+	"github.com/korovkin/gokvstore/tuple"
+	"github.com/korovkin/gotils"
 
 	. "github.com/onsi/gomega"
 )
@@ -80,3 +90,422 @@ func TestSqlite(t *testing.T) {
 	g.Expect(err).To(BeNil())
 	g.Expect(list).To(BeEquivalentTo([]string{"kkk", "333", "kk", "33", "k", "3"}))
 }
+
+func TestSqliteKeyRange(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	os.RemoveAll("kv_test_range.db")
+	defer os.RemoveAll("kv_test_range.db")
+
+	s, err := gokvstore.NewStoreSqlite("kv_test_range", ".")
+	g.Expect(err).To(BeNil())
+	defer s.Close()
+
+	for _, e := range []tuple.Tuple{
+		{"user", 1, "order", 10},
+		{"user", 2, "order", 9},
+		{"user", 2, "order", 10},
+		{"user", 2, "order", 100},
+		{"user", 3, "order", 1},
+	} {
+		k, err := e.Pack()
+		g.Expect(err).To(BeNil())
+		err = s.AddValueKV(k, "v")
+		g.Expect(err).To(BeNil())
+	}
+
+	begin, end, err := tuple.Tuple{"user", 2}.Range()
+	g.Expect(err).To(BeNil())
+
+	list := []tuple.Tuple{}
+	err = s.IterateByKeyRangeASC(
+		begin,
+		end,
+		1000,
+		func(k *string, t *string, v *string, stop *bool) {
+			e, err := tuple.Unpack(*k)
+			g.Expect(err).To(BeNil())
+			list = append(list, e)
+		})
+	g.Expect(err).To(BeNil())
+	g.Expect(list).To(Equal([]tuple.Tuple{
+		{"user", int64(2), "order", int64(9)},
+		{"user", int64(2), "order", int64(10)},
+		{"user", int64(2), "order", int64(100)},
+	}))
+
+	list = []tuple.Tuple{}
+	err = s.IterateByKeyRangeDESC(
+		begin,
+		end,
+		2,
+		func(k *string, t *string, v *string, stop *bool) {
+			e, err := tuple.Unpack(*k)
+			g.Expect(err).To(BeNil())
+			list = append(list, e)
+		})
+	g.Expect(err).To(BeNil())
+	g.Expect(list).To(Equal([]tuple.Tuple{
+		{"user", int64(2), "order", int64(100)},
+		{"user", int64(2), "order", int64(10)},
+	}))
+
+	count := 0
+	err = s.IterateByKeyRangeASC(
+		begin,
+		"",
+		1000,
+		func(k *string, t *string, v *string, stop *bool) {
+			count++
+		})
+	g.Expect(err).To(BeNil())
+	g.Expect(count).To(Equal(4))
+}
+
+func TestSqliteTables(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	os.RemoveAll("kv_test_tables.db")
+	defer os.RemoveAll("kv_test_tables.db")
+
+	s, err := gokvstore.NewStoreSqlite("kv_test_tables", ".")
+	g.Expect(err).To(BeNil())
+	defer s.Close()
+
+	users, err := s.Table("users")
+	g.Expect(err).To(BeNil())
+	defer users.Close()
+	g.Expect(users.TableName).To(Equal("kv_users"))
+
+	orders, err := s.Table("orders")
+	g.Expect(err).To(BeNil())
+	defer orders.Close()
+
+	g.Expect(users.AddValueKV("1", "superman")).To(BeNil())
+	g.Expect(orders.AddValueKV("1", "cape")).To(BeNil())
+
+	g.Expect(*users.GetValue("1")).To(Equal("superman"))
+	g.Expect(*orders.GetValue("1")).To(Equal("cape"))
+	g.Expect(s.GetValue("1")).To(BeNil())
+
+	// a single transaction spans the tables
+	errAbort := errors.New("abort")
+	err = users.Update(func(tx *gokvstore.Tx) error {
+		g.Expect(tx.AddValueKV("2", "batman")).To(BeNil())
+		otx, err := orders.InTx(tx)
+		g.Expect(err).To(BeNil())
+		g.Expect(otx.AddValueKV("2", "batmobile")).To(BeNil())
+		return errAbort
+	})
+	g.Expect(err).To(Equal(errAbort))
+	g.Expect(users.GetValue("2")).To(BeNil())
+	g.Expect(orders.GetValue("2")).To(BeNil())
+
+	err = users.Update(func(tx *gokvstore.Tx) error {
+		err := tx.AddValueKV("2", "batman")
+		if err != nil {
+			return err
+		}
+		otx, err := orders.InTx(tx)
+		if err != nil {
+			return err
+		}
+		return otx.AddValueKV("2", "batmobile")
+	})
+	g.Expect(err).To(BeNil())
+	g.Expect(*users.GetValue("2")).To(Equal("batman"))
+	g.Expect(*orders.GetValue("2")).To(Equal("batmobile"))
+
+	os.RemoveAll("kv_test_tables_other.db")
+	defer os.RemoveAll("kv_test_tables_other.db")
+
+	other, err := gokvstore.NewStoreSqlite("kv_test_tables_other", ".")
+	g.Expect(err).To(BeNil())
+	defer other.Close()
+
+	err = users.Update(func(tx *gokvstore.Tx) error {
+		_, err := other.InTx(tx)
+		return err
+	})
+	g.Expect(err).To(Equal(gokvstore.ErrDifferentDatabase))
+
+	// the tables are still there after reopening the file
+	reopened, err := gokvstore.NewStoreSqlite("kv_test_tables", ".")
+	g.Expect(err).To(BeNil())
+	defer reopened.Close()
+
+	reopenedUsers, err := reopened.Table("users")
+	g.Expect(err).To(BeNil())
+	defer reopenedUsers.Close()
+	g.Expect(*reopenedUsers.GetValue("2")).To(Equal("batman"))
+}
+
+func TestSqliteWALDefault(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	os.RemoveAll("kv_test_wal.db")
+	defer os.RemoveAll("kv_test_wal.db")
+
+	s, err := gokvstore.NewStoreSqliteWithOptions(gokvstore.SqliteOptions{
+		Filename:           "kv_test_wal.db",
+		CheckpointInterval: time.Millisecond,
+	})
+	g.Expect(err).To(BeNil())
+	defer s.Close()
+
+	var journalMode string
+	err = s.Db.QueryRow(`PRAGMA journal_mode`).Scan(&journalMode)
+	g.Expect(err).To(BeNil())
+	g.Expect(journalMode).To(Equal("wal"))
+
+	var synchronous int
+	err = s.Db.QueryRow(`PRAGMA synchronous`).Scan(&synchronous)
+	g.Expect(err).To(BeNil())
+	g.Expect(synchronous).To(Equal(1))
+
+	// rollback works with a journal
+	errAbort := errors.New("abort")
+	err = s.Update(func(tx *gokvstore.Tx) error {
+		g.Expect(tx.AddValueKV("k", "v")).To(BeNil())
+		return errAbort
+	})
+	g.Expect(err).To(Equal(errAbort))
+	g.Expect(s.GetValue("k")).To(BeNil())
+
+	g.Expect(s.AddValueKV("k", "v")).To(BeNil())
+	g.Expect(s.Checkpoint("TRUNCATE")).To(BeNil())
+	g.Expect(s.Checkpoint("bogus")).NotTo(BeNil())
+
+	os.RemoveAll("kv_test_unsafe.db")
+	defer os.RemoveAll("kv_test_unsafe.db")
+
+	unsafe, err := gokvstore.NewStoreSqliteWithOptions(gokvstore.SqliteOptions{
+		Filename:   "kv_test_unsafe.db",
+		UnsafeFast: true,
+	})
+	g.Expect(err).To(BeNil())
+	defer unsafe.Close()
+
+	err = unsafe.Db.QueryRow(`PRAGMA journal_mode`).Scan(&journalMode)
+	g.Expect(err).To(BeNil())
+	g.Expect(journalMode).To(Equal("off"))
+}
+
+// crashWriterEnv makes the test binary act as the writer killed by TestSqliteCrashRecovery
+const crashWriterEnv = "GOKVSTORE_CRASH_WRITER"
+
+func crashWriter(filename string) {
+	s, err := gokvstore.NewStoreSqliteWithOptions(gokvstore.SqliteOptions{Filename: filename})
+	gotils.CheckFatal(err)
+
+	err = s.Update(func(tx *gokvstore.Tx) error {
+		for i := 0; i < 1000; i++ {
+			err := tx.AddValueKV(fmt.Sprintf("committed-%04d", i), strings.Repeat("c", 100))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	gotils.CheckFatal(err)
+
+	s.Update(func(tx *gokvstore.Tx) error {
+		// large enough to spill pages of the open transaction to the disk
+		for i := 0; i < 20000; i++ {
+			err := tx.AddValueKV(fmt.Sprintf("uncommitted-%05d", i), strings.Repeat("u", 1000))
+			gotils.CheckFatal(err)
+		}
+		fmt.Println("ready")
+		time.Sleep(time.Hour)
+		return nil
+	})
+}
+
+func TestSqliteCrashRecovery(t *testing.T) {
+	if filename := os.Getenv(crashWriterEnv); filename != "" {
+		crashWriter(filename)
+		return
+	}
+
+	g := NewGomegaWithT(t)
+
+	filename := "kv_test_crash.db"
+	removeAll := func() {
+		for _, suffix := range []string{"", "-wal", "-shm", "-journal"} {
+			os.RemoveAll(filename + suffix)
+		}
+	}
+	removeAll()
+	defer removeAll()
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestSqliteCrashRecovery$")
+	cmd.Env = append(os.Environ(), crashWriterEnv+"="+filename)
+	stdout, err := cmd.StdoutPipe()
+	g.Expect(err).To(BeNil())
+	g.Expect(cmd.Start()).To(BeNil())
+
+	// kill the writer in the middle of its transaction
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	g.Expect(err).To(BeNil())
+	g.Expect(line).To(Equal("ready\n"))
+	g.Expect(cmd.Process.Kill()).To(BeNil())
+	cmd.Wait()
+
+	s, err := gokvstore.NewStoreSqliteWithOptions(gokvstore.SqliteOptions{Filename: filename})
+	g.Expect(err).To(BeNil())
+	defer s.Close()
+
+	var integrity string
+	err = s.Db.QueryRow(`PRAGMA integrity_check`).Scan(&integrity)
+	g.Expect(err).To(BeNil())
+	g.Expect(integrity).To(Equal("ok"))
+
+	count, min, max := s.CountAll()
+	g.Expect(count).To(Equal(int64(1000)))
+	g.Expect(min).To(Equal("committed-0000"))
+	g.Expect(max).To(Equal("committed-0999"))
+}
+
+func TestSqliteConcurrency(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	os.RemoveAll("kv_test_concurrency.db")
+	defer os.RemoveAll("kv_test_concurrency.db")
+
+	s, err := gokvstore.NewStoreSqlite("kv_test_concurrency", ".")
+	g.Expect(err).To(BeNil())
+	defer s.Close()
+
+	g.Expect(s.AddValueKV("counter", "0")).To(BeNil())
+
+	workers := 8
+	increments := 25
+	wg := sync.WaitGroup{}
+	errs := make(chan error, 4*workers*increments)
+
+	for w := 0; w < workers; w++ {
+		wg.Add(3)
+
+		// read, modify, write under concurrent transactions
+		go func() {
+			defer wg.Done()
+			for i := 0; i < increments; i++ {
+				errs <- s.Update(func(tx *gokvstore.Tx) error {
+					v, err := tx.GetValue("counter")
+					if err != nil {
+						return err
+					}
+					n, err := strconv.Atoi(*v)
+					if err != nil {
+						return err
+					}
+					return tx.AddValueKV("counter", strconv.Itoa(n+1))
+				})
+			}
+		}()
+
+		// writes outside of transactions
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < increments; i++ {
+				errs <- s.AddValueKV(fmt.Sprintf("w-%d-%d", w, i), "v")
+			}
+		}(w)
+
+		// reads
+		go func() {
+			defer wg.Done()
+			for i := 0; i < increments; i++ {
+				s.GetValue("counter")
+				errs <- s.IterateByKeyRangeASC(
+					"w-",
+					"w.",
+					10,
+					func(k *string, t *string, v *string, stop *bool) {})
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		g.Expect(err).To(BeNil())
+	}
+
+	g.Expect(*s.GetValue("counter")).To(Equal(strconv.Itoa(workers * increments)))
+	count, _, _ := s.CountAll()
+	g.Expect(count).To(Equal(int64(1 + workers*increments)))
+
+	// a write outside of a transaction doesn't join it
+	started := make(chan struct{})
+	errAbort := errors.New("abort")
+	done := make(chan error)
+	go func() {
+		done <- s.Update(func(tx *gokvstore.Tx) error {
+			err := tx.AddValueKV("inside", "v")
+			if err != nil {
+				return err
+			}
+			close(started)
+			time.Sleep(50 * time.Millisecond)
+			return errAbort
+		})
+	}()
+
+	<-started
+	g.Expect(s.AddValueKV("outside", "v")).To(BeNil())
+	g.Expect(<-done).To(Equal(errAbort))
+	g.Expect(s.GetValue("inside")).To(BeNil())
+	g.Expect(s.GetValue("outside")).NotTo(BeNil())
+}
+
+func TestSqliteUpdateReentry(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	os.RemoveAll("kv_test_reentry.db")
+	defer os.RemoveAll("kv_test_reentry.db")
+
+	file, err := gokvstore.NewStoreSqlite("kv_test_reentry", ".")
+	g.Expect(err).To(BeNil())
+	defer file.Close()
+
+	memory, err := gokvstore.NewStoreSqlite("kv_test_reentry", ":memory:")
+	g.Expect(err).To(BeNil())
+	defer memory.Close()
+
+	for _, s := range []*gokvstore.StoreSqlite{file, memory} {
+		g.Expect(s.AddValueKV("k", "v")).To(BeNil())
+		table, err := s.Table("other")
+		g.Expect(err).To(BeNil())
+
+		// the calls to the stores of the database made by the block fail instead of waiting for it
+		done := make(chan error)
+		go func() {
+			done <- s.Update(func(tx *gokvstore.Tx) error {
+				g.Expect(s.AddValueKV("inside", "v")).To(Equal(gokvstore.ErrInUpdate))
+				g.Expect(table.AddValueKV("inside", "v")).To(Equal(gokvstore.ErrInUpdate))
+				g.Expect(s.GetValue("k")).To(BeNil())
+				_, err := s.CountPrefix("")
+				g.Expect(err).To(Equal(gokvstore.ErrInUpdate))
+				_, err = s.DeleteValue("k")
+				g.Expect(err).To(Equal(gokvstore.ErrInUpdate))
+				_, err = s.Find(gokvstore.Where())
+				g.Expect(err).To(Equal(gokvstore.ErrInUpdate))
+				g.Expect(s.Update(func(tx *gokvstore.Tx) error { return nil })).To(Equal(gokvstore.ErrInUpdate))
+				g.Expect(s.Transaction(func(tx *gokvstore.Tx) {})).To(Equal(gokvstore.ErrInUpdate))
+				return tx.AddValueKV("inside", "v")
+			})
+		}()
+
+		select {
+		case err = <-done:
+			g.Expect(err).To(BeNil())
+		case <-time.After(5 * time.Second):
+			t.Fatal("Update waits for itself")
+		}
+
+		// the store works again after the block
+		g.Expect(*s.GetValue("inside")).To(Equal("v"))
+		g.Expect(s.AddValueKV("after", "v")).To(BeNil())
+	}
+}
@@ -0,0 +1,232 @@
+// Package tuple packs typed tuples into order preserving string keys.
+//
+// The packed keys sort (byte-wise) in the same order as the tuples they
+// encode, element by element, so they can be used directly as keys of
+// gokvstore.StoreSqlite and gokvstore.StorePostgres and traversed with the
+// prefix and range iteration APIs:
+//
+//	k, _ := tuple.Pack("user", 42, "order", 7)
+//	s.AddValueKV(k, v)
+//
+//	begin, end, _ := tuple.Tuple{"user", 42}.Range()
+//	s.IterateByKeyRangeASC(begin, end, 100, block)
+//
+// Packed keys are valid UTF-8 and never contain a NUL byte, so they can be
+// stored in Postgres text columns.
+package tuple
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// type codes, their order defines the order between elements of different types
+const (
+	codeBytes  = 'b'
+	codeInt    = 'i'
+	codeString = 's'
+	codeTime   = 't'
+)
+
+const (
+	// terminator ends variable length elements (strings and bytes)
+	terminator = '\x01'
+	// escape prefixes the bytes 0x00, 0x01 and 0x02 inside strings
+	escape = '\x02'
+	// rangeEnd is greater than any type code
+	rangeEnd = '\x7f'
+)
+
+// width of the fixed size elements (int64 and time) in hex digits
+const fixedWidth = 16
+
+// Tuple is an ordered list of elements.
+// Supported element types: string, []byte, all the int and uint types and time.Time
+type Tuple []interface{}
+
+// Pack packs the elements into an order preserving key
+func Pack(elements ...interface{}) (string, error) {
+	return Tuple(elements).Pack()
+}
+
+// Pack packs the tuple into an order preserving key
+func (t Tuple) Pack() (string, error) {
+	var b strings.Builder
+
+	for i, e := range t {
+		switch v := e.(type) {
+		case string:
+			if !utf8.ValidString(v) {
+				return "", fmt.Errorf("tuple: element %d: invalid UTF-8 string", i)
+			}
+			b.WriteByte(codeString)
+			packString(&b, v)
+		case []byte:
+			b.WriteByte(codeBytes)
+			b.WriteString(hex.EncodeToString(v))
+			b.WriteByte(terminator)
+		case time.Time:
+			b.WriteByte(codeTime)
+			packInt(&b, v.UnixNano())
+		default:
+			n, err := toInt64(e)
+			if err != nil {
+				return "", fmt.Errorf("tuple: element %d: %s", i, err)
+			}
+			b.WriteByte(codeInt)
+			packInt(&b, n)
+		}
+	}
+
+	return b.String(), nil
+}
+
+// Range returns the [begin, end) key range of all the keys
+// that start with the tuple t, including the key of t itself
+func (t Tuple) Range() (string, string, error) {
+	begin, err := t.Pack()
+	if err != nil {
+		return "", "", err
+	}
+	return begin, begin + string(rangeEnd), nil
+}
+
+// Unpack unpacks a key created by Pack.
+// Integers are returned as int64, times as time.Time in UTC
+func Unpack(key string) (Tuple, error) {
+	t := Tuple{}
+
+	for i := 0; i < len(key); {
+		code := key[i]
+		i++
+
+		switch code {
+		case codeString:
+			v, n, err := unpackString(key[i:])
+			if err != nil {
+				return nil, err
+			}
+			t = append(t, v)
+			i += n
+		case codeBytes:
+			end := strings.IndexByte(key[i:], terminator)
+			if end < 0 {
+				return nil, fmt.Errorf("tuple: unterminated bytes at %d", i)
+			}
+			v, err := hex.DecodeString(key[i : i+end])
+			if err != nil {
+				return nil, fmt.Errorf("tuple: invalid bytes at %d: %s", i, err)
+			}
+			t = append(t, v)
+			i += end + 1
+		case codeInt, codeTime:
+			if len(key) < i+fixedWidth {
+				return nil, fmt.Errorf("tuple: short integer at %d", i)
+			}
+			n, err := unpackInt(key[i : i+fixedWidth])
+			if err != nil {
+				return nil, fmt.Errorf("tuple: invalid integer at %d: %s", i, err)
+			}
+			if code == codeTime {
+				t = append(t, time.Unix(0, n).UTC())
+			} else {
+				t = append(t, n)
+			}
+			i += fixedWidth
+		default:
+			return nil, fmt.Errorf("tuple: unknown type code %q at %d", code, i-1)
+		}
+	}
+
+	return t, nil
+}
+
+// packString escapes the bytes 0x00, 0x01 and 0x02 so the terminator
+// sorts before any other byte and no NUL byte ends up in the key
+func packString(b *strings.Builder, s string) {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c <= escape {
+			b.WriteByte(escape)
+			b.WriteByte(c + 1)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	b.WriteByte(terminator)
+}
+
+func unpackString(s string) (string, int, error) {
+	var b strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch c {
+		case terminator:
+			return b.String(), i + 1, nil
+		case escape:
+			i++
+			if i >= len(s) || s[i] == 0 || s[i] > escape+1 {
+				return "", 0, fmt.Errorf("tuple: invalid escape in string")
+			}
+			b.WriteByte(s[i] - 1)
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	return "", 0, fmt.Errorf("tuple: unterminated string")
+}
+
+// packInt flips the sign bit so negative numbers sort before positive ones
+func packInt(b *strings.Builder, n int64) {
+	s := strconv.FormatUint(uint64(n)^(1<<63), 16)
+	b.WriteString(strings.Repeat("0", fixedWidth-len(s)))
+	b.WriteString(s)
+}
+
+func unpackInt(s string) (int64, error) {
+	u, err := strconv.ParseUint(s, 16, 64)
+	if err != nil {
+		return 0, err
+	}
+	return int64(u ^ (1 << 63)), nil
+}
+
+func toInt64(e interface{}) (int64, error) {
+	switch v := e.(type) {
+	case int:
+		return int64(v), nil
+	case int8:
+		return int64(v), nil
+	case int16:
+		return int64(v), nil
+	case int32:
+		return int64(v), nil
+	case int64:
+		return v, nil
+	case uint:
+		return uintToInt64(uint64(v))
+	case uint8:
+		return int64(v), nil
+	case uint16:
+		return int64(v), nil
+	case uint32:
+		return int64(v), nil
+	case uint64:
+		return uintToInt64(v)
+	}
+	return 0, fmt.Errorf("unsupported type %T", e)
+}
+
+func uintToInt64(v uint64) (int64, error) {
+	if v > math.MaxInt64 {
+		return 0, fmt.Errorf("integer overflow %d", v)
+	}
+	return int64(v), nil
+}
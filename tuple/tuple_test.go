@@ -0,0 +1,116 @@
+package tuple_test
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/korovkin/gokvstore/tuple"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestPackUnpack(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	now := time.Unix(1500000000, 123456789).UTC()
+	in := tuple.Tuple{"user", 42, "order", int64(-7), []byte{0, 1, 2, 0xff}, "a\x00b\x01c\x02", now, uint8(3), ""}
+
+	k, err := in.Pack()
+	g.Expect(err).To(BeNil())
+	g.Expect(k).NotTo(ContainSubstring("\x00"))
+
+	out, err := tuple.Unpack(k)
+	g.Expect(err).To(BeNil())
+	g.Expect(out).To(Equal(tuple.Tuple{
+		"user", int64(42), "order", int64(-7), []byte{0, 1, 2, 0xff}, "a\x00b\x01c\x02", now, int64(3), ""}))
+
+	_, err = tuple.Pack(3.14)
+	g.Expect(err).NotTo(BeNil())
+
+	_, err = tuple.Pack(uint64(1 << 63))
+	g.Expect(err).NotTo(BeNil())
+
+	_, err = tuple.Pack("\xff")
+	g.Expect(err).NotTo(BeNil())
+
+	_, err = tuple.Unpack("x")
+	g.Expect(err).NotTo(BeNil())
+
+	_, err = tuple.Unpack("sabc")
+	g.Expect(err).NotTo(BeNil())
+
+	_, err = tuple.Unpack("i0001")
+	g.Expect(err).NotTo(BeNil())
+}
+
+func TestOrdering(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	ordered := []tuple.Tuple{
+		{[]byte{}},
+		{[]byte{0}},
+		{[]byte{0, 0}},
+		{[]byte{1}},
+		{-1000},
+		{-1},
+		{0},
+		{7},
+		{10},
+		{1000},
+		{""},
+		{"\x00"},
+		{"\x01"},
+		{"\x02"},
+		{"a"},
+		{"a", -1},
+		{"a", 0},
+		{"a", "b"},
+		{"a\x00"},
+		{"ab"},
+		{"b"},
+		{"é"},
+		{time.Unix(0, 0)},
+		{time.Unix(1, 0)},
+	}
+
+	keys := []string{}
+	for _, e := range ordered {
+		k, err := e.Pack()
+		g.Expect(err).To(BeNil())
+		keys = append(keys, k)
+	}
+
+	g.Expect(sort.StringsAreSorted(keys)).To(BeTrue())
+}
+
+func TestRange(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	begin, end, err := tuple.Tuple{"user", 42}.Range()
+	g.Expect(err).To(BeNil())
+
+	inside := []tuple.Tuple{
+		{"user", 42},
+		{"user", 42, "order", 1},
+		{"user", 42, []byte{0xff}},
+		{"user", 42, "\U0010FFFF"},
+	}
+	for _, e := range inside {
+		k, err := e.Pack()
+		g.Expect(err).To(BeNil())
+		g.Expect(k >= begin && k < end).To(BeTrue())
+	}
+
+	outside := []tuple.Tuple{
+		{"user"},
+		{"user", 41, "order", 1},
+		{"user", 43},
+		{"users", 42},
+	}
+	for _, e := range outside {
+		k, err := e.Pack()
+		g.Expect(err).To(BeNil())
+		g.Expect(k >= begin && k < end).To(BeFalse())
+	}
+}
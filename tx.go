@@ -0,0 +1,456 @@
+package gokvstore
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"math"
+	"unicode/utf8"
+
+	"github.com/korovkin/gotils"
+)
+
+// noLimit is used as the LIMIT of queries that traverse a whole key range
+const noLimit = math.MaxInt32
+
+// kvStmts the prepared statements of a store used by Tx and Bucket,
+// the statements of both backends take the same arguments and return the same columns
+type kvStmts struct {
+	insert          *sql.Stmt
+	insertNew       *sql.Stmt
+	get             *sql.Stmt
+	delete          *sql.Stmt
+	deleteRange     *sql.Stmt
+	deleteTag       *sql.Stmt
+	deleteTagLT     *sql.Stmt
+	deleteTagRange  *sql.Stmt
+	deleteAll       *sql.Stmt
+	countRange      *sql.Stmt
+	iterateRangeASC *sql.Stmt
+	iterateRangeDSC *sql.Stmt
+	incr            *sql.Stmt
+	sumRange        *sql.Stmt
+	lockAcquire     *sql.Stmt
+	lockRenew       *sql.Stmt
+	lockRelease     *sql.Stmt
+	queueEnqueue    *sql.Stmt
+	queueDequeue    *sql.Stmt
+	queueNack       *sql.Stmt
+	queueAck        *sql.Stmt
+	generation      *sql.Stmt
+	deleteOlder     *sql.Stmt
+	keysRange       *sql.Stmt
+	keysTag         *sql.Stmt
+	keysTagLT       *sql.Stmt
+	keysTagRange    *sql.Stmt
+	keysAll         *sql.Stmt
+}
+
+// kv runs the prepared statements of a store, directly or under a transaction,
+// direct writes are retried by retry
+type kv struct {
+	stmts    *kvStmts
+	tx       *sql.Tx
+	retry    *retrier
+	readOnly bool
+}
+
+// ErrReadOnly is returned for a write through a read only handle (see Snapshot)
+var ErrReadOnly = errors.New("gokvstore: read only")
+
+// check fail with ErrInUpdate for a read through a store made by the block of its
+// Update, the writes check it when they are retried
+func (c kv) check() error {
+	if c.tx != nil || c.retry == nil {
+		return nil
+	}
+	return c.retry.writer.check()
+}
+
+func (c kv) stmt(stmt *sql.Stmt) *sql.Stmt {
+	if c.tx != nil {
+		return c.tx.Stmt(stmt)
+	}
+	return stmt
+}
+
+// exec run a write statement, a failed transaction is retried as a whole (see update)
+func (c kv) exec(stmt *sql.Stmt, args ...interface{}) error {
+	_, err := c.execCount(stmt, args...)
+	return err
+}
+
+// execCount run a write statement, get the number of rows it changed
+func (c kv) execCount(stmt *sql.Stmt, args ...interface{}) (int64, error) {
+	if c.readOnly {
+		return 0, ErrReadOnly
+	}
+
+	var n int64
+	op := func() error {
+		res, err := c.stmt(stmt).Exec(args...)
+		if err != nil {
+			return err
+		}
+		n, err = res.RowsAffected()
+		return err
+	}
+
+	var err error
+	if c.tx == nil {
+		err = c.retry.do(op)
+	} else {
+		err = op()
+	}
+	gotils.CheckNotFatal(err)
+	return n, err
+}
+
+func (c kv) addValueKVT(k string, v string, t string) error {
+	return c.exec(c.stmts.insert, k, v, t)
+}
+
+func (c kv) addValueAsJSON(k string, t string, o interface{}) error {
+	b, err := json.Marshal(o)
+	gotils.CheckNotFatal(err)
+	if err != nil {
+		return err
+	}
+	return c.addValueKVT(k, string(b), t)
+}
+
+func (c kv) getValue(k string) (*string, error) {
+	err := c.check()
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := c.stmt(c.stmts.get).Query(k)
+	gotils.CheckNotFatal(err)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+
+	for res.Next() {
+		var k string
+		var v string
+		var t string
+		err = res.Scan(&k, &v, &t)
+		gotils.CheckNotFatal(err)
+		if err != nil {
+			return nil, err
+		}
+		return &v, nil
+	}
+	return nil, res.Err()
+}
+
+func (c kv) getValueAsJSON(k string, o interface{}) error {
+	v, err := c.getValue(k)
+	if err != nil || v == nil {
+		return err
+	}
+	err = json.Unmarshal([]byte(*v), o)
+	gotils.CheckNotFatal(err)
+	return err
+}
+
+func (c kv) deleteValue(k string) (int64, error) {
+	return c.execCount(c.stmts.delete, k)
+}
+
+// deleteRange delete the keys with begin <= key < end, but the keys of buckets, locks and queues
+func (c kv) deleteRange(begin string, end string) (int64, error) {
+	return c.execCount(c.stmts.deleteRange, begin, end, false)
+}
+
+// deleteInternalRange delete the keys with begin <= key < end, the keys of buckets too
+func (c kv) deleteInternalRange(begin string, end string) (int64, error) {
+	return c.execCount(c.stmts.deleteRange, begin, end, true)
+}
+
+func (c kv) countRange(begin string, end string) (int64, error) {
+	err := c.check()
+	if err != nil {
+		return 0, err
+	}
+
+	var n int64
+	err = c.stmt(c.stmts.countRange).QueryRow(begin, end).Scan(&n)
+	gotils.CheckNotFatal(err)
+	return n, err
+}
+
+// prefixEnd the smallest key greater than all the keys with prefix,
+// empty (no upper bound) when there's none
+func prefixEnd(prefix string) string {
+	for i := len(prefix); i > 0; {
+		r, size := utf8.DecodeLastRuneInString(prefix[:i])
+		i -= size
+		switch {
+		case r == utf8.RuneError && size == 1:
+			// not UTF-8, the keys compare byte by byte
+			if prefix[i] < 0xff {
+				return prefix[:i] + string([]byte{prefix[i] + 1})
+			}
+		case r == 0xd7ff:
+			// skip the surrogates, they are not valid in UTF-8
+			return prefix[:i] + string(rune(0xe000))
+		case r < utf8.MaxRune:
+			return prefix[:i] + string(r+1)
+		}
+	}
+	return ""
+}
+
+func (c kv) iterateByKeyRange(
+	desc bool,
+	begin string,
+	end string,
+	limit int,
+	block func(k *string, t *string, v *string, stop *bool)) error {
+	err := c.check()
+	if err != nil {
+		return err
+	}
+
+	stmt := c.stmts.iterateRangeASC
+	if desc {
+		stmt = c.stmts.iterateRangeDSC
+	}
+
+	res, err := c.stmt(stmt).Query(begin, end, limit)
+	gotils.CheckNotFatal(err)
+	if err != nil {
+		return err
+	}
+	defer res.Close()
+
+	stop := false
+	for res.Next() && false == stop {
+		var k string
+		var v string
+		var t string
+		err = res.Scan(&k, &v, &t)
+		gotils.CheckNotFatal(err)
+		if err != nil {
+			break
+		}
+
+		block(&k, &t, &v, &stop)
+	}
+
+	return err
+}
+
+// ErrDifferentDatabase is returned when a transaction is used with a store of another database
+var ErrDifferentDatabase = errors.New("gokvstore: the transaction belongs to a different database")
+
+// Tx is a transaction on a store, see StoreSqlite.Update and StorePostgres.Update
+type Tx struct {
+	kv
+	db *sql.DB
+	// deleted the keys deleted by the deletes of a dry run, nil outside of dry runs
+	deleted *[]string
+}
+
+// in get a handle to the same transaction with the statements of another store
+func (tx *Tx) in(db *sql.DB, stmts *kvStmts) (*Tx, error) {
+	if db != tx.db {
+		return nil, ErrDifferentDatabase
+	}
+	return &Tx{kv: kv{stmts: stmts, tx: tx.tx}, db: db, deleted: tx.deleted}, nil
+}
+
+// deleteKeys run the delete stmt, a dry run first gets the keys it deletes with keys
+// (the same predicate and args)
+func (tx *Tx) deleteKeys(keys *sql.Stmt, stmt *sql.Stmt, args ...interface{}) (int64, error) {
+	if tx.deleted != nil {
+		res, err := tx.stmt(keys).Query(args...)
+		gotils.CheckNotFatal(err)
+		if err != nil {
+			return 0, err
+		}
+		defer res.Close()
+
+		for res.Next() {
+			var k string
+			err = res.Scan(&k)
+			gotils.CheckNotFatal(err)
+			if err != nil {
+				return 0, err
+			}
+			*tx.deleted = append(*tx.deleted, k)
+		}
+		err = res.Err()
+		if err != nil {
+			return 0, err
+		}
+	}
+	return tx.execCount(stmt, args...)
+}
+
+// update runs block under a new transaction,
+// commits if block returns nil and rolls back otherwise.
+// The whole transaction (block included) is replayed on retryable errors
+func update(db *sql.DB, stmts *kvStmts, retry *retrier, block func(tx *Tx) error) error {
+	return retry.do(func() error {
+		return updateOnce(db, stmts, retry.writer, block)
+	})
+}
+
+// errDryRun rolls back the transaction of a dry run
+var errDryRun = errors.New("gokvstore: dry run")
+
+// dryRun runs block under a new transaction that is always rolled back,
+// block sees its own writes and gets the counts of the real run.
+// Get the keys the deletes of block would delete, in the order of the deletes
+func dryRun(db *sql.DB, stmts *kvStmts, retry *retrier, block func(tx *Tx) error) ([]string, error) {
+	var deleted []string
+	err := update(db, stmts, retry, func(tx *Tx) error {
+		deleted = []string{}
+		tx.deleted = &deleted
+		err := block(tx)
+		if err == nil {
+			err = errDryRun
+		}
+		return err
+	})
+	if err == errDryRun {
+		return deleted, nil
+	}
+	return nil, err
+}
+
+// updateOnce runs block under a new transaction, w (when not nil) is held by the block
+func updateOnce(db *sql.DB, stmts *kvStmts, w *writer, block func(tx *Tx) error) error {
+	err := w.check()
+	if err != nil {
+		return err
+	}
+
+	transaction, err := db.Begin()
+	gotils.CheckNotFatal(err)
+	if err != nil {
+		return err
+	}
+
+	committed := false
+	defer func() {
+		if !committed {
+			transaction.Rollback()
+		}
+	}()
+
+	release := w.hold()
+	err = block(&Tx{kv: kv{stmts: stmts, tx: transaction}, db: db})
+	release()
+	if err != nil {
+		return err
+	}
+
+	err = transaction.Commit()
+	gotils.CheckNotFatal(err)
+	committed = err == nil
+	return err
+}
+
+// AddValueKVT add (k,v,t) to the store
+func (tx *Tx) AddValueKVT(k string, v string, t string) error {
+	return tx.addValueKVT(k, v, t)
+}
+
+// AddValueKV add (k,v) to the store
+func (tx *Tx) AddValueKV(k string, v string) error {
+	return tx.addValueKVT(k, v, "")
+}
+
+// AddValueAsJSON add (k, t, json(o)) to the store
+func (tx *Tx) AddValueAsJSON(k string, t string, o interface{}) error {
+	return tx.addValueAsJSON(k, t, o)
+}
+
+// GetValue get the value for the given k, nil if k is not in the store
+func (tx *Tx) GetValue(k string) (*string, error) {
+	return tx.getValue(k)
+}
+
+// GetValueAsJSON get the value for the given k into o
+func (tx *Tx) GetValueAsJSON(k string, o interface{}) error {
+	return tx.getValueAsJSON(k, o)
+}
+
+// DeleteValue delete k from the store, get the number of deleted keys
+func (tx *Tx) DeleteValue(k string) (int64, error) {
+	n, err := tx.deleteValue(k)
+	if tx.deleted != nil && n > 0 {
+		*tx.deleted = append(*tx.deleted, k)
+	}
+	return n, err
+}
+
+// DeleteAllWithTag delete all the keys with tag t, get the number of deleted keys
+func (tx *Tx) DeleteAllWithTag(t string) (int64, error) {
+	return tx.deleteKeys(tx.stmts.keysTag, tx.stmts.deleteTag, t)
+}
+
+// DeleteWhereTagLT delete all the keys with a tag less than t, the keys of buckets,
+// locks and queues are kept. Get the number of deleted keys
+func (tx *Tx) DeleteWhereTagLT(t string) (int64, error) {
+	return tx.deleteKeys(tx.stmts.keysTagLT, tx.stmts.deleteTagLT, t)
+}
+
+// DeleteTagRange delete all the keys with begin <= tag < end, an empty end means no upper bound.
+// The keys of buckets, locks and queues are kept. Get the number of deleted keys
+func (tx *Tx) DeleteTagRange(begin string, end string) (int64, error) {
+	return tx.deleteKeys(tx.stmts.keysTagRange, tx.stmts.deleteTagRange, begin, end)
+}
+
+// DeleteAll delete all the data in the store, get the number of deleted keys
+func (tx *Tx) DeleteAll() (int64, error) {
+	return tx.deleteKeys(tx.stmts.keysAll, tx.stmts.deleteAll)
+}
+
+// DeletePrefix delete the keys that start with prefix, the keys of buckets, locks and queues
+// are kept. Get the number of deleted keys
+func (tx *Tx) DeletePrefix(prefix string) (int64, error) {
+	return tx.DeleteRange(prefix, prefixEnd(prefix))
+}
+
+// DeleteRange delete the keys with begin <= key < end, an empty end means no upper bound.
+// The keys of buckets, locks and queues are kept. Get the number of deleted keys
+func (tx *Tx) DeleteRange(begin string, end string) (int64, error) {
+	return tx.deleteKeys(tx.stmts.keysRange, tx.stmts.deleteRange, begin, end, false)
+}
+
+// CountPrefix count the keys that start with prefix, but the keys of buckets, locks and queues
+func (tx *Tx) CountPrefix(prefix string) (int64, error) {
+	return tx.countRange(prefix, prefixEnd(prefix))
+}
+
+// CountRange count the keys with begin <= key < end, an empty end means no upper bound.
+// The keys of buckets, locks and queues are not counted
+func (tx *Tx) CountRange(begin string, end string) (int64, error) {
+	return tx.countRange(begin, end)
+}
+
+// IterateByKeyRangeASC traverse the items with begin <= key < end in ASC order,
+// an empty end means no upper bound
+func (tx *Tx) IterateByKeyRangeASC(
+	begin string,
+	end string,
+	limit int,
+	block func(k *string, t *string, v *string, stop *bool)) error {
+	return tx.iterateByKeyRange(false, begin, end, limit, block)
+}
+
+// IterateByKeyRangeDESC traverse the items with begin <= key < end in DESC order,
+// an empty end means no upper bound
+func (tx *Tx) IterateByKeyRangeDESC(
+	begin string,
+	end string,
+	limit int,
+	block func(k *string, t *string, v *string, stop *bool)) error {
+	return tx.iterateByKeyRange(true, begin, end, limit, block)
+}
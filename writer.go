@@ -0,0 +1,55 @@
+package gokvstore
+
+import (
+	"bytes"
+	"errors"
+	"runtime"
+	"strconv"
+	"sync/atomic"
+)
+
+// ErrInUpdate is returned by the calls to a sqlite store made by the block of an Update
+// of the same database: the block holds the single writer connection, it has to use tx
+var ErrInUpdate = errors.New("gokvstore: the store is used by the block of its own Update, use tx")
+
+// writer tracks the goroutine running the block of an Update on the single writer
+// connection of a sqlite database, the stores of its tables share it
+type writer struct {
+	// holder the id of the goroutine, 0 when the writer is free
+	holder int64
+}
+
+// goroutineID the id of the calling goroutine, from the header of its stack trace
+func goroutineID() int64 {
+	b := make([]byte, 64)
+	b = bytes.TrimPrefix(b[:runtime.Stack(b, false)], []byte("goroutine "))
+	if i := bytes.IndexByte(b, ' '); i >= 0 {
+		b = b[:i]
+	}
+	id, _ := strconv.ParseInt(string(b), 10, 64)
+	return id
+}
+
+// hold mark the writer as held by the calling goroutine until release is called
+func (w *writer) hold() (release func()) {
+	if w == nil {
+		return func() {}
+	}
+	atomic.StoreInt64(&w.holder, goroutineID())
+	return func() {
+		atomic.StoreInt64(&w.holder, 0)
+	}
+}
+
+// check fail with ErrInUpdate when the calling goroutine holds the writer,
+// waiting for the writer would wait for itself
+func (w *writer) check() error {
+	if w == nil {
+		return nil
+	}
+	holder := atomic.LoadInt64(&w.holder)
+	if holder != 0 && holder == goroutineID() {
+		return ErrInUpdate
+	}
+	return nil
+}